@@ -0,0 +1,361 @@
+// Package balancer spreads the requests of an RPCClient over the endpoints of
+// a service, given as a static list or kept up to date by a resolver.
+//
+// Every request is sent to one endpoint picked by the policy of the balancer.
+// An endpoint failing several requests in a row is skipped for a while, then
+// picked again until a request succeeds or it fails once more. With outlier
+// detection, the endpoints failing or much slower than the others are also
+// ejected from the pool for a while, and probed with pings.
+package balancer
+
+import (
+	"context"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/internal/logging"
+	tnet "thunder/net"
+	"thunder/protocol"
+	"time"
+)
+
+// EndpointStats is a snapshot of the state of an endpoint of a balancer.
+type EndpointStats struct {
+	Addr   net.Addr
+	Weight int
+	// Outstanding is the number of requests waiting for a response.
+	Outstanding int64
+	// Latency is the moving average of the response times.
+	Latency time.Duration
+	// Failures is the number of requests failed in a row.
+	Failures int
+	Healthy  bool
+	// Ejected tells whether the outlier detection ejected the endpoint, and
+	// Ejections the number of its recent ejections.
+	Ejected   bool
+	Ejections int
+}
+
+// state is the state of an endpoint, it outlives the updates of the
+// endpoints which keep its address.
+type state struct {
+	outstanding int64
+	failures    int32
+	// unhealthyUntil is the time, in unix nanoseconds, until which the
+	// endpoint is skipped.
+	unhealthyUntil int64
+	// ejectedUntil is the time, in unix nanoseconds, until which the
+	// endpoint is ejected by the outlier detection.
+	ejectedUntil int64
+	// ejections is the number of recent ejections of the endpoint, one of
+	// which is forgotten every BaseEjectionTime after quietSince. They are
+	// guarded by the outlier locker of the balancer.
+	ejections  int
+	quietSince int64
+	// probing is 1 while a probe of the endpoint is in flight
+	probing int32
+
+	latencyLocker sync.Mutex
+	latency       float64
+	sampledAt     time.Time
+}
+
+type endpoint struct {
+	config.Endpoint
+	*state
+}
+
+func (e *endpoint) healthy(now int64) bool {
+	return atomic.LoadInt64(&e.unhealthyUntil) <= now && !e.ejected(now)
+}
+
+func (e *endpoint) triedIn(tried []net.Addr) bool {
+	for _, addr := range tried {
+		if addr.String() == e.Addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// observe adds the response time to the latency, the weight of the previous
+// average decays with the time elapsed since the last sample.
+func (e *endpoint) observe(rtt time.Duration, decay time.Duration) {
+	e.latencyLocker.Lock()
+	defer e.latencyLocker.Unlock()
+	now := time.Now()
+	if e.sampledAt.IsZero() || decay <= 0 {
+		e.latency = float64(rtt)
+	} else {
+		w := math.Exp(-float64(now.Sub(e.sampledAt)) / float64(decay))
+		e.latency = e.latency*w + float64(rtt)*(1-w)
+	}
+	e.sampledAt = now
+}
+
+func (e *endpoint) resetLatency() {
+	e.latencyLocker.Lock()
+	defer e.latencyLocker.Unlock()
+	e.latency = 0
+	e.sampledAt = time.Time{}
+}
+
+func (e *endpoint) averageLatency() float64 {
+	e.latencyLocker.Lock()
+	defer e.latencyLocker.Unlock()
+	return e.latency
+}
+
+// endpoints is a snapshot of the endpoints, with their hash ring when the
+// policy is ConsistentHashBalance, and the ramp up of the endpoints back from
+// an ejection.
+type endpoints struct {
+	list   []*endpoint
+	ring   []ringPoint
+	rampUp time.Duration
+}
+
+// Client sends the requests to the endpoints picked by its policy.
+type Client struct {
+	client         *tnet.RPCClient
+	balancerConfig *config.BalancerConfig
+	logger         logging.Logger
+
+	endpoints    atomic.Value
+	next         uint32
+	updateLocker sync.Mutex
+	cancel       func()
+	// watched tells the watch of a resolved balancer has passed the
+	// endpoints, guarded by updateLocker
+	watched bool
+
+	outlierLocker sync.Mutex
+	stop          chan struct{}
+	stopOnce      sync.Once
+}
+
+// NewClient creates a balancer over the endpoints, requested through the
+// client which may be shared with other balancers. The outlier detection runs
+// until Close.
+func NewClient(client *tnet.RPCClient, list []config.Endpoint, balancerConfig *config.BalancerConfig) *Client {
+	c := &Client{
+		client:         client,
+		balancerConfig: balancerConfig,
+		logger:         balancerConfig.Logger,
+		stop:           make(chan struct{}),
+	}
+	c.endpoints.Store(&endpoints{})
+	c.Update(list)
+	if outlierConfig := balancerConfig.Outlier; outlierConfig != nil && outlierConfig.Interval > 0 {
+		go c.detect()
+	}
+	return c
+}
+
+// NewResolvedClient creates a balancer over the endpoints of the service,
+// resolved and watched by the resolver until Close. The service is watched
+// before it is resolved so no change is missed, the resolved endpoints are
+// dropped if the watch has passed newer ones.
+func NewResolvedClient(ctx context.Context, client *tnet.RPCClient, resolver config.Resolver, service string, balancerConfig *config.BalancerConfig) (*Client, error) {
+	if resolver == nil {
+		return nil, internal.ErrNoResolver
+	}
+	c := NewClient(client, nil, balancerConfig)
+	cancel, err := resolver.Watch(service, func(list []config.Endpoint) {
+		c.updateLocker.Lock()
+		defer c.updateLocker.Unlock()
+		c.watched = true
+		c.update(list)
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.cancel = cancel
+	list, err := resolver.Resolve(ctx, service)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.updateLocker.Lock()
+	defer c.updateLocker.Unlock()
+	if !c.watched {
+		c.update(list)
+	}
+	return c, nil
+}
+
+// Close stops the outlier detection and watching the endpoints of a resolved
+// balancer.
+func (c *Client) Close() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// Update replaces the endpoints, the state of the endpoints which keep their
+// address is kept.
+func (c *Client) Update(list []config.Endpoint) {
+	c.updateLocker.Lock()
+	defer c.updateLocker.Unlock()
+	c.update(list)
+}
+
+func (c *Client) update(list []config.Endpoint) {
+	states := make(map[string]*state)
+	for _, e := range c.snapshot().list {
+		states[e.Addr.String()] = e.state
+	}
+
+	s := &endpoints{list: make([]*endpoint, 0, len(list))}
+	for _, e := range list {
+		if e.Weight <= 0 {
+			e.Weight = 1
+		}
+		st, ok := states[e.Addr.String()]
+		if !ok {
+			st = &state{}
+		}
+		s.list = append(s.list, &endpoint{Endpoint: e, state: st})
+	}
+	if c.balancerConfig.Policy == config.ConsistentHashBalance {
+		s.ring = newRing(s.list, c.balancerConfig.VirtualNodes)
+	}
+	if c.balancerConfig.Outlier != nil {
+		s.rampUp = c.balancerConfig.Outlier.RampUpTime
+	}
+	c.endpoints.Store(s)
+}
+
+func (c *Client) snapshot() *endpoints {
+	return c.endpoints.Load().(*endpoints)
+}
+
+// Endpoints returns the state of the endpoints.
+func (c *Client) Endpoints() []EndpointStats {
+	now := time.Now().UnixNano()
+	list := c.snapshot().list
+	stats := make([]EndpointStats, 0, len(list))
+	c.outlierLocker.Lock()
+	defer c.outlierLocker.Unlock()
+	for _, e := range list {
+		stats = append(stats, EndpointStats{
+			Addr:        e.Addr,
+			Weight:      e.Weight,
+			Outstanding: atomic.LoadInt64(&e.outstanding),
+			Latency:     time.Duration(e.averageLatency()),
+			Failures:    int(atomic.LoadInt32(&e.failures)),
+			Healthy:     e.healthy(now),
+			Ejected:     e.ejected(now),
+			Ejections:   e.ejections,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Addr.String() < stats[j].Addr.String()
+	})
+	return stats
+}
+
+// InvokeSync sends the request to an endpoint and waits for its response, a
+// request retried by the retry policy of the RPCClient goes to another
+// endpoint when there is one.
+func (c *Client) InvokeSync(ctx context.Context, packet *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
+	return c.client.InvokePickedSync(ctx, c.pickAttempt, packet, timeout)
+}
+
+func (c *Client) pickAttempt(ctx context.Context, packet *protocol.Packet, tried []net.Addr) (net.Addr, func(error), error) {
+	e, err := c.pick(packet, tried)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := c.begin(e)
+	return e.Addr, func(err error) {
+		c.done(e, start, err)
+	}, nil
+}
+
+func (c *Client) InvokeAsync(ctx context.Context, packet *protocol.Packet, callback func(future *tnet.ResponseFuture), timeout time.Duration) error {
+	e, err := c.pick(packet, nil)
+	if err != nil {
+		return err
+	}
+	start := c.begin(e)
+	err = c.client.InvokeAsync(ctx, e.Addr, packet, func(future *tnet.ResponseFuture) {
+		c.done(e, start, future.Err)
+		if callback != nil {
+			callback(future)
+		}
+	}, timeout)
+	if err != nil {
+		c.done(e, start, err)
+	}
+	return err
+}
+
+// InvokeOneway sends the request to an endpoint, only the failures to send
+// it count against the health of the endpoint.
+func (c *Client) InvokeOneway(ctx context.Context, packet *protocol.Packet, timeout time.Duration) error {
+	e, err := c.pick(packet, nil)
+	if err != nil {
+		return err
+	}
+	err = c.client.InvokeOneway(ctx, e.Addr, packet, timeout)
+	if err != nil {
+		c.fail(e)
+	}
+	return err
+}
+
+func (c *Client) begin(e *endpoint) time.Time {
+	atomic.AddInt64(&e.outstanding, 1)
+	return time.Now()
+}
+
+// done records the result of a request, the requests canceled by the caller
+// say nothing about the endpoint. The response times of an ejected endpoint
+// are not sampled, it comes back without the latency it was ejected for.
+func (c *Client) done(e *endpoint, start time.Time, err error) {
+	atomic.AddInt64(&e.outstanding, -1)
+	if err == context.Canceled {
+		return
+	}
+	if !e.ejected(time.Now().UnixNano()) {
+		e.observe(time.Since(start), c.balancerConfig.LatencyDecay)
+	}
+	if err != nil {
+		c.fail(e)
+		return
+	}
+	c.recover(e)
+}
+
+func (c *Client) recover(e *endpoint) {
+	atomic.StoreInt32(&e.failures, 0)
+	atomic.StoreInt64(&e.unhealthyUntil, 0)
+}
+
+// fail skips the endpoint for UnhealthyTimeout once it has failed
+// FailureThreshold requests in a row, and again on every failure after that
+// until a request succeeds. It ejects the endpoint once it has failed
+// ConsecutiveFailures requests in a row.
+func (c *Client) fail(e *endpoint) {
+	threshold := c.balancerConfig.FailureThreshold
+	failures := atomic.AddInt32(&e.failures, 1)
+	if outlierConfig := c.balancerConfig.Outlier; outlierConfig != nil && outlierConfig.ConsecutiveFailures > 0 && int(failures) >= outlierConfig.ConsecutiveFailures {
+		c.eject(e, "failures", failures)
+	}
+	if threshold <= 0 || int(failures) < threshold {
+		return
+	}
+	if int(failures) == threshold {
+		c.logger.Warnf("endpoint unhealthy, addr: %s, failures: %d", e.Addr.String(), failures)
+	}
+	atomic.StoreInt64(&e.unhealthyUntil, time.Now().Add(c.balancerConfig.UnhealthyTimeout).UnixNano())
+}
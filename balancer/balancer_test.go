@@ -0,0 +1,483 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"github.com/panjf2000/gnet"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/internal/logging"
+	tnet "thunder/net"
+	"thunder/protocol"
+	"time"
+)
+
+// startedLogger closes started on the first info message, which the server
+// logs once gnet has initialized. gnet sets its global logger on every Serve,
+// so the servers of a test are started one after the other.
+type startedLogger struct {
+	logging.Logger
+	once    sync.Once
+	started chan struct{}
+}
+
+func (l *startedLogger) Infof(format string, args ...interface{}) {
+	l.Logger.Infof(format, args...)
+	l.once.Do(func() {
+		close(l.started)
+	})
+}
+
+// startTestServer starts a server answering code 1 right away and code 2
+// after the delay, both with its address.
+func startTestServer(t *testing.T, delay time.Duration) config.Endpoint {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	serverConfig := config.NewDefaultServerConfig(int32(port))
+	serverConfig.Addr = fmt.Sprintf("tcp://127.0.0.1:%d", port)
+	serverConfig.PrintBanner = false
+	logger := &startedLogger{Logger: serverConfig.Logger, started: make(chan struct{})}
+	serverConfig.Logger = logger
+	s := tnet.NewRPCServer(serverConfig)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	s.RegisterProcessor(1, func(p *protocol.Packet, _ net.Addr) *protocol.Packet {
+		return protocol.NewPacket(1, []byte(addr.String()), nil)
+	})
+	s.RegisterProcessor(2, func(p *protocol.Packet, _ net.Addr) *protocol.Packet {
+		time.Sleep(delay)
+		return protocol.NewPacket(2, []byte(addr.String()), nil)
+	})
+	go s.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = gnet.Stop(ctx, serverConfig.Addr)
+	})
+
+	select {
+	case <-logger.started:
+	case <-time.After(time.Second):
+		t.Fatal("server is not started")
+	}
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr.String()); err == nil {
+			_ = conn.Close()
+			return config.Endpoint{Addr: addr, Weight: 1}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server is not listening on %s", addr.String())
+	return config.Endpoint{}
+}
+
+func newTestClient(policy config.BalancePolicy, list ...config.Endpoint) *Client {
+	balancerConfig := config.NewDefaultBalancerConfig()
+	balancerConfig.Policy = policy
+	balancerConfig.HashKey = "key"
+	return NewClient(tnet.NewRPCClient(config.NewClientConfig()), list, balancerConfig)
+}
+
+// invoke sends count requests and returns the number answered by every
+// address.
+func invoke(t *testing.T, c *Client, code int16, count int, key func(i int) string) map[string]int {
+	t.Helper()
+	answered := make(map[string]int)
+	for i := 0; i < count; i++ {
+		p := protocol.NewPacket(code, nil, nil)
+		if key != nil {
+			p.ExtData = map[string]string{"key": key(i)}
+		}
+		resp, err := c.InvokeSync(context.Background(), p, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answered[string(resp.Body)]++
+	}
+	return answered
+}
+
+func TestRoundRobin(t *testing.T) {
+	e1, e2, e3 := startTestServer(t, 0), startTestServer(t, 0), startTestServer(t, 0)
+	c := newTestClient(config.RoundRobinBalance, e1, e2, e3)
+	for addr, n := range invoke(t, c, 1, 9, nil) {
+		if n != 3 {
+			t.Fatalf("%s answered %d requests out of 9", addr, n)
+		}
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	e1, e2 := startTestServer(t, 0), startTestServer(t, 0)
+	e1.Weight = 9
+	c := newTestClient(config.WeightedRandomBalance, e1, e2)
+	if n := invoke(t, c, 1, 200, nil)[e1.Addr.String()]; n < 150 || n == 200 {
+		t.Fatalf("endpoint of weight 9 out of 10 answered %d requests out of 200", n)
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	e1, e2 := startTestServer(t, 300*time.Millisecond), startTestServer(t, 300*time.Millisecond)
+	c := newTestClient(config.LeastOutstandingBalance, e1, e2)
+	slow := make(chan string, 1)
+	err := c.InvokeAsync(context.Background(), protocol.NewPacket(2, nil, nil), func(f *tnet.ResponseFuture) {
+		slow <- string(f.Response.Body)
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answered := invoke(t, c, 1, 5, nil)
+	busy := <-slow
+	if answered[busy] != 0 {
+		t.Fatalf("busy endpoint %s answered %d requests", busy, answered[busy])
+	}
+}
+
+func TestLeastLatency(t *testing.T) {
+	fast, slow := startTestServer(t, 0), startTestServer(t, 50*time.Millisecond)
+	c := newTestClient(config.LeastLatencyBalance, fast, slow)
+	if n := invoke(t, c, 2, 20, nil)[slow.Addr.String()]; n > 2 {
+		t.Fatalf("slow endpoint answered %d requests out of 20", n)
+	}
+	stats := c.Endpoints()
+	if stats[0].Latency == 0 || stats[1].Latency == 0 {
+		t.Fatalf("latency not measured: %+v", stats)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	e1, e2, e3 := startTestServer(t, 0), startTestServer(t, 0), startTestServer(t, 0)
+	c := newTestClient(config.ConsistentHashBalance, e1, e2, e3)
+	owners := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		key := strconv.Itoa(i)
+		answered := invoke(t, c, 1, 3, func(int) string { return key })
+		if len(answered) != 1 {
+			t.Fatalf("key %s is sent to %d endpoints", key, len(answered))
+		}
+		for addr := range answered {
+			owners[key] = addr
+		}
+	}
+	if len(invoke(t, c, 1, 30, func(i int) string { return strconv.Itoa(i) })) != 3 {
+		t.Fatal("keys are not spread over the endpoints")
+	}
+
+	// only the keys of a removed endpoint move
+	c.Update([]config.Endpoint{e1, e2})
+	for key, owner := range owners {
+		for addr := range invoke(t, c, 1, 1, func(int) string { return key }) {
+			if owner != e3.Addr.String() && addr != owner {
+				t.Fatalf("key %s moved from %s to %s", key, owner, addr)
+			}
+		}
+	}
+}
+
+func TestUnhealthyEndpoint(t *testing.T) {
+	e := startTestServer(t, 0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := config.Endpoint{Addr: l.Addr(), Weight: 1}
+	_ = l.Close()
+
+	balancerConfig := config.NewDefaultBalancerConfig()
+	balancerConfig.FailureThreshold = 2
+	c := NewClient(tnet.NewRPCClient(config.NewClientConfig()), []config.Endpoint{e, down}, balancerConfig)
+	failed := 0
+	for i := 0; i < 10; i++ {
+		if _, err := c.InvokeSync(context.Background(), protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Fatalf("%d requests failed, want 2", failed)
+	}
+	for _, stats := range c.Endpoints() {
+		if stats.Healthy != (stats.Addr == e.Addr) {
+			t.Fatalf("unexpected health: %+v", stats)
+		}
+	}
+}
+
+func TestRetryOtherEndpoint(t *testing.T) {
+	e := startTestServer(t, 0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := config.Endpoint{Addr: l.Addr(), Weight: 1}
+	_ = l.Close()
+
+	clientConfig := config.NewClientConfig()
+	clientConfig.RetryPolicies = map[int16]*config.RetryPolicy{1: config.NewDefaultRetryPolicy()}
+	balancerConfig := config.NewDefaultBalancerConfig()
+	balancerConfig.FailureThreshold = 0
+	c := NewClient(tnet.NewRPCClient(clientConfig), []config.Endpoint{down, e}, balancerConfig)
+	if answered := invoke(t, c, 1, 6, nil); answered[e.Addr.String()] != 6 {
+		t.Fatalf("unexpected answers: %v", answered)
+	}
+	for _, stats := range c.Endpoints() {
+		if stats.Addr == down.Addr && stats.Failures == 0 {
+			t.Fatal("unreachable endpoint is not invoked")
+		}
+	}
+}
+
+// downEndpoint returns an endpoint nothing listens on.
+func downEndpoint(t *testing.T) config.Endpoint {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+	return config.Endpoint{Addr: l.Addr(), Weight: 1}
+}
+
+func newOutlierClient(outlierConfig *config.OutlierConfig, list ...config.Endpoint) *Client {
+	balancerConfig := config.NewDefaultBalancerConfig()
+	balancerConfig.FailureThreshold = 0
+	balancerConfig.Outlier = outlierConfig
+	return NewClient(tnet.NewRPCClient(config.NewClientConfig()), list, balancerConfig)
+}
+
+func TestLatencyOutlier(t *testing.T) {
+	e1, e2, e3 := startTestServer(t, 0), startTestServer(t, 0), startTestServer(t, 0)
+	slow := startTestServer(t, 50*time.Millisecond)
+	outlierConfig := config.NewDefaultOutlierConfig()
+	outlierConfig.ConsecutiveFailures = 0
+	outlierConfig.MinLatency = 20 * time.Millisecond
+	outlierConfig.Interval = 20 * time.Millisecond
+	outlierConfig.BaseEjectionTime = 300 * time.Millisecond
+	outlierConfig.RampUpTime = 0
+	outlierConfig.ProbeTimeout = 0
+	c := newOutlierClient(outlierConfig, e1, e2, e3, slow)
+	defer c.Close()
+
+	invoke(t, c, 2, 8, nil)
+	time.Sleep(100 * time.Millisecond)
+	for _, stats := range c.Endpoints() {
+		if stats.Ejected != (stats.Addr == slow.Addr) {
+			t.Fatalf("unexpected ejection: %+v", stats)
+		}
+	}
+	if n := invoke(t, c, 1, 12, nil)[slow.Addr.String()]; n != 0 {
+		t.Fatalf("ejected endpoint answered %d requests", n)
+	}
+
+	// the endpoint is back once its ejection ends
+	time.Sleep(300 * time.Millisecond)
+	if n := invoke(t, c, 1, 12, nil)[slow.Addr.String()]; n != 3 {
+		t.Fatalf("endpoint back from ejection answered %d requests out of 12: %+v", n, c.Endpoints())
+	}
+}
+
+func TestFailureOutlier(t *testing.T) {
+	e, down := startTestServer(t, 0), downEndpoint(t)
+	outlierConfig := config.NewDefaultOutlierConfig()
+	outlierConfig.ConsecutiveFailures = 2
+	outlierConfig.LatencyFactor = 0
+	outlierConfig.Interval = 20 * time.Millisecond
+	outlierConfig.BaseEjectionTime = 100 * time.Millisecond
+	outlierConfig.MaxEjectionTime = 150 * time.Millisecond
+	outlierConfig.RampUpTime = 0
+	outlierConfig.ProbeTimeout = 100 * time.Millisecond
+	c := newOutlierClient(outlierConfig, e, down)
+	defer c.Close()
+
+	// the probes keep failing the ejected endpoint, which is ejected again on
+	// its first request once back
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, _ = c.InvokeSync(context.Background(), protocol.NewPacket(1, nil, nil), time.Second)
+		stats := c.Endpoints()
+		if stats[0].Ejected != (stats[0].Addr == down.Addr) && stats[1].Ejected != (stats[1].Addr == down.Addr) {
+			t.Fatalf("unexpected ejection: %+v", stats)
+		}
+		for _, s := range stats {
+			if s.Addr == down.Addr && s.Ejections >= 2 {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("endpoint is not ejected twice: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	e := startTestServer(t, 0)
+	outlierConfig := config.NewDefaultOutlierConfig()
+	outlierConfig.ConsecutiveFailures = 0
+	outlierConfig.LatencyFactor = 0
+	outlierConfig.Interval = 20 * time.Millisecond
+	outlierConfig.ProbeTimeout = 100 * time.Millisecond
+	balancerConfig := config.NewDefaultBalancerConfig()
+	balancerConfig.FailureThreshold = 2
+	balancerConfig.UnhealthyTimeout = time.Minute
+	balancerConfig.Outlier = outlierConfig
+	c := NewClient(tnet.NewRPCClient(config.NewClientConfig()), []config.Endpoint{e}, balancerConfig)
+	defer c.Close()
+
+	// a successful probe brings the unhealthy endpoint back, the failures of
+	// its requests are kept
+	endpoint := c.snapshot().list[0]
+	c.fail(endpoint)
+	c.fail(endpoint)
+	if stats := c.Endpoints()[0]; stats.Healthy {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !c.Endpoints()[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("endpoint is not probed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := c.Endpoints()[0]; stats.Failures != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestMaxEjectionPercent(t *testing.T) {
+	e, down1, down2 := startTestServer(t, 0), downEndpoint(t), downEndpoint(t)
+	outlierConfig := config.NewDefaultOutlierConfig()
+	outlierConfig.ConsecutiveFailures = 1
+	outlierConfig.LatencyFactor = 0
+	outlierConfig.Interval = 20 * time.Millisecond
+	outlierConfig.BaseEjectionTime = 50 * time.Millisecond
+	outlierConfig.RampUpTime = 0
+	outlierConfig.ProbeTimeout = 100 * time.Millisecond
+	c := newOutlierClient(outlierConfig, e, down1, down2)
+	defer c.Close()
+
+	ejections := 0
+	for i := 0; i < 30; i++ {
+		_, _ = c.InvokeSync(context.Background(), protocol.NewPacket(1, nil, nil), time.Second)
+		ejected := 0
+		for _, stats := range c.Endpoints() {
+			if stats.Ejected {
+				ejected++
+			}
+			ejections += stats.Ejections
+		}
+		if ejected > 1 {
+			t.Fatalf("%d endpoints out of 3 ejected", ejected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ejections == 0 {
+		t.Fatal("no endpoint is ejected")
+	}
+}
+
+func TestRampUp(t *testing.T) {
+	e1, e2 := startTestServer(t, 0), startTestServer(t, 0)
+	outlierConfig := config.NewDefaultOutlierConfig()
+	outlierConfig.Interval = 0
+	outlierConfig.BaseEjectionTime = 50 * time.Millisecond
+	outlierConfig.RampUpTime = 500 * time.Millisecond
+	c := newOutlierClient(outlierConfig, e1, e2)
+	defer c.Close()
+
+	c.eject(c.snapshot().list[1], "test", nil)
+	time.Sleep(200 * time.Millisecond)
+	// the endpoint gets a small share of the requests early in its ramp up
+	if n := invoke(t, c, 1, 40, nil)[e2.Addr.String()]; n == 0 || n > 15 {
+		t.Fatalf("endpoint ramping up answered %d requests out of 40", n)
+	}
+}
+
+// staticResolver resolves a single service which the tests update. resolved,
+// when set, is called after the endpoints are read.
+type staticResolver struct {
+	lock      sync.Mutex
+	endpoints []config.Endpoint
+	onChange  func([]config.Endpoint)
+	resolved  func()
+}
+
+func (r *staticResolver) Resolve(ctx context.Context, service string) ([]config.Endpoint, error) {
+	r.lock.Lock()
+	endpoints, resolved := r.endpoints, r.resolved
+	r.lock.Unlock()
+	if resolved != nil {
+		resolved()
+	}
+	return endpoints, nil
+}
+
+func (r *staticResolver) Watch(service string, onChange func([]config.Endpoint)) (func(), error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.onChange = onChange
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.onChange = nil
+	}, nil
+}
+
+func (r *staticResolver) set(endpoints ...config.Endpoint) {
+	r.lock.Lock()
+	r.endpoints = endpoints
+	onChange := r.onChange
+	r.lock.Unlock()
+	if onChange != nil {
+		onChange(endpoints)
+	}
+}
+
+func TestResolvedClient(t *testing.T) {
+	client := tnet.NewRPCClient(config.NewClientConfig())
+	if _, err := NewResolvedClient(context.Background(), client, nil, "echo", config.NewDefaultBalancerConfig()); err != internal.ErrNoResolver {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolver := &staticResolver{}
+	c, err := NewResolvedClient(context.Background(), client, resolver, "echo", config.NewDefaultBalancerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.InvokeSync(context.Background(), protocol.NewPacket(1, nil, nil), time.Second); err != internal.ErrNoEndpoints {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	e1, e2 := startTestServer(t, 0), startTestServer(t, 0)
+	resolver.set(e1, e2)
+	if answered := invoke(t, c, 1, 4, nil); len(answered) != 2 {
+		t.Fatalf("requests are not spread over the resolved endpoints: %v", answered)
+	}
+	resolver.set(e2)
+	if answered := invoke(t, c, 1, 4, nil); answered[e2.Addr.String()] != 4 {
+		t.Fatalf("removed endpoint is still invoked: %v", answered)
+	}
+
+	// the change between the watch and the resolution is not lost to the
+	// older resolved endpoints
+	moved := &staticResolver{endpoints: []config.Endpoint{e1}}
+	moved.resolved = func() {
+		moved.set(e2)
+	}
+	c, err = NewResolvedClient(context.Background(), client, moved, "echo", config.NewDefaultBalancerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if answered := invoke(t, c, 1, 4, nil); answered[e2.Addr.String()] != 4 {
+		t.Fatalf("changed endpoint is not invoked: %v", answered)
+	}
+}
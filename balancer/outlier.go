@@ -0,0 +1,135 @@
+package balancer
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ejected reports whether the endpoint is ejected at the time.
+func (e *endpoint) ejected(now int64) bool {
+	return atomic.LoadInt64(&e.ejectedUntil) > now
+}
+
+// ramped reports whether a request can go to the endpoint, which gets a share
+// of its requests growing from none to all over the ramp up after an
+// ejection.
+func (e *endpoint) ramped(now int64, rampUp time.Duration) bool {
+	back := now - atomic.LoadInt64(&e.ejectedUntil)
+	if rampUp <= 0 || back >= int64(rampUp) {
+		return true
+	}
+	return back > 0 && rand.Int63n(int64(rampUp)) < back
+}
+
+// detect ejects the latency outliers and probes the ejected and unhealthy
+// endpoints every interval until Close.
+func (c *Client) detect() {
+	ticker := time.NewTicker(c.balancerConfig.Outlier.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *Client) sweep() {
+	outlierConfig := c.balancerConfig.Outlier
+	list := c.snapshot().list
+	now := time.Now().UnixNano()
+	if outlierConfig.ProbeTimeout > 0 {
+		for _, e := range list {
+			if !e.healthy(now) && atomic.CompareAndSwapInt32(&e.probing, 0, 1) {
+				go c.probe(e)
+			}
+		}
+	}
+
+	c.outlierLocker.Lock()
+	for _, e := range list {
+		if e.ejections > 0 && !e.ejected(now) && now-e.quietSince >= int64(outlierConfig.BaseEjectionTime) {
+			e.ejections--
+			e.quietSince = now
+		}
+	}
+	c.outlierLocker.Unlock()
+
+	if outlierConfig.LatencyFactor <= 0 {
+		return
+	}
+	var sampled []*endpoint
+	var latencies []float64
+	for _, e := range list {
+		if latency := e.averageLatency(); latency > 0 && !e.ejected(now) {
+			sampled = append(sampled, e)
+			latencies = append(latencies, latency)
+		}
+	}
+	if len(sampled) == 0 || len(sampled) < outlierConfig.MinLatencyEndpoints {
+		return
+	}
+	sort.Float64s(latencies)
+	median := latencies[len(latencies)/2]
+	if len(latencies)%2 == 0 {
+		median = (median + latencies[len(latencies)/2-1]) / 2
+	}
+	for _, e := range sampled {
+		latency := e.averageLatency()
+		if latency > outlierConfig.LatencyFactor*median && latency >= float64(outlierConfig.MinLatency) {
+			c.eject(e, "latency", time.Duration(latency))
+		}
+	}
+}
+
+// probe pings the endpoint, a failed ping counts as a failed request. A
+// successful one ends the unhealthy period of the endpoint but keeps the
+// failures of its requests, only a successful request resets them.
+func (c *Client) probe(e *endpoint) {
+	defer atomic.StoreInt32(&e.probing, 0)
+	err := c.client.Ping(context.Background(), e.Addr, c.balancerConfig.Outlier.ProbeTimeout)
+	if err != nil {
+		c.fail(e)
+		return
+	}
+	atomic.StoreInt64(&e.unhealthyUntil, 0)
+}
+
+// eject takes the endpoint out of the pool for a period growing with the
+// number of its recent ejections, unless as many endpoints as allowed are
+// ejected already.
+func (c *Client) eject(e *endpoint, reason string, value interface{}) {
+	outlierConfig := c.balancerConfig.Outlier
+	c.outlierLocker.Lock()
+	defer c.outlierLocker.Unlock()
+	now := time.Now().UnixNano()
+	if e.ejected(now) {
+		return
+	}
+	list := c.snapshot().list
+	ejected := 0
+	for _, other := range list {
+		if other.ejected(now) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > outlierConfig.MaxEjectionPercent*len(list) {
+		return
+	}
+
+	e.ejections++
+	period := outlierConfig.BaseEjectionTime * time.Duration(e.ejections)
+	if outlierConfig.MaxEjectionTime > 0 && period > outlierConfig.MaxEjectionTime {
+		period = outlierConfig.MaxEjectionTime
+	}
+	e.quietSince = now + int64(period)
+	atomic.StoreInt64(&e.ejectedUntil, e.quietSince)
+	atomic.StoreInt32(&e.failures, 0)
+	e.resetLatency()
+	c.logger.Warnf("endpoint ejected, addr: %s, %s: %v, ejections: %d, period: %v", e.Addr.String(), reason, value, e.ejections, period)
+}
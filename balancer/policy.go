@@ -0,0 +1,165 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+type ringPoint struct {
+	hash     uint32
+	endpoint *endpoint
+}
+
+// newRing places virtualNodes points per unit of weight of every endpoint on
+// the hash ring.
+func newRing(list []*endpoint, virtualNodes int) []ringPoint {
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+	var ring []ringPoint
+	for _, e := range list {
+		addr := e.Addr.String()
+		for i := 0; i < e.Weight*virtualNodes; i++ {
+			ring = append(ring, ringPoint{hash: hash(addr + "#" + strconv.Itoa(i)), endpoint: e})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return ring
+}
+
+// hash is FNV-1a followed by the murmur3 finalizer, FNV alone leaves close
+// keys close on the ring.
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// pick returns the endpoint of the request. The unhealthy endpoints are
+// skipped unless they all are, and so are the tried ones, the endpoints the
+// previous attempts of the request went to.
+func (c *Client) pick(packet *protocol.Packet, tried []net.Addr) (*endpoint, error) {
+	s := c.snapshot()
+	if len(s.list) == 0 {
+		return nil, internal.ErrNoEndpoints
+	}
+	now := time.Now().UnixNano()
+	if c.balancerConfig.Policy == config.ConsistentHashBalance && c.balancerConfig.HashKey != "" {
+		if key, ok := packet.ExtData[c.balancerConfig.HashKey]; ok {
+			return s.lookup(key, now, tried), nil
+		}
+	}
+
+	candidates := s.candidates(now, tried)
+	switch c.balancerConfig.Policy {
+	case config.WeightedRandomBalance:
+		total := 0
+		for _, e := range candidates {
+			total += e.Weight
+		}
+		n := rand.Intn(total)
+		for _, e := range candidates {
+			if n -= e.Weight; n < 0 {
+				return e, nil
+			}
+		}
+	case config.LeastOutstandingBalance:
+		// start at a random endpoint so the ties are spread
+		offset := rand.Intn(len(candidates))
+		var picked *endpoint
+		for i := range candidates {
+			e := candidates[(offset+i)%len(candidates)]
+			if picked == nil || atomic.LoadInt64(&e.outstanding) < atomic.LoadInt64(&picked.outstanding) {
+				picked = e
+			}
+		}
+		return picked, nil
+	case config.LeastLatencyBalance:
+		if len(candidates) == 1 {
+			return candidates[0], nil
+		}
+		i := rand.Intn(len(candidates))
+		j := rand.Intn(len(candidates) - 1)
+		if j >= i {
+			j++
+		}
+		if cost(candidates[j]) < cost(candidates[i]) {
+			return candidates[j], nil
+		}
+		return candidates[i], nil
+	}
+	return candidates[atomic.AddUint32(&c.next, 1)%uint32(len(candidates))], nil
+}
+
+// cost is the expected wait of a request sent to the endpoint, an endpoint
+// without samples yet costs nothing so it gets some.
+func cost(e *endpoint) float64 {
+	return e.averageLatency() * float64(atomic.LoadInt64(&e.outstanding)+1)
+}
+
+// candidates returns the healthy endpoints not tried yet, or the healthy
+// ones if they have all been tried, or all of them if none is healthy. An
+// endpoint back from an ejection only counts as healthy for a share of the
+// requests during its ramp up.
+func (s *endpoints) candidates(now int64, tried []net.Addr) []*endpoint {
+	healthy := make([]*endpoint, 0, len(s.list))
+	untried := make([]*endpoint, 0, len(s.list))
+	for _, e := range s.list {
+		if e.healthy(now) && e.ramped(now, s.rampUp) {
+			healthy = append(healthy, e)
+			if !e.triedIn(tried) {
+				untried = append(untried, e)
+			}
+		}
+	}
+	switch {
+	case len(untried) > 0:
+		return untried
+	case len(healthy) > 0:
+		return healthy
+	default:
+		return s.list
+	}
+}
+
+// lookup returns the first healthy endpoint not tried yet clockwise from the
+// key on the hash ring, with the same fallbacks as candidates.
+func (s *endpoints) lookup(key string, now int64, tried []net.Addr) *endpoint {
+	h := hash(key)
+	start := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= h
+	})
+	var healthy *endpoint
+	for i := 0; i < len(s.ring); i++ {
+		e := s.ring[(start+i)%len(s.ring)].endpoint
+		if !e.healthy(now) || !e.ramped(now, s.rampUp) {
+			continue
+		}
+		if !e.triedIn(tried) {
+			return e
+		}
+		if healthy == nil {
+			healthy = e
+		}
+	}
+	if healthy != nil {
+		return healthy
+	}
+	return s.ring[start%len(s.ring)].endpoint
+}
@@ -0,0 +1,499 @@
+// Package broker turns an RPCServer into a small in-memory message broker.
+//
+// Producers send messages to named topics. Every consumer group of a topic
+// gets each message, the consumers of a group compete for them: a message is
+// delivered to one consumer of the group, which acks it once handled, and is
+// delivered again to the next consumer if the ack does not come in time.
+package broker
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/internal/logging"
+	"thunder/internal/timingwheel"
+	tnet "thunder/net"
+	"thunder/protocol"
+)
+
+// The codes of the broker requests, they are reserved on the servers and
+// clients of a broker.
+const (
+	CodeSend        int16 = -100
+	CodeSubscribe   int16 = -101
+	CodeUnsubscribe int16 = -102
+	CodeDeliver     int16 = -103
+	CodeAck         int16 = -104
+)
+
+// attrClientId is the attribute holding the client id of the consumer
+// connections.
+const attrClientId = "broker.clientId"
+
+// the ext data keys of the broker requests
+const (
+	keyTopic      = "topic"
+	keyGroup      = "group"
+	keyClientId   = "clientId"
+	keyMessageId  = "messageId"
+	keyDeliveries = "deliveries"
+)
+
+// TopicStats is a snapshot of the consumer groups of a topic.
+type TopicStats struct {
+	Topic string
+	// Backlog is the number of messages sent before the topic had a
+	// consumer group, they go to the first group.
+	Backlog int
+	// Dropped is the number of messages sent oneway which were dropped for
+	// a full queue.
+	Dropped int
+	Groups  []GroupStats
+}
+
+type GroupStats struct {
+	Group     string
+	Consumers int
+	// Queued is the number of messages waiting for a consumer, Inflight the
+	// number of messages delivered and not acked yet.
+	Queued   int
+	Inflight int
+}
+
+type message struct {
+	// seq orders the messages as sent, id is its string
+	seq        uint64
+	id         string
+	body       []byte
+	deliveries int
+}
+
+type consumer struct {
+	clientId string
+	inflight int
+}
+
+type delivery struct {
+	message  *message
+	consumer *consumer
+	timer    timingwheel.Timer
+}
+
+type group struct {
+	name      string
+	queue     *list.List
+	consumers []*consumer
+	next      int
+	inflight  map[string]*delivery
+	// retry delivers the queue again after a failed delivery
+	retry timingwheel.Timer
+}
+
+// topic holds the consumer groups of a topic, all guarded by its lock.
+type topic struct {
+	name    string
+	lock    sync.Mutex
+	backlog *list.List
+	dropped int
+	groups  map[string]*group
+}
+
+type Broker struct {
+	server       *tnet.RPCServer
+	brokerConfig *config.BrokerConfig
+	logger       logging.Logger
+	wheel        *timingwheel.TimingWheel
+
+	topicsLocker sync.Mutex
+	topics       map[string]*topic
+	nextId       uint64
+}
+
+// New registers the processors of the broker on the server, the broker
+// consumers have to register a client id, see NewClient. The consumers of a
+// client are removed once its last connection closes.
+func New(server *tnet.RPCServer, brokerConfig *config.BrokerConfig) *Broker {
+	b := &Broker{
+		server:       server,
+		brokerConfig: brokerConfig,
+		logger:       brokerConfig.Logger,
+		wheel:        timingwheel.New(brokerConfig.TimerTick, timingwheel.DefaultSlots),
+		topics:       make(map[string]*topic),
+	}
+	server.RegisterProcessor(CodeSend, b.processSend)
+	server.RegisterContextProcessor(CodeSubscribe, b.processSubscribe)
+	server.RegisterProcessor(CodeUnsubscribe, b.processUnsubscribe)
+	server.RegisterProcessor(CodeAck, b.processAck)
+	server.AddEventListener(&disconnector{broker: b})
+	return b
+}
+
+// Stats returns the state of the topics.
+func (b *Broker) Stats() []TopicStats {
+	b.topicsLocker.Lock()
+	topics := make([]*topic, 0, len(b.topics))
+	for _, t := range b.topics {
+		topics = append(topics, t)
+	}
+	b.topicsLocker.Unlock()
+
+	stats := make([]TopicStats, 0, len(topics))
+	for _, t := range topics {
+		t.lock.Lock()
+		s := TopicStats{Topic: t.name, Backlog: t.backlog.Len(), Dropped: t.dropped}
+		for _, g := range t.groups {
+			s.Groups = append(s.Groups, GroupStats{
+				Group:     g.name,
+				Consumers: len(g.consumers),
+				Queued:    g.queue.Len(),
+				Inflight:  len(g.inflight),
+			})
+		}
+		t.lock.Unlock()
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+func (b *Broker) topic(name string) *topic {
+	b.topicsLocker.Lock()
+	defer b.topicsLocker.Unlock()
+	t, ok := b.topics[name]
+	if !ok {
+		t = &topic{
+			name:    name,
+			backlog: list.New(),
+			groups:  make(map[string]*group),
+		}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// send queues the message in every group of the topic, or in the backlog of
+// the topic until it has a group. The message is rejected if one of the
+// queues is full.
+func (b *Broker) send(name string, body []byte) (string, error) {
+	t := b.topic(name)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.groups) == 0 {
+		if t.backlog.Len() >= b.brokerConfig.QueueSize {
+			return "", internal.ErrQueueFull
+		}
+		m := b.newMessage(body)
+		t.backlog.PushBack(m)
+		return m.id, nil
+	}
+
+	for _, g := range t.groups {
+		if g.queue.Len() >= b.brokerConfig.QueueSize {
+			return "", internal.ErrQueueFull
+		}
+	}
+	m := b.newMessage(body)
+	for _, g := range t.groups {
+		g.queue.PushBack(&message{seq: m.seq, id: m.id, body: body})
+		b.dispatch(t, g)
+	}
+	return m.id, nil
+}
+
+// drop counts a message sent oneway to the topic and rejected, its sender is
+// not told.
+func (b *Broker) drop(name string) {
+	t := b.topic(name)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.dropped++
+}
+
+func (b *Broker) lookup(name string) (*topic, bool) {
+	b.topicsLocker.Lock()
+	defer b.topicsLocker.Unlock()
+	t, ok := b.topics[name]
+	return t, ok
+}
+
+func (b *Broker) newMessage(body []byte) *message {
+	seq := atomic.AddUint64(&b.nextId, 1)
+	return &message{seq: seq, id: strconv.FormatUint(seq, 10), body: body}
+}
+
+// subscribe adds the consumer to the group, the first group of a topic takes
+// over the backlog of the topic.
+func (b *Broker) subscribe(name, groupName, clientId string) {
+	t := b.topic(name)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	g, ok := t.groups[groupName]
+	if !ok {
+		g = &group{
+			name:     groupName,
+			queue:    list.New(),
+			inflight: make(map[string]*delivery),
+		}
+		if len(t.groups) == 0 {
+			g.queue, t.backlog = t.backlog, g.queue
+		}
+		t.groups[groupName] = g
+	}
+	for _, c := range g.consumers {
+		if c.clientId == clientId {
+			return
+		}
+	}
+	g.consumers = append(g.consumers, &consumer{clientId: clientId})
+	b.dispatch(t, g)
+}
+
+func (b *Broker) unsubscribe(name, groupName, clientId string) {
+	t, ok := b.lookup(name)
+	if !ok {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	g, ok := t.groups[groupName]
+	if !ok {
+		return
+	}
+	for _, c := range g.consumers {
+		if c.clientId == clientId {
+			b.removeConsumer(t, g, c)
+			return
+		}
+	}
+}
+
+// removeClient removes the consumers of the client from all the groups.
+func (b *Broker) removeClient(clientId string) {
+	b.topicsLocker.Lock()
+	topics := make([]*topic, 0, len(b.topics))
+	for _, t := range b.topics {
+		topics = append(topics, t)
+	}
+	b.topicsLocker.Unlock()
+
+	for _, t := range topics {
+		t.lock.Lock()
+		for _, g := range t.groups {
+			for _, c := range g.consumers {
+				if c.clientId == clientId {
+					b.removeConsumer(t, g, c)
+					break
+				}
+			}
+		}
+		t.lock.Unlock()
+	}
+}
+
+// removeConsumer removes the consumer from the group and queues the messages
+// it has not acked again, ahead of the queue in the order they were sent.
+func (b *Broker) removeConsumer(t *topic, g *group, c *consumer) {
+	for i, consumer := range g.consumers {
+		if consumer == c {
+			g.consumers = append(g.consumers[:i:i], g.consumers[i+1:]...)
+			break
+		}
+	}
+	var messages []*message
+	for id, d := range g.inflight {
+		if d.consumer == c {
+			b.wheel.Stop(&d.timer)
+			delete(g.inflight, id)
+			messages = append(messages, d.message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].seq < messages[j].seq
+	})
+	for i := len(messages) - 1; i >= 0; i-- {
+		g.queue.PushFront(messages[i])
+	}
+	b.dispatch(t, g)
+}
+
+// dispatch delivers the queued messages of the group to its consumers in
+// turn, as long as they have room for more. A consumer whose client is not
+// connected is removed, the queue is delivered again after RetryInterval when
+// a delivery fails otherwise.
+func (b *Broker) dispatch(t *topic, g *group) {
+	for g.queue.Len() > 0 {
+		c := g.pick(b.brokerConfig.MaxInflight)
+		if c == nil {
+			return
+		}
+		m := g.queue.Remove(g.queue.Front()).(*message)
+		m.deliveries++
+		err := b.server.InvokeClientOneway(context.Background(), c.clientId, newDeliver(t.name, g.name, m), 0)
+		if err != nil {
+			m.deliveries--
+			g.queue.PushFront(m)
+			if err == internal.ErrClientNotFound {
+				b.removeConsumer(t, g, c)
+				return
+			}
+			b.logger.Warnf("deliver message error, topic: %s, group: %s, client: %s, err: %v", t.name, g.name, c.clientId, err)
+			b.wheel.Add(&g.retry, b.brokerConfig.RetryInterval, func() {
+				go b.redispatch(t, g)
+			})
+			return
+		}
+
+		d := &delivery{message: m, consumer: c}
+		c.inflight++
+		g.inflight[m.id] = d
+		b.wheel.Add(&d.timer, b.brokerConfig.AckTimeout, func() {
+			go b.expire(t, g, d)
+		})
+	}
+}
+
+func (b *Broker) redispatch(t *topic, g *group) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	b.dispatch(t, g)
+}
+
+// pick returns the next consumer of the group with room for another message.
+func (g *group) pick(maxInflight int) *consumer {
+	for i := 0; i < len(g.consumers); i++ {
+		g.next = (g.next + 1) % len(g.consumers)
+		if c := g.consumers[g.next]; maxInflight <= 0 || c.inflight < maxInflight {
+			return c
+		}
+	}
+	return nil
+}
+
+// expire queues the message of a delivery which has not been acked in time
+// again.
+func (b *Broker) expire(t *topic, g *group, d *delivery) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if g.inflight[d.message.id] != d {
+		return
+	}
+	delete(g.inflight, d.message.id)
+	d.consumer.inflight--
+	g.queue.PushFront(d.message)
+	b.dispatch(t, g)
+}
+
+// ack completes the delivery of the message, the acks of a consumer which is
+// no longer delivered the message are dropped.
+func (b *Broker) ack(name, groupName, clientId, id string) {
+	t, ok := b.lookup(name)
+	if !ok {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	g, ok := t.groups[groupName]
+	if !ok {
+		return
+	}
+	d, ok := g.inflight[id]
+	if !ok || d.consumer.clientId != clientId {
+		return
+	}
+	b.wheel.Stop(&d.timer)
+	delete(g.inflight, id)
+	d.consumer.inflight--
+	b.dispatch(t, g)
+}
+
+func newDeliver(topic, group string, m *message) *protocol.Packet {
+	p := protocol.NewPacket(CodeDeliver, m.body, nil)
+	p.MarkOneway()
+	p.ExtData = map[string]string{
+		keyTopic:      topic,
+		keyGroup:      group,
+		keyMessageId:  m.id,
+		keyDeliveries: strconv.Itoa(m.deliveries),
+	}
+	return p
+}
+
+func newResponse(code int16, message string) *protocol.Packet {
+	p := protocol.NewPacket(code, nil, nil)
+	p.Message = message
+	return p
+}
+
+func (b *Broker) processSend(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+	name := p.ExtData[keyTopic]
+	if name == "" {
+		return newResponse(internal.BadRequest, "missing topic")
+	}
+	// the body of a pooled request is released with it
+	id, err := b.send(name, append([]byte(nil), p.Body...))
+	if err == internal.ErrQueueFull {
+		if p.IsOneway() {
+			b.drop(name)
+		}
+		return newResponse(internal.QueueFull, err.Error())
+	}
+	resp := newResponse(internal.Success, "")
+	resp.ExtData = map[string]string{keyMessageId: id}
+	return resp
+}
+
+func (b *Broker) processSubscribe(ctx context.Context, p *protocol.Packet) *protocol.Packet {
+	name, group, clientId := p.ExtData[keyTopic], p.ExtData[keyGroup], p.ExtData[keyClientId]
+	if name == "" || group == "" || clientId == "" {
+		return newResponse(internal.BadRequest, "missing topic, group or client id")
+	}
+	if conn, ok := tnet.ConnectionFromContext(ctx); ok {
+		conn.Attributes().Set(attrClientId, clientId)
+	}
+	b.subscribe(name, group, clientId)
+	return newResponse(internal.Success, "")
+}
+
+func (b *Broker) processUnsubscribe(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+	b.unsubscribe(p.ExtData[keyTopic], p.ExtData[keyGroup], p.ExtData[keyClientId])
+	return newResponse(internal.Success, "")
+}
+
+func (b *Broker) processAck(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+	b.ack(p.ExtData[keyTopic], p.ExtData[keyGroup], p.ExtData[keyClientId], p.ExtData[keyMessageId])
+	return nil
+}
+
+// disconnector removes the consumers of a client once it has no connection
+// left, a client connected again meanwhile keeps them.
+type disconnector struct {
+	broker *Broker
+}
+
+func (d *disconnector) OnConnect(conn config.Connection) {
+}
+
+func (d *disconnector) OnClose(conn config.Connection) {
+	value, ok := conn.Attributes().Get(attrClientId)
+	if !ok {
+		return
+	}
+	clientId := value.(string)
+	for _, client := range d.broker.server.Clients("") {
+		if client.Id == clientId {
+			return
+		}
+	}
+	d.broker.removeClient(clientId)
+}
+
+func (d *disconnector) OnIdle(conn config.Connection) {
+}
+
+func (d *disconnector) OnException(conn config.Connection, err error) {
+}
@@ -0,0 +1,242 @@
+package broker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/panjf2000/gnet"
+	"net"
+	"sync"
+	"testing"
+	"thunder/config"
+	"thunder/internal"
+	tnet "thunder/net"
+	"thunder/protocol"
+	"time"
+)
+
+func startTestBroker(t *testing.T, configure func(c *config.BrokerConfig)) (*Broker, net.Addr) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	serverConfig := config.NewDefaultServerConfig(int32(port))
+	serverConfig.Addr = fmt.Sprintf("tcp://127.0.0.1:%d", port)
+	serverConfig.PrintBanner = false
+	s := tnet.NewRPCServer(serverConfig)
+	brokerConfig := config.NewDefaultBrokerConfig()
+	if configure != nil {
+		configure(brokerConfig)
+	}
+	b := New(s, brokerConfig)
+	go s.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = gnet.Stop(ctx, serverConfig.Addr)
+	})
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr.String()); err == nil {
+			_ = conn.Close()
+			return b, addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("broker is not listening on %s", addr.String())
+	return nil, nil
+}
+
+type consumed struct {
+	lock     sync.Mutex
+	messages map[string][]string
+}
+
+func (c *consumed) handler(name string) Handler {
+	return func(m *Message) error {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.messages[name] = append(c.messages[name], string(m.Body))
+		return nil
+	}
+}
+
+func (c *consumed) count(name string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.messages[name])
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCompetingConsumers(t *testing.T) {
+	_, addr := startTestBroker(t, nil)
+	producer := NewClient(addr, config.NewClientConfig())
+	c := &consumed{messages: make(map[string][]string)}
+
+	// the messages sent before the first group go to it
+	if _, err := producer.Send(context.Background(), "orders", []byte("0"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a1", "a2"} {
+		if err := NewClient(addr, config.NewClientConfig()).Subscribe(context.Background(), "orders", "a", c.handler(name), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := NewClient(addr, config.NewClientConfig()).Subscribe(context.Background(), "orders", "b", c.handler("b"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 20; i++ {
+		if i%2 == 0 {
+			if _, err := producer.Send(context.Background(), "orders", []byte(fmt.Sprint(i)), time.Second); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := producer.SendOneway(context.Background(), "orders", []byte(fmt.Sprint(i)), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the messages", func() bool {
+		return c.count("a1")+c.count("a2") == 21 && c.count("b") == 20
+	})
+	if c.count("a1") == 0 || c.count("a2") == 0 {
+		t.Fatalf("consumers do not compete: %d, %d", c.count("a1"), c.count("a2"))
+	}
+}
+
+func TestRedelivery(t *testing.T) {
+	b, addr := startTestBroker(t, func(c *config.BrokerConfig) {
+		c.AckTimeout = 100 * time.Millisecond
+	})
+	deliveries := make(chan int, 4)
+	consumer := NewClient(addr, config.NewClientConfig())
+	err := consumer.Subscribe(context.Background(), "orders", "a", func(m *Message) error {
+		deliveries <- m.Deliveries
+		if m.Deliveries == 1 {
+			return errors.New("not yet")
+		}
+		return nil
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewClient(addr, config.NewClientConfig()).Send(context.Background(), "orders", []byte("1"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		select {
+		case d := <-deliveries:
+			if d != i {
+				t.Fatalf("unexpected delivery: %d", d)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message is not delivered again")
+		}
+	}
+	waitFor(t, "the ack", func() bool {
+		g := b.Stats()[0].Groups[0]
+		return g.Inflight == 0 && g.Queued == 0
+	})
+}
+
+func TestQueueFull(t *testing.T) {
+	b, addr := startTestBroker(t, func(c *config.BrokerConfig) {
+		c.QueueSize = 2
+	})
+	producer := NewClient(addr, config.NewClientConfig())
+	for i := 0; i < 2; i++ {
+		if _, err := producer.Send(context.Background(), "orders", nil, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := producer.Send(context.Background(), "orders", nil, time.Second); err != internal.ErrQueueFull {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := b.Stats(); len(stats) != 1 || stats[0].Backlog != 2 || stats[0].Dropped != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// the oneway messages dropped are counted
+	if err := producer.SendOneway(context.Background(), "orders", nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the dropped message", func() bool {
+		return b.Stats()[0].Dropped == 1
+	})
+}
+
+// dialConsumer subscribes a consumer from a raw connection, which reads none
+// of its deliveries.
+func dialConsumer(t *testing.T, addr net.Addr, clientId, topic, group string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe := protocol.NewPacket(CodeSubscribe, nil, nil)
+	subscribe.ExtData = map[string]string{keyTopic: topic, keyGroup: group, keyClientId: clientId}
+	for _, p := range []*protocol.Packet{protocol.NewRegister(clientId, "", nil), subscribe} {
+		frame, err := protocol.Encode(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(frame)))
+		if _, err = conn.Write(append(length, frame...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conn
+}
+
+func TestDisconnectedConsumer(t *testing.T) {
+	b, addr := startTestBroker(t, nil)
+	conn := dialConsumer(t, addr, "gone", "orders", "a")
+	defer conn.Close()
+	waitFor(t, "the consumer", func() bool {
+		stats := b.Stats()
+		return len(stats) == 1 && len(stats[0].Groups) == 1 && stats[0].Groups[0].Consumers == 1
+	})
+	producer := NewClient(addr, config.NewClientConfig())
+	for i := 0; i < 8; i++ {
+		if _, err := producer.Send(context.Background(), "orders", []byte(fmt.Sprint(i)), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g := b.Stats()[0].Groups[0]; g.Inflight != 8 {
+		t.Fatalf("unexpected stats: %+v", g)
+	}
+
+	// the consumer is removed once its connection closes, its messages are
+	// queued again in the order they were sent
+	_ = conn.Close()
+	waitFor(t, "the consumer removal", func() bool {
+		g := b.Stats()[0].Groups[0]
+		return g.Consumers == 0 && g.Queued == 8
+	})
+	tp, _ := b.lookup("orders")
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	i := 0
+	for e := tp.groups["a"].queue.Front(); e != nil; e = e.Next() {
+		if body := string(e.Value.(*message).body); body != fmt.Sprint(i) {
+			t.Fatalf("message %s queued at %d", body, i)
+		}
+		i++
+	}
+}
@@ -0,0 +1,215 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/internal/logging"
+	tnet "thunder/net"
+	"thunder/protocol"
+	"time"
+)
+
+// Message is a message delivered to a consumer.
+type Message struct {
+	Id    string
+	Topic string
+	Group string
+	Body  []byte
+	// Deliveries is the number of times the message has been delivered,
+	// this delivery included.
+	Deliveries int
+}
+
+// Handler handles a message delivered to a consumer, the message is acked
+// when it returns nil and delivered again once the ack timeout of the broker
+// expires otherwise.
+type Handler func(m *Message) error
+
+type subscription struct {
+	topic string
+	group string
+}
+
+// Client is a producer and consumer of a broker.
+type Client struct {
+	client   *tnet.RPCClient
+	addr     net.Addr
+	clientId string
+	logger   logging.Logger
+
+	lock          sync.RWMutex
+	subscriptions map[subscription]Handler
+}
+
+var clientSeq uint32
+
+// NewClient creates a client of the broker at the address. The client needs an
+// id to consume, a unique one is generated when the config has none. It
+// subscribes again to its topics on every new connection, so it keeps
+// consuming after reconnecting.
+func NewClient(addr net.Addr, clientConfig *config.ClientConfig) *Client {
+	copied := *clientConfig
+	clientConfig = &copied
+	if clientConfig.ClientId == "" {
+		host, _ := os.Hostname()
+		clientConfig.ClientId = fmt.Sprintf("%s-%d-%d-%d", host, os.Getpid(), time.Now().UnixNano(), atomic.AddUint32(&clientSeq, 1))
+	}
+	c := &Client{
+		addr:          addr,
+		clientId:      clientConfig.ClientId,
+		logger:        clientConfig.Logger,
+		subscriptions: make(map[subscription]Handler),
+	}
+	clientConfig.EventListener = &resubscriber{listener: clientConfig.EventListener, client: c}
+	c.client = tnet.NewRPCClient(clientConfig)
+	c.client.RegisterProcessor(CodeDeliver, c.processDeliver)
+	return c
+}
+
+// Send sends the message to the topic and returns its id once the broker has
+// queued it. It fails with ErrQueueFull when a queue of the topic is full.
+func (c *Client) Send(ctx context.Context, topic string, body []byte, timeout time.Duration) (string, error) {
+	p := protocol.NewPacket(CodeSend, body, nil)
+	p.ExtData = map[string]string{keyTopic: topic}
+	resp, err := c.invoke(ctx, p, timeout)
+	if err != nil {
+		return "", err
+	}
+	return resp.ExtData[keyMessageId], nil
+}
+
+// SendOneway sends the message to the topic without waiting for the broker,
+// a message sent to a full queue is dropped and counted in the Dropped of the
+// stats of the topic.
+func (c *Client) SendOneway(ctx context.Context, topic string, body []byte, timeout time.Duration) error {
+	p := protocol.NewPacket(CodeSend, body, nil)
+	p.MarkOneway()
+	p.ExtData = map[string]string{keyTopic: topic}
+	return c.client.InvokeOneway(ctx, c.addr, p, timeout)
+}
+
+// Subscribe makes the client a consumer of the group of the topic, the
+// messages are passed to the handler on the worker pool of the client.
+func (c *Client) Subscribe(ctx context.Context, topic, group string, handler Handler, timeout time.Duration) error {
+	c.lock.Lock()
+	c.subscriptions[subscription{topic: topic, group: group}] = handler
+	c.lock.Unlock()
+	_, err := c.invoke(ctx, c.newSubscription(CodeSubscribe, topic, group), timeout)
+	return err
+}
+
+func (c *Client) Unsubscribe(ctx context.Context, topic, group string, timeout time.Duration) error {
+	c.lock.Lock()
+	delete(c.subscriptions, subscription{topic: topic, group: group})
+	c.lock.Unlock()
+	_, err := c.invoke(ctx, c.newSubscription(CodeUnsubscribe, topic, group), timeout)
+	return err
+}
+
+func (c *Client) newSubscription(code int16, topic, group string) *protocol.Packet {
+	p := protocol.NewPacket(code, nil, nil)
+	p.ExtData = map[string]string{keyTopic: topic, keyGroup: group, keyClientId: c.clientId}
+	return p
+}
+
+// invoke sends the request and turns an error response into an error.
+func (c *Client) invoke(ctx context.Context, p *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
+	resp, err := c.client.InvokeSync(ctx, c.addr, p, timeout)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Code {
+	case internal.Success:
+		return resp, nil
+	case internal.QueueFull:
+		return nil, internal.ErrQueueFull
+	default:
+		return nil, errors.New(resp.Message)
+	}
+}
+
+func (c *Client) processDeliver(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+	topic, group := p.ExtData[keyTopic], p.ExtData[keyGroup]
+	c.lock.RLock()
+	handler := c.subscriptions[subscription{topic: topic, group: group}]
+	c.lock.RUnlock()
+	if handler == nil {
+		return nil
+	}
+
+	deliveries, _ := strconv.Atoi(p.ExtData[keyDeliveries])
+	m := &Message{
+		Id:         p.ExtData[keyMessageId],
+		Topic:      topic,
+		Group:      group,
+		Body:       append([]byte(nil), p.Body...),
+		Deliveries: deliveries,
+	}
+	if err := handler(m); err != nil {
+		c.logger.Warnf("handle message error, topic: %s, group: %s, id: %s, err: %v", topic, group, m.Id, err)
+		return nil
+	}
+
+	ack := protocol.NewPacket(CodeAck, nil, nil)
+	ack.MarkOneway()
+	ack.ExtData = map[string]string{keyTopic: topic, keyGroup: group, keyClientId: c.clientId, keyMessageId: m.Id}
+	if err := c.client.InvokeOneway(context.Background(), c.addr, ack, 0); err != nil {
+		c.logger.Warnf("ack message error, topic: %s, group: %s, id: %s, err: %v", topic, group, m.Id, err)
+	}
+	return nil
+}
+
+// resubscribe subscribes again to all the topics of the client.
+func (c *Client) resubscribe() {
+	c.lock.RLock()
+	subscriptions := make([]subscription, 0, len(c.subscriptions))
+	for s := range c.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	c.lock.RUnlock()
+	for _, s := range subscriptions {
+		if _, err := c.invoke(context.Background(), c.newSubscription(CodeSubscribe, s.topic, s.group), 3*time.Second); err != nil {
+			c.logger.Warnf("resubscribe error, topic: %s, group: %s, err: %v", s.topic, s.group, err)
+		}
+	}
+}
+
+// resubscriber subscribes the client again on every new connection and passes
+// the events on to the listener of the config, if any.
+type resubscriber struct {
+	listener config.ConnectionEventListener
+	client   *Client
+}
+
+func (r *resubscriber) OnConnect(conn config.Connection) {
+	if r.listener != nil {
+		r.listener.OnConnect(conn)
+	}
+	go r.client.resubscribe()
+}
+
+func (r *resubscriber) OnClose(conn config.Connection) {
+	if r.listener != nil {
+		r.listener.OnClose(conn)
+	}
+}
+
+func (r *resubscriber) OnIdle(conn config.Connection) {
+	if r.listener != nil {
+		r.listener.OnIdle(conn)
+	}
+}
+
+func (r *resubscriber) OnException(conn config.Connection, err error) {
+	if r.listener != nil {
+		r.listener.OnException(conn, err)
+	}
+}
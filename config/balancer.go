@@ -0,0 +1,92 @@
+package config
+
+import (
+	"thunder/internal/logging"
+	"time"
+)
+
+type BalancerConfig struct {
+	Logger logging.Logger
+
+	Policy BalancePolicy
+	// HashKey is the ext data key hashed by ConsistentHashBalance
+	HashKey string
+	// VirtualNodes is the number of ring points per unit of weight
+	VirtualNodes int
+	LatencyDecay time.Duration
+
+	// FailureThreshold failures in a row skip an endpoint for UnhealthyTimeout
+	FailureThreshold int
+	UnhealthyTimeout time.Duration
+
+	// Outlier of nil disables the outlier detection
+	Outlier *OutlierConfig
+}
+
+func NewDefaultBalancerConfig() *BalancerConfig {
+	return &BalancerConfig{
+		Logger:           logging.DefaultLogger,
+		Policy:           RoundRobinBalance,
+		VirtualNodes:     40,
+		LatencyDecay:     10 * time.Second,
+		FailureThreshold: 5,
+		UnhealthyTimeout: 10 * time.Second,
+	}
+}
+
+// BalancePolicy is the strategy picking one of the endpoints of a balancer.
+type BalancePolicy int
+
+const (
+	// RoundRobinBalance sends the requests to the endpoints in turn.
+	RoundRobinBalance BalancePolicy = iota
+	// WeightedRandomBalance sends a request to a random endpoint, picked in
+	// proportion to the endpoint weights.
+	WeightedRandomBalance
+	// LeastOutstandingBalance sends a request to the endpoint with the
+	// fewest requests waiting for a response.
+	LeastOutstandingBalance
+	// LeastLatencyBalance picks two random endpoints and sends a request to
+	// the one with the lowest latency, an exponentially weighted moving
+	// average, times its outstanding requests plus one.
+	LeastLatencyBalance
+	// ConsistentHashBalance sends the requests with the same hash key to the
+	// same endpoint, as long as it is healthy. Only the keys of an endpoint
+	// move when it is added or removed.
+	ConsistentHashBalance
+)
+
+// OutlierConfig sets up the ejection of the endpoints failing in a row or
+// slower than LatencyFactor times the median latency.
+type OutlierConfig struct {
+	// ConsecutiveFailures of 0 ejects no endpoint for failing
+	ConsecutiveFailures int
+	// LatencyFactor of 0 ejects no endpoint for its latency
+	LatencyFactor       float64
+	MinLatencyEndpoints int
+	MinLatency          time.Duration
+
+	Interval           time.Duration
+	BaseEjectionTime   time.Duration
+	MaxEjectionTime    time.Duration
+	RampUpTime         time.Duration
+	MaxEjectionPercent int
+
+	// ProbeTimeout of 0 disables the probes
+	ProbeTimeout time.Duration
+}
+
+func NewDefaultOutlierConfig() *OutlierConfig {
+	return &OutlierConfig{
+		ConsecutiveFailures: 5,
+		LatencyFactor:       3,
+		MinLatencyEndpoints: 3,
+		MinLatency:          10 * time.Millisecond,
+		Interval:            time.Second,
+		BaseEjectionTime:    30 * time.Second,
+		MaxEjectionTime:     5 * time.Minute,
+		RampUpTime:          10 * time.Second,
+		MaxEjectionPercent:  50,
+		ProbeTimeout:        time.Second,
+	}
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"net"
+	"thunder/internal"
+	"time"
+)
+
+// BreakerConfig sets up the circuit breakers of a client, per address or per
+// address and code.
+type BreakerConfig struct {
+	PerCode bool
+
+	Window        time.Duration
+	WindowBuckets int
+	MinCalls      int
+	FailureRate   float64
+	// SlowCallDuration of 0 counts no call as slow
+	SlowCallDuration time.Duration
+	SlowCallRate     float64
+	// FailureCodes are the response codes counted as failures
+	FailureCodes []int16
+
+	// OpenTimeout also bounds the half-open trials, the circuit opens again
+	// when they are not all done by then
+	OpenTimeout   time.Duration
+	HalfOpenCalls int
+
+	Listener CircuitListener
+}
+
+func NewDefaultBreakerConfig() *BreakerConfig {
+	return &BreakerConfig{
+		Window:           10 * time.Second,
+		WindowBuckets:    10,
+		MinCalls:         20,
+		FailureRate:      0.5,
+		SlowCallDuration: 0,
+		SlowCallRate:     0.8,
+		FailureCodes:     []int16{internal.SystemError},
+		OpenTimeout:      5 * time.Second,
+		HalfOpenCalls:    3,
+	}
+}
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets the calls through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails the calls right away.
+	CircuitOpen
+	// CircuitHalfOpen lets a few calls through to find out whether the
+	// circuit can close.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitListener is called when the circuit of the address, and of the code
+// when the circuits are per code, goes from a state to another. It is called
+// on the goroutine of the call which changed the state, so it must not block.
+type CircuitListener func(addr net.Addr, code int16, from, to CircuitState)
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"thunder/internal/logging"
+	"thunder/internal/timingwheel"
+	"time"
+)
+
+type BrokerConfig struct {
+	Logger logging.Logger
+
+	QueueSize   int
+	AckTimeout  time.Duration
+	MaxInflight int
+	// RetryInterval is the delay before delivering again the messages which
+	// could not be sent to a consumer
+	RetryInterval time.Duration
+	TimerTick     time.Duration
+}
+
+func NewDefaultBrokerConfig() *BrokerConfig {
+	return &BrokerConfig{
+		Logger:        logging.DefaultLogger,
+		QueueSize:     1024,
+		AckTimeout:    30 * time.Second,
+		MaxInflight:   16,
+		RetryInterval: 100 * time.Millisecond,
+		TimerTick:     timingwheel.DefaultTick,
+	}
+}
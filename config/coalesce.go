@@ -0,0 +1,8 @@
+package config
+
+// CoalescePolicy makes the concurrent synchronous calls of a code to the same
+// address with the same key share one request.
+type CoalescePolicy struct {
+	// Key is the ext data key of the calls, the body is hashed without it
+	Key string
+}
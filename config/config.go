@@ -1,9 +1,13 @@
 package config
 
 import (
+	"context"
 	"fmt"
 	"github.com/panjf2000/gnet"
+	"net"
 	"thunder/internal/logging"
+	"thunder/internal/timingwheel"
+	"thunder/protocol"
 	"time"
 )
 
@@ -16,6 +20,30 @@ type ServerConfig struct {
 	LoadBalance  gnet.LoadBalancing
 	Logger       logging.Logger
 
+	// Checksum is also enabled per connection by a checksummed frame
+	Checksum bool
+
+	DecodeLimits    *protocol.DecodeLimits
+	DecodeErrorHook DecodeErrorHook
+
+	// PacketPool releases the request and response of a processor once the
+	// response is written
+	PacketPool bool
+
+	TimerTick time.Duration
+
+	// HeartbeatInterval of 0 disables the heartbeats
+	HeartbeatInterval  time.Duration
+	HeartbeatMaxMissed int
+
+	// IdleTimeout of 0 keeps the idle connections
+	IdleTimeout time.Duration
+	IdleGoodbye bool
+
+	EventListener ConnectionEventListener
+
+	BroadcastConcurrency int
+
 	PrintBanner bool
 }
 
@@ -27,18 +55,173 @@ func NewDefaultServerConfig(port int32) *ServerConfig {
 		EventLoopNum: 8,
 		TcpKeepAlive: 5 * time.Second,
 		Logger:       logging.DefaultLogger,
+		DecodeLimits: protocol.NewDefaultDecodeLimits(),
+		TimerTick:    timingwheel.DefaultTick,
 		PrintBanner:  true,
+
+		HeartbeatMaxMissed: 3,
+		IdleGoodbye:        true,
+
+		BroadcastConcurrency: 64,
 	}
 }
 
 type ClientConfig struct {
 	Logger logging.Logger
+
+	ClientId    string
+	ClientGroup string
+	ClientTags  map[string]string
+
+	DialTimeout     time.Duration
+	TcpKeepAlive    time.Duration
+	TcpNoDelay      bool
+	ReadBufferSize  int
+	WriteBufferSize int
+	LocalAddr       *net.TCPAddr
+	// Dialer replaces the default dialer, LocalAddr is then ignored
+	Dialer Dialer
+
+	// Checksum is also enabled per connection by a checksummed frame
+	Checksum bool
+
+	DecodeLimits    *protocol.DecodeLimits
+	DecodeErrorHook DecodeErrorHook
+
+	// PacketPool releases the response of an InvokeAsync callback once it
+	// returns, the response of InvokeSync belongs to the caller
+	PacketPool bool
+
+	TimerTick time.Duration
+
+	SendQueueSize       int
+	FailOnFullSendQueue bool
+
+	ConnectionsPerAddr       int
+	MaxConnectionsPerAddr    int
+	ConnectionGrowPending    int
+	ConnectionShrinkInterval time.Duration
+	ConnectionSelector       ConnectionSelector
+
+	// HeartbeatInterval of 0 disables the heartbeats
+	HeartbeatInterval  time.Duration
+	HeartbeatMaxMissed int
+
+	EventListener ConnectionEventListener
+
+	Resolver Resolver
+
+	ResubscribeInterval time.Duration
+
+	RetryPolicies map[int16]*RetryPolicy
+	// RetryBudgetRatio and RetryBudgetMinPerSecond of 0 disable the budget
+	RetryBudgetRatio        float64
+	RetryBudgetMinPerSecond int
+
+	HedgePolicies    map[int16]*HedgePolicy
+	CoalescePolicies map[int16]*CoalescePolicy
+
+	// Breaker of nil disables the circuit breakers
+	Breaker *BreakerConfig
 }
 
 func NewClientConfig() *ClientConfig {
 	return &ClientConfig{
-		Logger: logging.DefaultLogger,
+		Logger:        logging.DefaultLogger,
+		DialTimeout:   3 * time.Second,
+		TcpKeepAlive:  5 * time.Second,
+		TcpNoDelay:    true,
+		DecodeLimits:  protocol.NewDefaultDecodeLimits(),
+		TimerTick:     timingwheel.DefaultTick,
+		SendQueueSize: 1024,
+
+		ConnectionsPerAddr:       1,
+		MaxConnectionsPerAddr:    1,
+		ConnectionGrowPending:    64,
+		ConnectionShrinkInterval: 10 * time.Second,
+		ConnectionSelector:       RoundRobin,
+
+		HeartbeatMaxMissed: 3,
+
+		ResubscribeInterval: time.Second,
+
+		RetryBudgetRatio:        0.1,
+		RetryBudgetMinPerSecond: 10,
 	}
 }
 
+// ConnectionSelector is the strategy picking one of the connections to an
+// address.
+type ConnectionSelector int
+
+const (
+	// RoundRobin sends the requests on the connections in turn.
+	RoundRobin ConnectionSelector = iota
+	// LeastPending sends a request on the connection with the fewest
+	// pending requests.
+	LeastPending
+	// RoutingKeyHash sends a request on the connection picked by the hash
+	// of the routing key of its context, see net.WithRoutingKey, and falls
+	// back to RoundRobin without a routing key.
+	RoutingKeyHash
+)
+
+// Dialer opens a connection to the address on the network, the context
+// carries the dial timeout.
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Connection is a connection of a server or a client as seen by the event
+// listeners.
+type Connection interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	// Attributes holds the state of the session of the connection, it is
+	// cleared once OnClose has been delivered.
+	Attributes() Attributes
+}
+
+// Attributes is a concurrency-safe attribute map.
+type Attributes interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{})
+	Delete(key string)
+	Range(f func(key string, value interface{}) bool)
+}
+
+// ConnectionEventListener is notified of the lifecycle of the connections.
+// The events are delivered in order on a goroutine of their own, so a slow
+// listener delays the following events but never the connections.
+type ConnectionEventListener interface {
+	// OnConnect is called once the connection is established.
+	OnConnect(conn Connection)
+	// OnClose is called once the connection is closed, whatever the reason.
+	OnClose(conn Connection)
+	// OnIdle is called when the connection is closed for being idle, before
+	// OnClose.
+	OnIdle(conn Connection)
+	// OnException is called when the connection breaks or is sent a
+	// malformed frame, before OnClose.
+	OnException(conn Connection, err error)
+}
+
+// Endpoint is an address serving a service.
+type Endpoint struct {
+	Addr net.Addr
+	// Weight is relative to the other endpoints of the service
+	Weight   int
+	Metadata map[string]string
+}
+
+// Resolver resolves service names into endpoints, it is implemented by the
+// discovery backends.
+type Resolver interface {
+	// Resolve returns the current endpoints of the service.
+	Resolve(ctx context.Context, service string) ([]Endpoint, error)
+	// Watch passes the endpoints of the service to onChange whenever they
+	// change, until the returned function is called.
+	Watch(service string, onChange func(endpoints []Endpoint)) (cancel func(), err error)
+}
 
+// DecodeErrorHook receives the remote address of a connection and the error
+// of the malformed frame it carried.
+type DecodeErrorHook func(addr net.Addr, err *protocol.DecodeError)
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"thunder/internal/logging"
+	"time"
+)
+
+type FileResolverConfig struct {
+	Logger logging.Logger
+
+	Path string
+	// ReloadInterval is how often the file is checked for changes
+	ReloadInterval time.Duration
+}
+
+func NewDefaultFileResolverConfig(path string) *FileResolverConfig {
+	return &FileResolverConfig{
+		Logger:         logging.DefaultLogger,
+		Path:           path,
+		ReloadInterval: 5 * time.Second,
+	}
+}
@@ -0,0 +1,24 @@
+package config
+
+import "time"
+
+// HedgePolicy makes the client send a backup request to another address when
+// a call is slower than Percentile of the calls of its code. Only the
+// idempotent requests invoked by service or by a pick function are hedged. The
+// requests which lose are not canceled, the servers still process them.
+type HedgePolicy struct {
+	Percentile float64
+	MinDelay   time.Duration
+	MaxHedges  int
+	// MaxRatio of 0 does not bound the hedges
+	MaxRatio float64
+}
+
+func NewDefaultHedgePolicy() *HedgePolicy {
+	return &HedgePolicy{
+		Percentile: 0.95,
+		MinDelay:   10 * time.Millisecond,
+		MaxHedges:  1,
+		MaxRatio:   0.1,
+	}
+}
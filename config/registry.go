@@ -0,0 +1,25 @@
+package config
+
+import (
+	"thunder/internal/logging"
+	"thunder/internal/timingwheel"
+	"time"
+)
+
+type RegistryConfig struct {
+	Logger logging.Logger
+
+	InstanceTTL time.Duration
+	// RenewInterval is kept well below InstanceTTL
+	RenewInterval time.Duration
+	TimerTick     time.Duration
+}
+
+func NewDefaultRegistryConfig() *RegistryConfig {
+	return &RegistryConfig{
+		Logger:        logging.DefaultLogger,
+		InstanceTTL:   30 * time.Second,
+		RenewInterval: 10 * time.Second,
+		TimerTick:     timingwheel.DefaultTick,
+	}
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"thunder/internal"
+	"time"
+)
+
+// RetryPolicy tells which failed calls are sent again and when. A request
+// which was written is only retried after one of RetryableErrors if it is
+// idempotent, one rejected by a circuit breaker only on another address.
+type RetryPolicy struct {
+	// MaxAttempts includes the first call
+	MaxAttempts       int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	// Jitter is the fraction of every backoff taken off at random
+	Jitter float64
+
+	RetryableErrors []error
+	// RetryableCodes are retried either way, they must mean the server did
+	// not process the request
+	RetryableCodes []int16
+}
+
+func NewDefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:       3,
+		InitialBackoff:    50 * time.Millisecond,
+		MaxBackoff:        time.Second,
+		BackoffMultiplier: 2,
+		Jitter:            0.2,
+		RetryableErrors: []error{
+			internal.ErrRequestTimeout,
+			internal.ErrConnectionClosed,
+			internal.ErrHeartbeatTimeout,
+		},
+		RetryableCodes: []int16{internal.QueueFull},
+	}
+}
@@ -0,0 +1,202 @@
+// Package discovery holds the discovery backends which do not need a
+// registry.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"thunder/config"
+	"thunder/internal/logging"
+	"thunder/protocol"
+	"time"
+)
+
+// fileEndpoint is an endpoint as written in the file.
+type fileEndpoint struct {
+	Addr     string            `json:"addr" yaml:"addr"`
+	Weight   int               `json:"weight" yaml:"weight"`
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
+}
+
+// FileResolver resolves the services from a JSON or YAML file mapping the
+// service names to their endpoints, for instance:
+//
+//	echo:
+//	  - addr: 10.0.0.1:9003
+//	    weight: 2
+//	  - addr: 10.0.0.2:9003
+//
+// The file is checked for changes every reload interval and reloaded once it
+// has not changed for an interval, the watchers of the services which changed
+// are notified. A file which cannot be loaded is logged and the previous
+// endpoints are kept.
+type FileResolver struct {
+	path   string
+	logger logging.Logger
+
+	lock     sync.Mutex
+	services map[string][]config.Endpoint
+	modTime  time.Time
+	size     int64
+	// seenModTime and seenSize are those of the change waiting to settle
+	seenModTime time.Time
+	seenSize    int64
+	watchers    map[string]map[int]func([]config.Endpoint)
+	nextId      int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewFileResolver loads the file of the config and reloads it when it
+// changes, checked every ReloadInterval, until Close.
+func NewFileResolver(resolverConfig *config.FileResolverConfig) (*FileResolver, error) {
+	path := resolverConfig.Path
+	r := &FileResolver{
+		path:     path,
+		logger:   resolverConfig.Logger,
+		watchers: make(map[string]map[int]func([]config.Endpoint)),
+		stop:     make(chan struct{}),
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if r.services, err = load(path); err != nil {
+		return nil, err
+	}
+	r.modTime, r.size = info.ModTime(), info.Size()
+	go r.watchFile(resolverConfig.ReloadInterval)
+	return r, nil
+}
+
+func (r *FileResolver) Resolve(ctx context.Context, service string) ([]config.Endpoint, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.services[service], nil
+}
+
+func (r *FileResolver) Watch(service string, onChange func(endpoints []config.Endpoint)) (func(), error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	watchers, ok := r.watchers[service]
+	if !ok {
+		watchers = make(map[int]func([]config.Endpoint))
+		r.watchers[service] = watchers
+	}
+	id := r.nextId
+	r.nextId++
+	watchers[id] = onChange
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		delete(watchers, id)
+	}, nil
+}
+
+// Close stops watching the file.
+func (r *FileResolver) Close() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
+
+func (r *FileResolver) watchFile(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.reload()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// reload loads the file again if its modification time or size changed and
+// stayed the same since the previous check, and notifies the watchers of the
+// services which changed, in the order of the reloads since they are all done
+// by the goroutine watching the file.
+func (r *FileResolver) reload() {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		r.logger.Warnf("stat discovery file error, path: %s, err: %v", r.path, err)
+		return
+	}
+	if info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return
+	}
+	// a file still changing is most likely being written
+	if !info.ModTime().Equal(r.seenModTime) || info.Size() != r.seenSize {
+		r.seenModTime, r.seenSize = info.ModTime(), info.Size()
+		return
+	}
+	// a file which does not load is not loaded again until it changes
+	r.modTime, r.size = info.ModTime(), info.Size()
+	services, err := load(r.path)
+	if err != nil {
+		r.logger.Warnf("load discovery file error, path: %s, err: %v", r.path, err)
+		return
+	}
+
+	type change struct {
+		onChange  func([]config.Endpoint)
+		endpoints []config.Endpoint
+	}
+	var changes []change
+	r.lock.Lock()
+	for service, watchers := range r.watchers {
+		if reflect.DeepEqual(r.services[service], services[service]) {
+			continue
+		}
+		for _, onChange := range watchers {
+			changes = append(changes, change{onChange: onChange, endpoints: services[service]})
+		}
+	}
+	r.services = services
+	r.lock.Unlock()
+	for _, c := range changes {
+		c.onChange(c.endpoints)
+	}
+}
+
+// load reads the endpoints of the services from the file, YAML unless its
+// extension is .json.
+func load(path string) (map[string][]config.Endpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string][]fileEndpoint
+	if filepath.Ext(path) == ".json" {
+		err = protocol.JSON.API.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string][]config.Endpoint, len(file))
+	for service, endpoints := range file {
+		for _, e := range endpoints {
+			addr, err := net.ResolveTCPAddr("tcp", e.Addr)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %v", service, err)
+			}
+			if e.Weight <= 0 {
+				e.Weight = 1
+			}
+			services[service] = append(services[service], config.Endpoint{Addr: addr, Weight: e.Weight, Metadata: e.Metadata})
+		}
+	}
+	return services, nil
+}
@@ -0,0 +1,95 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"thunder/config"
+	"time"
+)
+
+func TestFileResolver(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		initial  string
+		reloaded string
+		emptied  string
+	}{
+		{
+			name:     "services.yaml",
+			initial:  "echo:\n  - addr: 127.0.0.1:9003\n    weight: 2\n  - addr: 127.0.0.1:9004\n",
+			reloaded: "echo:\n  - addr: 127.0.0.1:9004\n    metadata:\n      zone: a\n",
+			emptied:  "",
+		},
+		{
+			name:     "services.json",
+			initial:  `{"echo": [{"addr": "127.0.0.1:9003", "weight": 2}, {"addr": "127.0.0.1:9004"}]}`,
+			reloaded: `{"echo": [{"addr": "127.0.0.1:9004", "metadata": {"zone": "a"}}]}`,
+			emptied:  `{}`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.name)
+			if err := ioutil.WriteFile(path, []byte(test.initial), 0644); err != nil {
+				t.Fatal(err)
+			}
+			resolverConfig := config.NewDefaultFileResolverConfig(path)
+			resolverConfig.ReloadInterval = 10 * time.Millisecond
+			r, err := NewFileResolver(resolverConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			endpoints, err := r.Resolve(context.Background(), "echo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(endpoints) != 2 || endpoints[0].Addr.String() != "127.0.0.1:9003" || endpoints[0].Weight != 2 || endpoints[1].Weight != 1 {
+				t.Fatalf("unexpected endpoints: %+v", endpoints)
+			}
+
+			changes := make(chan []config.Endpoint, 4)
+			if _, err = r.Watch("echo", func(endpoints []config.Endpoint) { changes <- endpoints }); err != nil {
+				t.Fatal(err)
+			}
+			// a file which does not parse keeps the previous endpoints
+			if err = ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if endpoints, _ = r.Resolve(context.Background(), "echo"); len(endpoints) != 2 {
+				t.Fatalf("unexpected endpoints: %+v", endpoints)
+			}
+
+			if err = ioutil.WriteFile(path, []byte(test.reloaded), 0644); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case endpoints = <-changes:
+				if len(endpoints) != 1 || endpoints[0].Addr.String() != "127.0.0.1:9004" || endpoints[0].Metadata["zone"] != "a" {
+					t.Fatalf("unexpected endpoints: %+v", endpoints)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("change is not notified")
+			}
+
+			// removing the last service removes its endpoints
+			if err = ioutil.WriteFile(path, []byte(test.emptied), 0644); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case endpoints = <-changes:
+				if len(endpoints) != 0 {
+					t.Fatalf("unexpected endpoints: %+v", endpoints)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("change is not notified")
+			}
+			if endpoints, _ = r.Resolve(context.Background(), "echo"); len(endpoints) != 0 {
+				t.Fatalf("unexpected endpoints: %+v", endpoints)
+			}
+		})
+	}
+}
@@ -3,5 +3,14 @@ package internal
 import "errors"
 
 var (
-	ErrRequestTimeout = errors.New("request timeout")
+	ErrRequestTimeout   = errors.New("request timeout")
+	ErrConnectionClosed = errors.New("connection closed")
+	ErrSendQueueFull    = errors.New("send queue full")
+	ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+	ErrClientNotFound   = errors.New("client not found")
+	ErrQueueFull        = errors.New("queue full")
+	ErrNoResolver       = errors.New("no resolver")
+	ErrNoEndpoints      = errors.New("no endpoints")
+	ErrCircuitOpen      = errors.New("circuit open")
+	ErrPingFailed       = errors.New("ping failed")
 )
@@ -3,6 +3,10 @@ package internal
 type ResponseCode int16
 
 const (
-	Success = 0
+	Success    = 0
+	BadRequest = 400
 	NotSupport = 404
+	QueueFull  = 429
+	// SystemError answers a request whose process func failed
+	SystemError = 500
 )
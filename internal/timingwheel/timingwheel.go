@@ -0,0 +1,182 @@
+// Package timingwheel implements a hashed timing wheel for timeouts.
+//
+// The timers are intrusive: a Timer is embedded in the object it times out,
+// so the wheel itself only holds a fixed array of slots and its memory use
+// does not depend on the number of pending timers.
+package timingwheel
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTick  = 10 * time.Millisecond
+	DefaultSlots = 512
+)
+
+// Timer is a node of the wheel, it is reusable once it has fired or has been
+// stopped.
+type Timer struct {
+	deadline   int64
+	task       func()
+	prev, next *Timer
+	wheel      *TimingWheel
+}
+
+// timerList is a circular doubly linked list with a sentinel node.
+type timerList struct {
+	root Timer
+}
+
+func (l *timerList) init() {
+	l.root.prev, l.root.next = &l.root, &l.root
+}
+
+func (l *timerList) pushBack(t *Timer) {
+	t.prev, t.next = l.root.prev, &l.root
+	l.root.prev.next = t
+	l.root.prev = t
+}
+
+func (l *timerList) remove(t *Timer) {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next = nil, nil
+}
+
+// TimingWheel fires the timers added to it with the precision of its tick.
+// The goroutine driving the wheel only runs while there are pending timers.
+type TimingWheel struct {
+	tick  time.Duration
+	mask  int64
+	slots []timerList
+
+	lock    sync.Mutex
+	origin  time.Time
+	current int64
+	count   int
+	running bool
+}
+
+// New creates a timing wheel, slots is rounded up to a power of two.
+func New(tick time.Duration, slots int) *TimingWheel {
+	if tick <= 0 {
+		tick = DefaultTick
+	}
+	if slots <= 0 {
+		slots = DefaultSlots
+	}
+	size := 1
+	for size < slots {
+		size <<= 1
+	}
+	tw := &TimingWheel{
+		tick:   tick,
+		mask:   int64(size - 1),
+		slots:  make([]timerList, size),
+		origin: time.Now(),
+	}
+	for i := range tw.slots {
+		tw.slots[i].init()
+	}
+	return tw
+}
+
+func (tw *TimingWheel) ticks(now time.Time) int64 {
+	return int64(now.Sub(tw.origin) / tw.tick)
+}
+
+// Add schedules task to run after d on the goroutine of the wheel, so task
+// should return quickly. It returns false if the timer is already pending.
+func (tw *TimingWheel) Add(t *Timer, d time.Duration, task func()) bool {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if t.wheel != nil {
+		return false
+	}
+
+	now := tw.ticks(time.Now())
+	if !tw.running {
+		tw.current = now
+	}
+	delay := int64((d + tw.tick - 1) / tw.tick)
+	if delay < 1 {
+		delay = 1
+	}
+	t.deadline = now + delay
+	t.task = task
+	t.wheel = tw
+	tw.slots[t.deadline&tw.mask].pushBack(t)
+	tw.count++
+
+	if !tw.running {
+		tw.running = true
+		go tw.run()
+	}
+	return true
+}
+
+// Stop removes the timer from the wheel, it returns false if the timer has
+// already fired or has been stopped.
+func (tw *TimingWheel) Stop(t *Timer) bool {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if t.wheel != tw {
+		return false
+	}
+	tw.slots[t.deadline&tw.mask].remove(t)
+	t.wheel, t.task = nil, nil
+	tw.count--
+	return true
+}
+
+// Len returns the number of pending timers.
+func (tw *TimingWheel) Len() int {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	return tw.count
+}
+
+func (tw *TimingWheel) run() {
+	ticker := time.NewTicker(tw.tick)
+	defer ticker.Stop()
+
+	var expired []func()
+	for now := range ticker.C {
+		expired = tw.advance(tw.ticks(now), expired[:0])
+		for i, task := range expired {
+			task()
+			expired[i] = nil
+		}
+
+		tw.lock.Lock()
+		if tw.count == 0 {
+			tw.running = false
+			tw.lock.Unlock()
+			return
+		}
+		tw.lock.Unlock()
+	}
+}
+
+// advance moves the wheel up to the given tick and collects the tasks of the
+// expired timers.
+func (tw *TimingWheel) advance(now int64, expired []func()) []func() {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	for ; tw.current < now; tw.current++ {
+		slot := &tw.slots[(tw.current+1)&tw.mask]
+		for t := slot.root.next; t != &slot.root; {
+			next := t.next
+			if t.deadline <= tw.current+1 {
+				slot.remove(t)
+				expired = append(expired, t.task)
+				t.wheel, t.task = nil, nil
+				tw.count--
+			}
+			t = next
+		}
+	}
+	return expired
+}
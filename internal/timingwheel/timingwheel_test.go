@@ -0,0 +1,89 @@
+package timingwheel
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimerFires(t *testing.T) {
+	tw := New(5*time.Millisecond, 8)
+	var timer Timer
+	fired := make(chan time.Time, 1)
+	start := time.Now()
+	tw.Add(&timer, 50*time.Millisecond, func() {
+		fired <- time.Now()
+	})
+
+	select {
+	case at := <-fired:
+		if elapsed := at.Sub(start); elapsed < 45*time.Millisecond {
+			t.Fatalf("timer fired too early: %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer does not fire")
+	}
+	if tw.Len() != 0 {
+		t.Fatalf("%d timers pending after firing", tw.Len())
+	}
+}
+
+func TestTimerStop(t *testing.T) {
+	tw := New(5*time.Millisecond, 8)
+	var timer Timer
+	var fired int32
+	tw.Add(&timer, 20*time.Millisecond, func() {
+		atomic.StoreInt32(&fired, 1)
+	})
+	if tw.Add(&timer, time.Millisecond, func() {}) {
+		t.Fatal("pending timer is added twice")
+	}
+	if !tw.Stop(&timer) {
+		t.Fatal("pending timer is not stopped")
+	}
+	if tw.Stop(&timer) {
+		t.Fatal("timer is stopped twice")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&fired) == 1 {
+		t.Fatal("stopped timer fired")
+	}
+
+	// the timer is reusable once stopped
+	done := make(chan struct{})
+	tw.Add(&timer, time.Millisecond, func() {
+		close(done)
+	})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reused timer does not fire")
+	}
+}
+
+func TestManyTimersAcrossRounds(t *testing.T) {
+	// far more timers than slots and delays spanning several rounds
+	tw := New(time.Millisecond, 16)
+	const n = 10000
+	timers := make([]Timer, n)
+	var wg sync.WaitGroup
+	var fired int32
+	wg.Add(n / 2)
+	for i := range timers {
+		delay := time.Duration(i%100) * time.Millisecond
+		tw.Add(&timers[i], delay, func() {
+			atomic.AddInt32(&fired, 1)
+			wg.Done()
+		})
+	}
+	for i := 0; i < n; i += 2 {
+		if !tw.Stop(&timers[i]) {
+			t.Fatalf("timer %d is not stopped", i)
+		}
+	}
+	wg.Wait()
+	if fired != n/2 {
+		t.Fatalf("%d timers fired, expected %d", fired, n/2)
+	}
+}
@@ -0,0 +1,71 @@
+package net
+
+import (
+	"context"
+	"sync"
+	"thunder/config"
+)
+
+// attributes is the attribute map of a connection, it is cleared once the
+// connection is closed and its OnClose event delivered.
+type attributes struct {
+	lock   sync.RWMutex
+	values map[string]interface{}
+}
+
+func (a *attributes) Get(key string) (interface{}, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	value, ok := a.values[key]
+	return value, ok
+}
+
+func (a *attributes) Set(key string, value interface{}) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.values == nil {
+		a.values = make(map[string]interface{})
+	}
+	a.values[key] = value
+}
+
+func (a *attributes) Delete(key string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.values, key)
+}
+
+// Range calls f on a snapshot of the attributes, so f may modify them.
+func (a *attributes) Range(f func(key string, value interface{}) bool) {
+	a.lock.RLock()
+	snapshot := make(map[string]interface{}, len(a.values))
+	for key, value := range a.values {
+		snapshot[key] = value
+	}
+	a.lock.RUnlock()
+
+	for key, value := range snapshot {
+		if !f(key, value) {
+			return
+		}
+	}
+}
+
+func (a *attributes) clear() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.values = nil
+}
+
+type connectionKey struct{}
+
+func withConnection(ctx context.Context, conn config.Connection) context.Context {
+	return context.WithValue(ctx, connectionKey{}, conn)
+}
+
+// ConnectionFromContext returns the connection a request was received on from
+// the context given to a ContextProcessFunc.
+func ConnectionFromContext(ctx context.Context) (config.Connection, bool) {
+	conn, ok := ctx.Value(connectionKey{}).(config.Connection)
+	return conn, ok
+}
@@ -0,0 +1,80 @@
+package net
+
+import (
+	"context"
+	"testing"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+// attributesListener records the principal of the connections it sees closed.
+type attributesListener struct {
+	recordingListener
+	closed chan config.Connection
+}
+
+func (l *attributesListener) OnClose(conn config.Connection) {
+	if principal, ok := conn.Attributes().Get("principal"); ok {
+		l.events <- "close " + principal.(string)
+		l.closed <- conn
+	}
+}
+
+func TestConnectionAttributes(t *testing.T) {
+	listener := &attributesListener{
+		recordingListener: *newRecordingListener(0),
+		closed:            make(chan config.Connection, 1),
+	}
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.IdleTimeout = 100 * time.Millisecond
+		s.events = newEventDispatcher(listener, s.logger)
+		s.RegisterContextProcessor(3, func(ctx context.Context, p *protocol.Packet) *protocol.Packet {
+			conn, _ := ConnectionFromContext(ctx)
+			conn.Attributes().Set("principal", string(p.Body))
+			return protocol.NewPacket(3, nil, nil)
+		})
+		s.RegisterContextProcessor(4, func(ctx context.Context, p *protocol.Packet) *protocol.Packet {
+			conn, _ := ConnectionFromContext(ctx)
+			principal, _ := conn.Attributes().Get("principal")
+			return protocol.NewPacket(4, []byte(principal.(string)), nil)
+		})
+	})
+	listener.expect(t, "connect")
+
+	c := NewRPCClient(config.NewClientConfig())
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, []byte("Creams"), nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(4, nil, nil), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Body) != "Creams" {
+		t.Fatalf("attribute is not kept across requests: %s", p.Body)
+	}
+
+	// the listener sees the attributes, which are cleared after OnClose
+	listener.expect(t, "connect", "idle", "close Creams")
+	conn := <-listener.closed
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := conn.Attributes().Get("principal"); ok {
+		t.Fatal("attributes are not cleared on close")
+	}
+}
+
+func TestAttributesRange(t *testing.T) {
+	var attrs attributes
+	attrs.Set("a", 1)
+	attrs.Set("b", 2)
+	n := 0
+	attrs.Range(func(key string, value interface{}) bool {
+		// modifying the attributes while ranging over them does not deadlock
+		attrs.Delete(key)
+		n++
+		return true
+	})
+	if _, ok := attrs.Get("a"); ok || n != 2 {
+		t.Fatalf("unexpected attributes after range: %d ranged", n)
+	}
+}
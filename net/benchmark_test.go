@@ -0,0 +1,58 @@
+package net
+
+import (
+	"context"
+	"testing"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+func BenchmarkInvokeSync(b *testing.B) {
+	_, addr := startTestServer(b, nil)
+	c := NewRPCClient(config.NewClientConfig())
+	body := make([]byte, 128)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, body, nil), 3*time.Second); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInvokeSyncParallel(b *testing.B) {
+	_, addr := startTestServer(b, nil)
+	c := NewRPCClient(config.NewClientConfig())
+	body := make([]byte, 128)
+	b.SetParallelism(16)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, body, nil), 3*time.Second); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkInvokeOnewayParallel(b *testing.B) {
+	_, addr := startTestServer(b, nil)
+	c := NewRPCClient(config.NewClientConfig())
+	body := make([]byte, 128)
+	b.SetParallelism(16)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p := protocol.NewPacket(1, body, nil)
+			p.MarkOneway()
+			if err := c.InvokeOneway(context.Background(), addr, p, 3*time.Second); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,328 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/internal/logging"
+	"thunder/protocol"
+	"time"
+)
+
+// CircuitOpenError is the error of the calls failed by an open circuit, it is
+// internal.ErrCircuitOpen for errors.Is.
+type CircuitOpenError struct {
+	Addr net.Addr
+	// Code is the code of the circuit when the circuits are per code.
+	Code int16
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open, addr: %s, code: %d", e.Addr.String(), e.Code)
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == internal.ErrCircuitOpen
+}
+
+// CircuitStats is a snapshot of a circuit breaker.
+type CircuitStats struct {
+	Addr net.Addr
+	// Code is the code of the circuit when the circuits are per code.
+	Code  int16
+	State config.CircuitState
+	// Calls, Failures and SlowCalls count the calls of the sliding window.
+	Calls     int
+	Failures  int
+	SlowCalls int
+	// Rejected is the number of calls failed by the open circuit and Opened
+	// the number of times it opened.
+	Rejected uint64
+	Opened   uint64
+}
+
+type circuitKey struct {
+	addr string
+	code int16
+}
+
+type breakerBucket struct {
+	index     int64
+	calls     int
+	failures  int
+	slowCalls int
+}
+
+// circuit is the circuit breaker of an address, or of an address and a code.
+// Its generation changes with its state, so the results of the calls let
+// through in a previous state are ignored.
+type circuit struct {
+	addr          net.Addr
+	code          int16
+	breakerConfig *config.BreakerConfig
+	logger        logging.Logger
+
+	lock       sync.Mutex
+	state      config.CircuitState
+	generation uint64
+	buckets    []breakerBucket
+	openedAt   time.Time
+	// trials and successes count the calls let through and succeeded while
+	// half-open, since halfOpenedAt
+	halfOpenedAt time.Time
+	trials       int
+	successes    int
+
+	rejected uint64
+	opened   uint64
+}
+
+type circuitChange struct {
+	from, to config.CircuitState
+}
+
+// admit returns the circuit of the call and the generation it is let through
+// in, or a CircuitOpenError. The circuit is nil when there are no breakers.
+func (R *RPCClient) admit(addr net.Addr, code int16) (*circuit, uint64, error) {
+	breakerConfig := R.clientConfig.Breaker
+	if breakerConfig == nil {
+		return nil, 0, nil
+	}
+	if !breakerConfig.PerCode {
+		code = 0
+	}
+	key := circuitKey{addr: addr.String(), code: code}
+	value, ok := R.circuits.Load(key)
+	if !ok {
+		value, _ = R.circuits.LoadOrStore(key, &circuit{
+			addr:          addr,
+			code:          code,
+			breakerConfig: breakerConfig,
+			logger:        R.logger,
+			buckets:       make([]breakerBucket, bucketCount(breakerConfig)),
+		})
+	}
+	c := value.(*circuit)
+	generation, ok := c.allow()
+	if !ok {
+		atomic.AddUint64(&c.rejected, 1)
+		return nil, 0, &CircuitOpenError{Addr: addr, Code: code}
+	}
+	return c, generation, nil
+}
+
+func bucketCount(breakerConfig *config.BreakerConfig) int {
+	if breakerConfig.WindowBuckets < 1 {
+		return 1
+	}
+	return breakerConfig.WindowBuckets
+}
+
+// allow reports whether a call is let through, an open circuit turns
+// half-open once OpenTimeout has passed. A half-open circuit whose trials are
+// not all done within OpenTimeout opens again, so a trial which never ends
+// does not hold it half-open.
+func (c *circuit) allow() (uint64, bool) {
+	var change *circuitChange
+	defer func() {
+		c.notify(change)
+	}()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch c.state {
+	case config.CircuitOpen:
+		if time.Since(c.openedAt) < c.breakerConfig.OpenTimeout {
+			return 0, false
+		}
+		change = c.transition(config.CircuitHalfOpen)
+		fallthrough
+	case config.CircuitHalfOpen:
+		if c.trials >= c.halfOpenCalls() {
+			if time.Since(c.halfOpenedAt) >= c.breakerConfig.OpenTimeout {
+				change = c.transition(config.CircuitOpen)
+			}
+			return 0, false
+		}
+		c.trials++
+	}
+	return c.generation, true
+}
+
+// record counts the result of a call let through in the generation, a call
+// fails with an error or a response of one of FailureCodes. The calls
+// canceled by the caller are not counted but give their half-open trial back.
+func (c *circuit) record(generation uint64, rtt time.Duration, resp *protocol.Packet, err error) {
+	if c == nil {
+		return
+	}
+	if err == context.Canceled {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if generation == c.generation && c.state == config.CircuitHalfOpen && c.trials > 0 {
+			c.trials--
+		}
+		return
+	}
+	var change *circuitChange
+	defer func() {
+		c.notify(change)
+	}()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation != c.generation {
+		return
+	}
+	failed := err != nil || resp != nil && c.failureCode(resp.Code)
+	slow := c.breakerConfig.SlowCallDuration > 0 && rtt > c.breakerConfig.SlowCallDuration
+	switch c.state {
+	case config.CircuitClosed:
+		b := c.bucket(time.Now())
+		b.calls++
+		if failed {
+			b.failures++
+		}
+		if slow {
+			b.slowCalls++
+		}
+		if c.tripped() {
+			change = c.transition(config.CircuitOpen)
+		}
+	case config.CircuitHalfOpen:
+		if failed || slow {
+			change = c.transition(config.CircuitOpen)
+			return
+		}
+		if c.successes++; c.successes >= c.halfOpenCalls() {
+			change = c.transition(config.CircuitClosed)
+		}
+	}
+}
+
+func (c *circuit) failureCode(code int16) bool {
+	for _, failureCode := range c.breakerConfig.FailureCodes {
+		if code == failureCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *circuit) halfOpenCalls() int {
+	if c.breakerConfig.HalfOpenCalls < 1 {
+		return 1
+	}
+	return c.breakerConfig.HalfOpenCalls
+}
+
+// bucket returns the bucket of the window the time falls in.
+func (c *circuit) bucket(now time.Time) *breakerBucket {
+	index := now.UnixNano() / int64(c.bucketSpan())
+	b := &c.buckets[index%int64(len(c.buckets))]
+	if b.index != index {
+		*b = breakerBucket{index: index}
+	}
+	return b
+}
+
+func (c *circuit) bucketSpan() time.Duration {
+	span := c.breakerConfig.Window / time.Duration(len(c.buckets))
+	if span <= 0 {
+		return time.Millisecond
+	}
+	return span
+}
+
+// window sums the buckets of the sliding window.
+func (c *circuit) window(now time.Time) breakerBucket {
+	index := now.UnixNano() / int64(c.bucketSpan())
+	var sum breakerBucket
+	for _, b := range c.buckets {
+		if index-b.index < int64(len(c.buckets)) {
+			sum.calls += b.calls
+			sum.failures += b.failures
+			sum.slowCalls += b.slowCalls
+		}
+	}
+	return sum
+}
+
+func (c *circuit) tripped() bool {
+	w := c.window(time.Now())
+	if w.calls == 0 || w.calls < c.breakerConfig.MinCalls {
+		return false
+	}
+	if float64(w.failures) >= c.breakerConfig.FailureRate*float64(w.calls) {
+		return true
+	}
+	return c.breakerConfig.SlowCallDuration > 0 && float64(w.slowCalls) >= c.breakerConfig.SlowCallRate*float64(w.calls)
+}
+
+// transition moves the circuit to the state in a new generation, a circuit
+// starts over with an empty window.
+func (c *circuit) transition(state config.CircuitState) *circuitChange {
+	change := &circuitChange{from: c.state, to: state}
+	c.state = state
+	c.generation++
+	c.trials, c.successes = 0, 0
+	switch state {
+	case config.CircuitOpen:
+		c.openedAt = time.Now()
+		atomic.AddUint64(&c.opened, 1)
+	case config.CircuitHalfOpen:
+		c.halfOpenedAt = time.Now()
+	case config.CircuitClosed:
+		for i := range c.buckets {
+			c.buckets[i] = breakerBucket{}
+		}
+	}
+	return change
+}
+
+func (c *circuit) notify(change *circuitChange) {
+	if change == nil {
+		return
+	}
+	if change.to == config.CircuitOpen {
+		c.logger.Warnf("circuit open, addr: %s, code: %d", c.addr.String(), c.code)
+	}
+	if c.breakerConfig.Listener != nil {
+		c.breakerConfig.Listener(c.addr, c.code, change.from, change.to)
+	}
+}
+
+func (c *circuit) stats() CircuitStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	w := c.window(time.Now())
+	return CircuitStats{
+		Addr:      c.addr,
+		Code:      c.code,
+		State:     c.state,
+		Calls:     w.calls,
+		Failures:  w.failures,
+		SlowCalls: w.slowCalls,
+		Rejected:  atomic.LoadUint64(&c.rejected),
+		Opened:    atomic.LoadUint64(&c.opened),
+	}
+}
+
+// CircuitStats returns the state of the circuit breakers.
+func (R *RPCClient) CircuitStats() []CircuitStats {
+	var stats []CircuitStats
+	R.circuits.Range(func(_, value interface{}) bool {
+		stats = append(stats, value.(*circuit).stats())
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Addr.String() != stats[j].Addr.String() {
+			return stats[i].Addr.String() < stats[j].Addr.String()
+		}
+		return stats[i].Code < stats[j].Code
+	})
+	return stats
+}
@@ -0,0 +1,258 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+type circuitRecorder struct {
+	lock    sync.Mutex
+	changes []config.CircuitState
+}
+
+func (r *circuitRecorder) listen(addr net.Addr, code int16, from, to config.CircuitState) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.changes = append(r.changes, to)
+}
+
+func (r *circuitRecorder) states() []config.CircuitState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]config.CircuitState(nil), r.changes...)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		// code 3 answers too late while failing
+		s.RegisterProcessor(3, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			if atomic.LoadInt32(&failing) == 1 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			return protocol.NewPacket(3, nil, nil)
+		})
+	})
+	recorder := &circuitRecorder{}
+	breakerConfig := config.NewDefaultBreakerConfig()
+	breakerConfig.MinCalls = 4
+	breakerConfig.OpenTimeout = 100 * time.Millisecond
+	breakerConfig.HalfOpenCalls = 2
+	breakerConfig.Listener = recorder.listen
+	clientConfig := config.NewClientConfig()
+	clientConfig.Breaker = breakerConfig
+	c := NewRPCClient(clientConfig)
+
+	for i := 0; i < 4; i++ {
+		if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), 20*time.Millisecond); err != internal.ErrRequestTimeout {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// an open circuit fails the calls right away, whatever their code
+	start := time.Now()
+	_, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second)
+	var openErr *CircuitOpenError
+	if !errors.Is(err, internal.ErrCircuitOpen) || !errors.As(err, &openErr) || openErr.Addr.String() != addr.String() {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("open circuit call takes %v", elapsed)
+	}
+	if err := c.InvokeAsync(context.Background(), addr, protocol.NewPacket(1, nil, nil), nil, time.Second); !errors.Is(err, internal.ErrCircuitOpen) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stats := c.CircuitStats()
+	if len(stats) != 1 || stats[0].State != config.CircuitOpen || stats[0].Opened != 1 || stats[0].Rejected != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// a failed trial opens the circuit again
+	time.Sleep(150 * time.Millisecond)
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), 20*time.Millisecond); err != internal.ErrRequestTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), time.Second); !errors.Is(err, internal.ErrCircuitOpen) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the trials succeeding close it
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []config.CircuitState{config.CircuitOpen, config.CircuitHalfOpen, config.CircuitOpen, config.CircuitHalfOpen, config.CircuitClosed}
+	got := recorder.states()
+	if len(got) != len(want) {
+		t.Fatalf("state changes: %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("state changes: %v, want %v", got, want)
+		}
+	}
+}
+
+func TestCircuitBreakerSlowCalls(t *testing.T) {
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(3, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			time.Sleep(30 * time.Millisecond)
+			return protocol.NewPacket(3, nil, nil)
+		})
+	})
+	breakerConfig := config.NewDefaultBreakerConfig()
+	breakerConfig.PerCode = true
+	breakerConfig.MinCalls = 3
+	breakerConfig.SlowCallDuration = 20 * time.Millisecond
+	clientConfig := config.NewClientConfig()
+	clientConfig.Breaker = breakerConfig
+	c := NewRPCClient(clientConfig)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), time.Second)
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.Code != 3 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the circuits of the other codes stay closed
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	stats := c.CircuitStats()
+	if len(stats) != 2 || stats[0].Code != 1 || stats[0].State != config.CircuitClosed || stats[1].State != config.CircuitOpen {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCircuitBreakerCanceledTrial(t *testing.T) {
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(3, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			time.Sleep(100 * time.Millisecond)
+			return protocol.NewPacket(3, nil, nil)
+		})
+	})
+	breakerConfig := config.NewDefaultBreakerConfig()
+	breakerConfig.MinCalls = 2
+	breakerConfig.OpenTimeout = 50 * time.Millisecond
+	breakerConfig.HalfOpenCalls = 1
+	clientConfig := config.NewClientConfig()
+	clientConfig.Breaker = breakerConfig
+	c := NewRPCClient(clientConfig)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), 20*time.Millisecond); err != internal.ErrRequestTimeout {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	time.Sleep(80 * time.Millisecond)
+	// the only trial is canceled, it gives its slot back
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := c.InvokeSync(ctx, addr, protocol.NewPacket(3, nil, nil), time.Second); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.CircuitStats(); stats[0].State != config.CircuitClosed {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCircuitBreakerFailureCodes(t *testing.T) {
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(3, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			panic("failing")
+		})
+	})
+	breakerConfig := config.NewDefaultBreakerConfig()
+	breakerConfig.MinCalls = 2
+	clientConfig := config.NewClientConfig()
+	clientConfig.Breaker = breakerConfig
+	c := NewRPCClient(clientConfig)
+
+	// the server answers the failed process func with SystemError, which
+	// counts as a failure
+	for i := 0; i < 2; i++ {
+		resp, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != internal.SystemError {
+			t.Fatalf("unexpected response code: %d", resp.Code)
+		}
+	}
+	if stats := c.CircuitStats(); stats[0].State != config.CircuitOpen {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCircuitBreakerStuckTrial(t *testing.T) {
+	release := make(chan struct{})
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(3, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			<-release
+			return protocol.NewPacket(3, nil, nil)
+		})
+	})
+	t.Cleanup(func() {
+		close(release)
+	})
+	recorder := &circuitRecorder{}
+	breakerConfig := config.NewDefaultBreakerConfig()
+	breakerConfig.MinCalls = 2
+	breakerConfig.OpenTimeout = 50 * time.Millisecond
+	breakerConfig.HalfOpenCalls = 1
+	breakerConfig.Listener = recorder.listen
+	clientConfig := config.NewClientConfig()
+	clientConfig.Breaker = breakerConfig
+	c := NewRPCClient(clientConfig)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), 20*time.Millisecond); err != internal.ErrRequestTimeout {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	time.Sleep(80 * time.Millisecond)
+	// the only trial has no timeout and never ends
+	go c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), 0)
+	time.Sleep(10 * time.Millisecond)
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); !errors.Is(err, internal.ErrCircuitOpen) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// once OpenTimeout has passed the circuit opens again, then lets a new
+	// trial through
+	time.Sleep(50 * time.Millisecond)
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); !errors.Is(err, internal.ErrCircuitOpen) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	got := recorder.states()
+	want := []config.CircuitState{config.CircuitOpen, config.CircuitHalfOpen, config.CircuitOpen, config.CircuitHalfOpen, config.CircuitClosed}
+	if len(got) != len(want) {
+		t.Fatalf("state changes: %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("state changes: %v, want %v", got, want)
+		}
+	}
+}
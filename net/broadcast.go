@@ -0,0 +1,125 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sync"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+// BroadcastResponse is the outcome of a broadcast on one connection.
+type BroadcastResponse struct {
+	// ClientId is empty for the connections of unregistered clients.
+	ClientId   string
+	RemoteAddr net.Addr
+	// Response is nil for the oneway broadcasts.
+	Response *protocol.Packet
+	Err      error
+}
+
+// BroadcastResult sorts the outcomes of a broadcast: Acked holds the
+// connections which responded, or were written to for a oneway broadcast,
+// TimedOut those which did not respond before the deadline and Failed the
+// others.
+type BroadcastResult struct {
+	Acked    []BroadcastResponse
+	Failed   []BroadcastResponse
+	TimedOut []BroadcastResponse
+}
+
+func (b *BroadcastResult) add(resp BroadcastResponse) {
+	switch resp.Err {
+	case nil:
+		b.Acked = append(b.Acked, resp)
+	case internal.ErrRequestTimeout:
+		b.TimedOut = append(b.TimedOut, resp)
+	default:
+		b.Failed = append(b.Failed, resp)
+	}
+}
+
+type broadcastTarget struct {
+	ctx      *connContext
+	clientId string
+}
+
+// Broadcast sends a copy of the packet to every open connection. Unless oneway
+// it waits for the responses, all of them under the same timeout. The sends
+// run on their own goroutines, BroadcastConcurrency at most at once.
+func (r *RPCServer) Broadcast(ctx context.Context, packet *protocol.Packet, oneway bool, timeout time.Duration) *BroadcastResult {
+	var targets []broadcastTarget
+	r.conns.Range(func(_, value interface{}) bool {
+		targets = append(targets, broadcastTarget{ctx: value.(*connContext)})
+		return true
+	})
+	r.clients.resolve(targets)
+	return r.broadcast(ctx, targets, packet, oneway, timeout)
+}
+
+// BroadcastToGroup is Broadcast on the connections of the clients registered
+// in the group.
+func (r *RPCServer) BroadcastToGroup(ctx context.Context, group string, packet *protocol.Packet, oneway bool, timeout time.Duration) *BroadcastResult {
+	return r.broadcast(ctx, r.clients.groupTargets(group), packet, oneway, timeout)
+}
+
+func (r *RPCServer) broadcast(ctx context.Context, targets []broadcastTarget, packet *protocol.Packet, oneway bool, timeout time.Duration) *BroadcastResult {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	concurrency := r.serverConfig.BroadcastConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		result = &BroadcastResult{}
+		lock   sync.Mutex
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, concurrency)
+	)
+	for _, target := range targets {
+		resp := BroadcastResponse{ClientId: target.clientId, RemoteAddr: target.ctx.remoteAddr}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			resp.Err = contextError(ctx)
+			result.add(resp)
+			continue
+		}
+		wg.Add(1)
+		go func(conn *connContext) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			p := copyPacket(packet)
+			if oneway {
+				p.MarkOneway()
+				resp.Err = r.writeContext(conn, p)
+			} else {
+				resp.Response, resp.Err = r.invokeSync(ctx, conn, p, timeout)
+			}
+			lock.Lock()
+			result.add(resp)
+			lock.Unlock()
+		}(target.ctx)
+	}
+	wg.Wait()
+	return result
+}
+
+// copyPacket copies the packet under a new packet id, so the responses of the
+// connections can be told apart.
+func copyPacket(packet *protocol.Packet) *protocol.Packet {
+	p := protocol.NewPacket(packet.Code, packet.Body, nil)
+	p.Language = packet.Language
+	p.Version = packet.Version
+	p.Flag = packet.Flag
+	p.Message = packet.Message
+	p.ExtData = packet.ExtData
+	return p
+}
@@ -0,0 +1,77 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	s, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.BroadcastConcurrency = 2
+	})
+
+	var (
+		slow     sync.WaitGroup
+		received = make(chan string, 16)
+	)
+	newClient := func(id, group string, delay time.Duration) {
+		clientConfig := config.NewClientConfig()
+		clientConfig.ClientId = id
+		clientConfig.ClientGroup = group
+		c := NewRPCClient(clientConfig)
+		c.RegisterProcessor(2, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			received <- id
+			if delay > 0 {
+				time.Sleep(delay)
+				slow.Done()
+			}
+			return protocol.NewPacket(2, []byte(id), nil)
+		})
+		if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newClient("a", "g1", 0)
+	newClient("b", "g1", 0)
+	newClient("c", "g2", 300*time.Millisecond)
+	newClient("", "", 0)
+	slow.Add(1)
+	t.Cleanup(slow.Wait)
+
+	result := s.Broadcast(context.Background(), protocol.NewPacket(2, nil, nil), false, 200*time.Millisecond)
+	if len(result.Acked) != 3 || len(result.TimedOut) != 1 || len(result.Failed) != 0 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if result.TimedOut[0].ClientId != "c" {
+		t.Fatalf("unexpected timeout: %+v", result.TimedOut[0])
+	}
+	for _, ack := range result.Acked {
+		if string(ack.Response.Body) != ack.ClientId {
+			t.Fatalf("unexpected response: %+v", ack)
+		}
+	}
+	for len(received) > 0 {
+		<-received
+	}
+
+	result = s.BroadcastToGroup(context.Background(), "g1", protocol.NewPacket(2, nil, nil), true, time.Second)
+	if len(result.Acked) != 2 || len(result.TimedOut) != 0 || len(result.Failed) != 0 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	ids := []string{<-received, <-received}
+	sort.Strings(ids)
+	if ids[0] != "a" || ids[1] != "b" {
+		t.Fatalf("unexpected receivers: %v", ids)
+	}
+	select {
+	case id := <-received:
+		t.Fatalf("unexpected receiver: %s", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,75 @@
+package net
+
+import (
+	"sync"
+	"time"
+)
+
+// budgetSeconds is the window over which a budget bounds the extra requests.
+const budgetSeconds = 10
+
+type budgetSlot struct {
+	second int64
+	calls  int
+	extras int
+}
+
+// budget bounds the extra requests sent for the calls, the retries or the
+// hedges, to a share of the calls plus a number per second. It counts the
+// calls and the extra requests of the last seconds in a slot per second.
+type budget struct {
+	ratio        float64
+	minPerSecond int
+
+	lock  sync.Mutex
+	slots [budgetSeconds]budgetSlot
+}
+
+// newBudget returns nil, which allows all the extra requests, when there is
+// no bound.
+func newBudget(ratio float64, minPerSecond int) *budget {
+	if ratio <= 0 && minPerSecond <= 0 {
+		return nil
+	}
+	return &budget{ratio: ratio, minPerSecond: minPerSecond}
+}
+
+func (b *budget) slot(now int64) *budgetSlot {
+	s := &b.slots[now%budgetSeconds]
+	if s.second != now {
+		*s = budgetSlot{second: now}
+	}
+	return s
+}
+
+func (b *budget) call() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.slot(time.Now().Unix()).calls++
+}
+
+// take takes an extra request from the budget, it returns false if there is
+// none left.
+func (b *budget) take() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now().Unix()
+	calls, extras := 0, 0
+	for _, s := range b.slots {
+		if now-s.second < budgetSeconds {
+			calls += s.calls
+			extras += s.extras
+		}
+	}
+	if float64(extras+1) > b.ratio*float64(calls)+float64(b.minPerSecond*budgetSeconds) {
+		return false
+	}
+	b.slot(now).extras++
+	return true
+}
@@ -0,0 +1,26 @@
+package net
+
+import "testing"
+
+func TestBudget(t *testing.T) {
+	b := newBudget(0.5, 1)
+	extras := 0
+	for b.take() {
+		extras++
+	}
+	if extras != budgetSeconds {
+		t.Fatalf("%d extra requests without calls, want %d", extras, budgetSeconds)
+	}
+	for i := 0; i < 4; i++ {
+		b.call()
+	}
+	for b.take() {
+		extras++
+	}
+	if extras != budgetSeconds+2 {
+		t.Fatalf("%d extra requests after 4 calls, want %d", extras, budgetSeconds+2)
+	}
+	if !newBudget(0, 0).take() {
+		t.Fatal("unbounded budget denies an extra request")
+	}
+}
@@ -3,139 +3,374 @@ package net
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"github.com/panjf2000/gnet/pool/goroutine"
 	"github.com/smallnest/goframe"
-	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"thunder/config"
+	"thunder/internal"
 	"thunder/internal/logging"
+	"thunder/internal/timingwheel"
 	"thunder/protocol"
 	"time"
 )
 
 type RPCClient struct {
 	logger           logging.Logger
-	packetProcessors map[int16]processFunc
-	responseTable    sync.Map
+	packetProcessors map[int16]ContextProcessFunc
+	responseTable    *responseTable
 
+	// connectionTable holds the connection pool of every address,
+	// connectionLocker serializes the removals of the pools
 	connectionTable  sync.Map
 	connectionLocker sync.Mutex
+	// services holds the endpoints of every service resolved by the
+	// resolver, resolutions the first resolutions in progress, guarded by
+	// servicesLocker
+	services       sync.Map
+	resolutions    map[string]*resolution
+	servicesLocker sync.Mutex
+
+	clientConfig *config.ClientConfig
+	retryBudget  *budget
+	// hedgers holds the hedger of every code with a hedge policy
+	hedgers    sync.Map
+	hedgeStats hedgeStats
+	// circuits holds the circuit breaker of every address, or of every
+	// address and code
+	circuits sync.Map
+	// flights holds the requests shared by the coalesced calls in flight
+	flights       map[flightKey]*flight
+	flightsLock   sync.Mutex
+	coalesceStats coalesceStats
 
 	workerPool *goroutine.Pool
+	events     *eventDispatcher
 }
 
 func NewRPCClient(config *config.ClientConfig) *RPCClient {
+	workerPool := goroutine.Default()
 	return &RPCClient{
-		logger: config.Logger,
-		packetProcessors: make(map[int16]processFunc),
-		workerPool: goroutine.Default(),
+		logger:           config.Logger,
+		packetProcessors: make(map[int16]ContextProcessFunc),
+		responseTable:    newResponseTable(config.TimerTick, workerPool, config.Logger),
+		clientConfig:     config,
+		retryBudget:      newBudget(config.RetryBudgetRatio, config.RetryBudgetMinPerSecond),
+		workerPool:       workerPool,
+		events:           newEventDispatcher(config.EventListener, config.Logger),
 	}
 }
 
+type connWrapper struct {
+	conn      *limitedFrameConn
+	sendQueue *sendQueue
+	pool      *connPool
+	addr      net.Addr
+	checksum  int32
 
+	pending  int64
+	sent     uint64
+	received uint64
 
-type connWrapper struct {
-	conn goframe.FrameConn
-	addr net.Addr
+	heartbeatState
+	heartbeatTimer timingwheel.Timer
+	closed         int32
+	attrs          attributes
+}
+
+func (cw *connWrapper) LocalAddr() net.Addr {
+	return cw.conn.Conn().LocalAddr()
+}
+
+func (cw *connWrapper) RemoteAddr() net.Addr {
+	return cw.addr
+}
+
+func (cw *connWrapper) Attributes() config.Attributes {
+	return &cw.attrs
+}
+
+func (cw *connWrapper) isClosed() bool {
+	return atomic.LoadInt32(&cw.closed) == 1
+}
+
+func (cw *connWrapper) addPending(delta int64) {
+	atomic.AddInt64(&cw.pending, delta)
+}
+
+func (cw *connWrapper) pendingCount() int64 {
+	return atomic.LoadInt64(&cw.pending)
+}
+
+func (cw *connWrapper) stats() ConnectionStats {
+	return ConnectionStats{
+		LocalAddr:  cw.LocalAddr(),
+		RemoteAddr: cw.addr,
+		Pending:    cw.pendingCount(),
+		Sent:       atomic.LoadUint64(&cw.sent),
+		Received:   atomic.LoadUint64(&cw.received),
+	}
 }
 
+func (cw *connWrapper) checksumEnabled() bool {
+	return atomic.LoadInt32(&cw.checksum) == 1
+}
+
+func (cw *connWrapper) enableChecksum() {
+	atomic.StoreInt32(&cw.checksum, 1)
+}
+
+// InvokeSync sends the request to the address and waits for its response,
+// the timeout bounds every attempt of the call when it is retried. The calls
+// of a code with a coalesce policy may share their request. The request is
+// not hedged as there is no other address to hedge it to.
 func (R *RPCClient) InvokeSync(ctx context.Context, addr net.Addr, packet *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
-	cw, err := R.connect(addr)
-	if err != nil {
-		return nil, err
+	if policy := R.clientConfig.CoalescePolicies[packet.Code]; policy != nil {
+		return R.invokeCoalesced(ctx, policy, addr, packet, timeout)
 	}
-	ctx, _ = context.WithTimeout(ctx, timeout)
-	resp := NewResponseFuture(ctx, packet.PacketId, nil)
-	R.responseTable.Store(packet.PacketId, resp)
-	defer R.responseTable.Delete(packet.PacketId)
-	conn := cw.conn
-	data, err := protocol.Encode(packet)
+	return R.invokeSync(ctx, addr, packet, timeout)
+}
+
+func (R *RPCClient) invokeSync(ctx context.Context, addr net.Addr, packet *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
+	return R.invokePicked(ctx, func(context.Context, *protocol.Packet, []net.Addr) (net.Addr, func(error), error) {
+		return addr, nil, nil
+	}, packet, timeout, false)
+}
+
+// Ping sends a health probe to the address and waits for its answer.
+func (R *RPCClient) Ping(ctx context.Context, addr net.Addr, timeout time.Duration) error {
+	resp, _, err := R.invokeOnce(ctx, addr, protocol.NewPacket(protocol.PingCode, nil, nil), timeout)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = conn.WriteFrame(data)
+	defer R.releasePacket(resp)
+	if resp.Code != internal.Success {
+		return internal.ErrPingFailed
+	}
+	return nil
+}
+
+// invokeOnce sends the request to the address and waits for its response, it
+// reports whether the request was written, in which case it may have reached
+// the server.
+func (R *RPCClient) invokeOnce(ctx context.Context, addr net.Addr, packet *protocol.Packet, timeout time.Duration) (*protocol.Packet, bool, error) {
+	resp, err := R.send(ctx, addr, packet, nil, timeout)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	return resp.waitResponse()
+	pkt, err := R.responseTable.wait(resp)
+	return pkt, true, err
 }
 
-func (R *RPCClient) InvokeAsync(ctx context.Context, addr net.Addr, packet *protocol.Packet, callback func(future *ResponseFuture), timeout time.Duration) error {
-	cw, err := R.connect(addr)
+// send writes the request to the address and returns the future of its
+// response, it fails right away when the circuit of the request is open.
+func (R *RPCClient) send(ctx context.Context, addr net.Addr, packet *protocol.Packet, callback func(future *ResponseFuture), timeout time.Duration) (*ResponseFuture, error) {
+	c, generation, err := R.admit(addr, packet.Code)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	start := time.Now()
+	cw, err := R.connect(ctx, addr)
+	if err != nil {
+		c.record(generation, time.Since(start), nil, err)
+		return nil, err
 	}
-	ctx, _ = context.WithTimeout(ctx, timeout)
-	conn := cw.conn
 	resp := NewResponseFuture(ctx, packet.PacketId, callback)
-	R.responseTable.Store(packet.PacketId, resp)
-	data, err := protocol.Encode(packet)
+	resp.conn = cw
+	if c != nil {
+		resp.observe = func(pkt *protocol.Packet, err error) {
+			c.record(generation, time.Since(start), pkt, err)
+		}
+	}
+	R.responseTable.put(resp, timeout)
+	err = R.writePacket(ctx, cw, packet)
 	if err != nil {
-		return err
+		R.responseTable.removeFuture(resp)
+		c.record(generation, time.Since(start), nil, err)
+		return nil, err
 	}
-	err = conn.WriteFrame(data)
+	return resp, nil
+}
+
+func (R *RPCClient) InvokeAsync(ctx context.Context, addr net.Addr, packet *protocol.Packet, callback func(future *ResponseFuture), timeout time.Duration) error {
+	resp, err := R.send(ctx, addr, packet, callback, timeout)
 	if err != nil {
 		return err
 	}
-	go func() {
-		if err := recover(); err != nil {
-			R.logger.Errorf("receive message async error, err: %v", err)
-		}
-		R.receiveAsync(resp)
-	}()
+	R.responseTable.watch(resp)
 	return nil
 }
 
+// InvokeOneway writes the request to the address, its circuit counts the
+// request as a success once written.
 func (R *RPCClient) InvokeOneway(ctx context.Context, addr net.Addr, packet *protocol.Packet, timeout time.Duration) error {
-	cw, err := R.connect(addr)
-	if err != nil {
-		return err
-	}
-	conn := cw.conn
-	ctx, _ = context.WithTimeout(ctx, timeout)
-	data, err := protocol.Encode(packet)
+	c, generation, err := R.admit(addr, packet.Code)
 	if err != nil {
 		return err
 	}
-	err = conn.WriteFrame(data)
-	if err != nil {
-		return err
+	start := time.Now()
+	cw, err := R.connect(ctx, addr)
+	if err == nil {
+		err = R.writePacket(ctx, cw, packet)
 	}
-	return nil
+	c.record(generation, time.Since(start), nil, err)
+	return err
 }
 
 func (R *RPCClient) RegisterProcessor(code int16, processFunc processFunc) {
+	R.packetProcessors[code] = processFunc.withContext()
+}
+
+func (R *RPCClient) RegisterContextProcessor(code int16, processFunc ContextProcessFunc) {
 	R.packetProcessors[code] = processFunc
 }
 
-func (R *RPCClient) connect(addr net.Addr) (*connWrapper, error) {
+// ConnectionStats returns the stats of the connections to the address.
+func (R *RPCClient) ConnectionStats(addr net.Addr) []ConnectionStats {
+	if pool, ok := R.connectionTable.Load(addr.String()); ok {
+		return pool.(*connPool).stats()
+	}
+	return nil
+}
+
+func (R *RPCClient) connect(ctx context.Context, addr net.Addr) (*connWrapper, error) {
+	for {
+		pool := R.connPool(addr)
+		if cw := pool.selectConn(ctx); cw != nil {
+			if pool.overloaded() {
+				R.grow(pool)
+			}
+			return cw, nil
+		}
+
+		cw, err := R.dialLocked(ctx, pool)
+		// the pool was removed once its last connection closed, the address
+		// gets a new one
+		if err == internal.ErrConnectionClosed && pool.isRemoved() {
+			continue
+		}
+		return cw, err
+	}
+}
+
+func (R *RPCClient) dialLocked(ctx context.Context, pool *connPool) (*connWrapper, error) {
+	pool.dialLocker.Lock()
+	defer pool.dialLocker.Unlock()
+	if cw := pool.selectConn(ctx); cw != nil {
+		return cw, nil
+	}
+	return R.dial(ctx, pool)
+}
+
+func (R *RPCClient) connPool(addr net.Addr) *connPool {
+	if pool, ok := R.connectionTable.Load(addr.String()); ok {
+		return pool.(*connPool)
+	}
+	pool, _ := R.connectionTable.LoadOrStore(addr.String(), newConnPool(addr, R.clientConfig))
+	return pool.(*connPool)
+}
+
+// removePool removes the pool of the address from the table once it has no
+// connections nor subscriptions left, the next call to the address creates a
+// new one.
+func (R *RPCClient) removePool(pool *connPool) {
+	pool.topicsLocker.Lock()
+	defer pool.topicsLocker.Unlock()
+	if len(pool.topics) > 0 || !pool.remove() {
+		return
+	}
 	R.connectionLocker.Lock()
 	defer R.connectionLocker.Unlock()
-	conn, ok := R.connectionTable.Load(addr.String())
-	if ok {
-		return conn.(*connWrapper), nil
+	if current, ok := R.connectionTable.Load(pool.addr.String()); ok && current == pool {
+		R.connectionTable.Delete(pool.addr.String())
 	}
+}
 
-	cw, err := createGoFrameConn(addr)
+// dial opens a new connection to the address of the pool and adds it to the
+// pool, the caller holds the dial lock of the pool, so a slow dial only holds
+// up the calls to the same address.
+func (R *RPCClient) dial(ctx context.Context, pool *connPool) (*connWrapper, error) {
+	if pool.isDrained() {
+		return nil, internal.ErrConnectionClosed
+	}
+	cw, err := createGoFrameConn(ctx, pool.addr, R.clientConfig)
 	if err != nil {
 		return nil, err
 	}
-
-	R.connectionTable.Store(addr.String(), cw)
+	// the identity is queued before the connection can be picked, so it is
+	// the first frame the server reads
+	if R.clientConfig.ClientId != "" {
+		register := protocol.NewRegister(R.clientConfig.ClientId, R.clientConfig.ClientGroup, R.clientConfig.ClientTags)
+		if err = R.writeFrame(ctx, cw, register); err != nil {
+			_ = cw.conn.Close()
+			return nil, err
+		}
+	}
+	cw.pool = pool
+	if !pool.add(cw) {
+		_ = cw.conn.Close()
+		return nil, internal.ErrConnectionClosed
+	}
+	R.events.onConnect(cw)
 	go func() {
 		defer func() {
 			if err := recover(); err != nil {
-				R.logger.Errorf("receive response packet error, addr: %d, err: %v", addr.String(), err)
+				R.logger.Errorf("receive response packet error, addr: %s, err: %v", pool.addr.String(), err)
 			}
 		}()
 		R.receivePacket(cw)
 	}()
+	go R.sendPackets(cw)
+	if R.clientConfig.HeartbeatInterval > 0 {
+		R.scheduleHeartbeat(cw)
+	}
+
+	if len(pool.list()) > pool.minConns() {
+		R.scheduleShrink(pool)
+	}
 	return cw, nil
 }
 
-func createGoFrameConn(addr net.Addr) (*connWrapper, error) {
-	conn, err := net.Dial("tcp", addr.String())
+// grow adds a connection to the pool in the background.
+func (R *RPCClient) grow(pool *connPool) {
+	if !atomic.CompareAndSwapInt32(&pool.growing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&pool.growing, 0)
+		pool.dialLocker.Lock()
+		defer pool.dialLocker.Unlock()
+		if !pool.overloaded() {
+			return
+		}
+		if _, err := R.dial(context.Background(), pool); err != nil {
+			R.logger.Warnf("grow connection pool error, addr: %s, err: %v", pool.addr.String(), err)
+		}
+	}()
+}
+
+func (R *RPCClient) scheduleShrink(pool *connPool) {
+	R.responseTable.wheel.Add(&pool.shrinkTimer, R.clientConfig.ConnectionShrinkInterval, func() {
+		go R.shrink(pool)
+	})
+}
+
+// shrink closes the extra connections of the pool which are no longer needed
+// and checks the pool again later while it has extra connections.
+func (R *RPCClient) shrink(pool *connPool) {
+	closable, extra := pool.shrink()
+	for _, cw := range closable {
+		R.closeConnection(cw, internal.ErrConnectionClosed, nil)
+	}
+	if extra {
+		R.scheduleShrink(pool)
+	}
+}
+
+func createGoFrameConn(ctx context.Context, addr net.Addr, clientConfig *config.ClientConfig) (*connWrapper, error) {
+	conn, err := dialConn(ctx, addr, clientConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -155,11 +390,17 @@ func createGoFrameConn(addr net.Addr) (*connWrapper, error) {
 		InitialBytesToStrip: 4,
 	}
 
+	var maxFrameSize int32
+	if clientConfig.DecodeLimits != nil {
+		maxFrameSize = clientConfig.DecodeLimits.MaxFrameSize
+	}
 	fc := goframe.NewLengthFieldBasedFrameConn(encoderConfig, decoderConfig, conn)
 	cw := &connWrapper{
-		conn: fc,
-		addr: addr,
+		conn:      newLimitedFrameConn(fc, maxFrameSize),
+		sendQueue: newSendQueue(conn, clientConfig.SendQueueSize, clientConfig.FailOnFullSendQueue),
+		addr:      addr,
 	}
+	cw.touch(time.Now())
 
 	return cw, nil
 }
@@ -168,80 +409,326 @@ func (R *RPCClient) ShutDown() {
 	panic("implement me")
 }
 
-func (R *RPCClient) receiveAsync(f *ResponseFuture) {
-	_, err := f.waitResponse()
-	if err != nil {
-		f.executeInvokeCallback()
-	}
-}
-
 func (R *RPCClient) receivePacket(cw *connWrapper) {
-	var err error
 	for {
-		conn := cw.conn
+		var (
+			data []byte
+			buf  *protocol.Buffer
+			err  error
+		)
+		if R.clientConfig.PacketPool {
+			buf = protocol.AcquireBuffer()
+			buf.B, err = cw.conn.appendFrame(buf.B)
+			data = buf.B
+		} else {
+			data, err = cw.conn.ReadFrame()
+		}
 		if err != nil {
-			if err == io.EOF {
+			if buf != nil {
+				buf.Release()
+			}
+			if decodeErr, ok := err.(*protocol.DecodeError); ok {
+				R.onDecodeError(cw, decodeErr)
+				return
+			}
+			if !cw.isClosed() {
 				R.logger.Errorf("conn error, close connection, addr: %s, err: %v", cw.addr.String(), err)
 			}
-			cw.conn.Close()
-			break
+			R.closeConnection(cw, internal.ErrConnectionClosed, err)
+			return
+		}
+
+		if cw.checksumEnabled() {
+			if decodeErr := protocol.RequireChecksum(data); decodeErr != nil {
+				if buf != nil {
+					buf.Release()
+				}
+				R.onDecodeError(cw, decodeErr)
+				return
+			}
 		}
-		data, tmpErr := conn.ReadFrame()
-		if tmpErr != nil {
-			err = tmpErr
+		var pkt *protocol.Packet
+		if buf != nil {
+			pkt, err = protocol.DecodePooled(data, buf, R.clientConfig.DecodeLimits)
+		} else {
+			// every frame read is a new slice, so the body can alias it
+			pkt, err = protocol.DecodeAliasBody(data, R.clientConfig.DecodeLimits)
+		}
+		if err != nil {
+			if buf != nil {
+				buf.Release()
+			}
+			R.onDecodeError(cw, err.(*protocol.DecodeError))
+			return
+		}
+		cw.touch(time.Now())
+		if protocol.HasChecksum(data) {
+			cw.enableChecksum()
+		}
+		if pkt.IsGoodbye() {
+			R.logger.Infof("goodbye received, close connection, addr: %s", cw.addr.String())
+			R.releasePacket(pkt)
+			R.closeConnection(cw, internal.ErrConnectionClosed, errIdle)
+			return
+		}
+		if pkt.IsHeartbeat() {
+			R.onHeartbeat(pkt, cw)
 			continue
 		}
+		atomic.AddUint64(&cw.received, 1)
+		R.processPacket(pkt, cw)
+	}
+}
+
+// onDecodeError reports the malformed frame and closes the connection which
+// received it.
+func (R *RPCClient) onDecodeError(cw *connWrapper, err *protocol.DecodeError) {
+	R.logger.Errorf("decode packet error, close connection, addr: %s, err: %v", cw.addr.String(), err)
+	if R.clientConfig.DecodeErrorHook != nil {
+		R.clientConfig.DecodeErrorHook(cw.addr, err)
+	}
+	R.closeConnection(cw, err, err)
+}
+
+// errIdle is the cause of closing a connection the server has evicted for
+// being idle.
+var errIdle = errors.New("connection idle")
 
-		pkt, tmpErr := protocol.Decode(data)
-		if tmpErr != nil {
-			err = tmpErr
-			R.logger.Errorf("decode packet error, err: %v", err)
+// closeConnection removes the connection from its pool, closes it and fails
+// all the futures waiting for a response from it with err. The cause of the
+// close is reported to the event listener, it is nil for an orderly close.
+// Only the first call takes effect.
+func (R *RPCClient) closeConnection(cw *connWrapper, err error, cause error) {
+	if !atomic.CompareAndSwapInt32(&cw.closed, 0, 1) {
+		return
+	}
+	switch cause {
+	case nil:
+	case errIdle:
+		R.events.onIdle(cw)
+	default:
+		R.events.onException(cw, cause)
+	}
+	cw.pool.removeConn(cw)
+	cw.sendQueue.close()
+	R.responseTable.wheel.Stop(&cw.heartbeatTimer)
+	_ = cw.conn.Close()
+	R.responseTable.failConn(cw, err)
+	R.onSubscriberClosed(cw)
+	R.removePool(cw.pool)
+	R.events.onClose(cw, &cw.attrs)
+}
+
+// Subscribe subscribes the client to the topics of the server at the address,
+// the packets published to them are passed to the processor registered for
+// protocol.PublishCode. The subscriptions are carried by one connection to the
+// address and sent again on another one when it is closed.
+func (R *RPCClient) Subscribe(ctx context.Context, addr net.Addr, topics ...string) error {
+	pool := R.connPool(addr)
+	pool.topicsLocker.Lock()
+	// a pool with topics is never removed, a removed one is replaced
+	for pool.isRemoved() {
+		pool.topicsLocker.Unlock()
+		pool = R.connPool(addr)
+		pool.topicsLocker.Lock()
+	}
+	for _, topic := range topics {
+		pool.topics[topic] = struct{}{}
+	}
+	pool.topicsLocker.Unlock()
+	return R.subscribe(ctx, pool, topics)
+}
+
+// Unsubscribe removes the subscriptions of the client to the topics of the
+// server at the address.
+func (R *RPCClient) Unsubscribe(ctx context.Context, addr net.Addr, topics ...string) error {
+	value, ok := R.connectionTable.Load(addr.String())
+	if !ok {
+		return nil
+	}
+	pool := value.(*connPool)
+	pool.topicsLocker.Lock()
+	defer pool.topicsLocker.Unlock()
+	for _, topic := range topics {
+		delete(pool.topics, topic)
+	}
+	if pool.subscriber == nil {
+		return nil
+	}
+	return R.writeFrame(ctx, pool.subscriber, protocol.NewUnsubscribe(topics...))
+}
+
+// subscribe sends the topics on the subscriber connection of the pool, or all
+// the topics of the pool when it has to pick a new subscriber connection.
+func (R *RPCClient) subscribe(ctx context.Context, pool *connPool, topics []string) error {
+	cw, err := R.connect(ctx, pool.addr)
+	if err != nil {
+		return err
+	}
+	pool.topicsLocker.Lock()
+	defer pool.topicsLocker.Unlock()
+	if pool.subscriber == nil || pool.subscriber.isClosed() {
+		pool.subscriber = cw
+		topics = make([]string, 0, len(pool.topics))
+		for topic := range pool.topics {
+			topics = append(topics, topic)
 		}
-		R.processPacket(pkt, cw)
+	}
+	if len(topics) == 0 {
+		return nil
+	}
+	return R.writeFrame(ctx, pool.subscriber, protocol.NewSubscribe(topics...))
+}
+
+// onSubscriberClosed subscribes again on another connection when the closed
+// connection carried the subscriptions of its pool.
+func (R *RPCClient) onSubscriberClosed(cw *connWrapper) {
+	pool := cw.pool
+	pool.topicsLocker.Lock()
+	lost := pool.subscriber == cw && len(pool.topics) > 0 && !pool.isDrained()
+	if pool.subscriber == cw {
+		pool.subscriber = nil
+	}
+	pool.topicsLocker.Unlock()
+	if lost {
+		go R.resubscribe(pool)
+	}
+}
+
+// resubscribe subscribes again to the topics of the pool, dialing a new
+// connection if needed, and tries again later until it succeeds.
+func (R *RPCClient) resubscribe(pool *connPool) {
+	if err := R.subscribe(context.Background(), pool, nil); err != nil {
+		R.logger.Warnf("resubscribe error, addr: %s, err: %v", pool.addr.String(), err)
+		R.responseTable.wheel.Add(&pool.resubscribeTimer, R.clientConfig.ResubscribeInterval, func() {
+			go R.resubscribe(pool)
+		})
+	}
+}
+
+// writePacket encodes the packet, with a checksum if it is enabled by the
+// config or negotiated by the peer, and queues it on the connection. With
+// packet pooling the frame is encoded into a pooled buffer, which is released
+// once it is written.
+func (R *RPCClient) writePacket(ctx context.Context, cw *connWrapper, packet *protocol.Packet) error {
+	if err := R.writeFrame(ctx, cw, packet); err != nil {
+		return err
+	}
+	atomic.AddUint64(&cw.sent, 1)
+	return nil
+}
+
+// writeFrame is writePacket without the stats, for the control packets.
+func (R *RPCClient) writeFrame(ctx context.Context, cw *connWrapper, packet *protocol.Packet) error {
+	checksum := R.clientConfig.Checksum || cw.checksumEnabled()
+	f, err := encodeFrame(packet, checksum, R.clientConfig.PacketPool)
+	if err != nil {
+		return err
+	}
+	return cw.sendQueue.enqueue(ctx, f)
+}
+
+func (R *RPCClient) scheduleHeartbeat(cw *connWrapper) {
+	R.responseTable.wheel.Add(&cw.heartbeatTimer, R.clientConfig.HeartbeatInterval, func() {
+		go R.checkHeartbeat(cw)
+	})
+}
+
+// checkHeartbeat sends a heartbeat on the connection if it is idle, or closes
+// it if too many heartbeats went unanswered.
+func (R *RPCClient) checkHeartbeat(cw *connWrapper) {
+	if cw.isClosed() {
+		return
+	}
+	send, dead := cw.check(time.Now(), R.clientConfig.HeartbeatInterval, R.clientConfig.HeartbeatMaxMissed)
+	switch {
+	case dead:
+		R.logger.Warnf("heartbeats missed, close connection, addr: %s", cw.addr.String())
+		R.closeConnection(cw, internal.ErrConnectionClosed, internal.ErrHeartbeatTimeout)
+		return
+	case send:
+		if err := R.writeFrame(context.Background(), cw, protocol.NewHeartbeat()); err != nil {
+			R.logger.Warnf("send heartbeat error, addr: %s, err: %v", cw.addr.String(), err)
+		}
+	}
+	R.scheduleHeartbeat(cw)
+}
+
+// onHeartbeat answers a heartbeat request, the heartbeat responses only
+// matter for having been read.
+func (R *RPCClient) onHeartbeat(heartbeat *protocol.Packet, cw *connWrapper) {
+	if !heartbeat.IsResponseType() {
+		if err := R.writeFrame(context.Background(), cw, protocol.NewHeartbeatResponse(heartbeat)); err != nil {
+			R.logger.Warnf("send heartbeat response error, addr: %s, err: %v", cw.addr.String(), err)
+		}
+	}
+	R.releasePacket(heartbeat)
+}
+
+// sendPackets writes the frames queued on the connection until it is closed.
+func (R *RPCClient) sendPackets(cw *connWrapper) {
+	if err := cw.sendQueue.run(); err != nil {
+		R.logger.Errorf("write error, close connection, addr: %s, err: %v", cw.addr.String(), err)
+		R.closeConnection(cw, internal.ErrConnectionClosed, err)
+	}
+}
+
+// releasePacket gives the packet back to the pool when packet pooling is
+// enabled.
+func (R *RPCClient) releasePacket(packet *protocol.Packet) {
+	if R.clientConfig.PacketPool && !packet.IsReleased() {
+		packet.Release()
 	}
 }
 
 func (R *RPCClient) processPacket(packet *protocol.Packet, cw *connWrapper) {
 	if packet.IsResponseType() {
-		resp, exist := R.responseTable.Load(packet.PacketId)
-		if exist {
-			R.responseTable.Delete(packet.PacketId)
-			responseFuture := resp.(*ResponseFuture)
+		responseFuture := R.responseTable.remove(packet.PacketId)
+		if responseFuture != nil {
 			err := R.workerPool.Submit(func() {
 				defer func() {
 					if err := recover(); err != nil {
 						R.logger.Errorf("executeCallback error: %v", err)
 					}
 				}()
-				responseFuture.Response = packet
+				if !responseFuture.complete(packet, nil) {
+					R.releasePacket(packet)
+					return
+				}
 				responseFuture.executeInvokeCallback()
-				if responseFuture.Done != nil {
-					responseFuture.Done <- true
+				// the caller of InvokeSync owns the response, it is only
+				// released for the callbacks
+				if responseFuture.callback != nil {
+					R.releasePacket(packet)
 				}
-
 			})
 
 			if err != nil {
 				R.logger.Warnf("submit func to workerpool error, err: %v", err)
+				R.releasePacket(packet)
+				R.responseTable.fail(responseFuture, err)
 			}
+		} else {
+			R.releasePacket(packet)
 		}
 	} else {
 		f := R.packetProcessors[packet.Code]
 		if f != nil {
 			err := R.workerPool.Submit(func() {
-				res := f(packet, cw.addr)
-				if res != nil && !packet.IsOneway()  {
+				defer R.releasePacket(packet)
+				res := f(withConnection(context.Background(), cw), packet)
+				if res != nil && !packet.IsOneway() {
 					res.PacketId = packet.PacketId
 					res.MarkResponseType()
-					data, err := protocol.Encode(res)
-					if err != nil {
-						R.logger.Errorf("encode response packet error, err: %v", err)
-					}
-					err = cw.conn.WriteFrame(data)
+					err := R.writePacket(context.Background(), cw, res)
 					if err != nil {
 						R.logger.Warnf("send response packet error, response: %+v, err: %+v", res, err)
 					}
 				}
+				// only the responses acquired from the pool are the client's
+				if res != nil && res.IsPooled() {
+					R.releasePacket(res)
+				}
 			})
 
 			if err != nil {
@@ -249,6 +736,7 @@ func (R *RPCClient) processPacket(packet *protocol.Packet, cw *connWrapper) {
 			}
 		} else {
 			R.logger.Warnf("there is no process func registered with code: %d", packet.Code)
+			R.releasePacket(packet)
 		}
 	}
 }
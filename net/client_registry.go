@@ -0,0 +1,134 @@
+package net
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ClientInfo describes a client registered on the server.
+type ClientInfo struct {
+	Id    string
+	Group string
+	Tags  map[string]string
+	// Connections is the number of connections of the client.
+	Connections int
+}
+
+type registeredClient struct {
+	info  ClientInfo
+	conns []*connContext
+	next  uint32
+}
+
+// clientRegistry indexes the live connections of the registered clients by
+// client id.
+type clientRegistry struct {
+	lock    sync.RWMutex
+	clients map[string]*registeredClient
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{
+		clients: make(map[string]*registeredClient),
+	}
+}
+
+// register adds the connection to the client, the latest group and tags of
+// the client win. A connection registered again under another id moves.
+func (cr *clientRegistry) register(ctx *connContext, id, group string, tags map[string]string) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if ctx.clientId != "" {
+		cr.removeLocked(ctx)
+	}
+	client, ok := cr.clients[id]
+	if !ok {
+		client = &registeredClient{}
+		cr.clients[id] = client
+	}
+	client.info = ClientInfo{Id: id, Group: group, Tags: tags}
+	client.conns = append(client.conns, ctx)
+	ctx.clientId = id
+}
+
+// unregister removes the closed connection from its client, the client is
+// removed with its last connection.
+func (cr *clientRegistry) unregister(ctx *connContext) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.removeLocked(ctx)
+}
+
+func (cr *clientRegistry) removeLocked(ctx *connContext) {
+	client, ok := cr.clients[ctx.clientId]
+	if !ok {
+		return
+	}
+	for i, c := range client.conns {
+		if c == ctx {
+			client.conns = append(client.conns[:i:i], client.conns[i+1:]...)
+			break
+		}
+	}
+	if len(client.conns) == 0 {
+		delete(cr.clients, ctx.clientId)
+	}
+	ctx.clientId = ""
+}
+
+// conn picks one of the connections of the client in turn.
+func (cr *clientRegistry) conn(id string) (*connContext, bool) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	client, ok := cr.clients[id]
+	if !ok {
+		return nil, false
+	}
+	return client.conns[atomic.AddUint32(&client.next, 1)%uint32(len(client.conns))], true
+}
+
+// list returns the registered clients sorted by id, only those of the group
+// unless group is empty.
+func (cr *clientRegistry) list(group string) []ClientInfo {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	clients := make([]ClientInfo, 0, len(cr.clients))
+	for _, client := range cr.clients {
+		if group != "" && client.info.Group != group {
+			continue
+		}
+		info := client.info
+		info.Connections = len(client.conns)
+		clients = append(clients, info)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id < clients[j].Id
+	})
+	return clients
+}
+
+// resolve fills in the client ids of the targets.
+func (cr *clientRegistry) resolve(targets []broadcastTarget) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	for i := range targets {
+		targets[i].clientId = targets[i].ctx.clientId
+	}
+}
+
+// groupTargets returns all the connections of the clients of the group.
+func (cr *clientRegistry) groupTargets(group string) []broadcastTarget {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	var targets []broadcastTarget
+	for id, client := range cr.clients {
+		if client.info.Group != group {
+			continue
+		}
+		for _, ctx := range client.conns {
+			targets = append(targets, broadcastTarget{ctx: ctx, clientId: id})
+		}
+	}
+	return targets
+}
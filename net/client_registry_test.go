@@ -0,0 +1,56 @@
+package net
+
+import (
+	"context"
+	"net"
+	"testing"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+func TestInvokeClient(t *testing.T) {
+	s, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.IdleTimeout = 200 * time.Millisecond
+	})
+	clientConfig := config.NewClientConfig()
+	clientConfig.ClientId = "client-1"
+	clientConfig.ClientGroup = "group-1"
+	clientConfig.ClientTags = map[string]string{"zone": "a"}
+	c := NewRPCClient(clientConfig)
+	c.RegisterProcessor(2, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+		return protocol.NewPacket(2, append([]byte("client-1:"), p.Body...), nil)
+	})
+
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clients := s.Clients("group-1")
+	if len(clients) != 1 || clients[0].Id != "client-1" || clients[0].Tags["zone"] != "a" || clients[0].Connections != 1 {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+	if clients = s.Clients("group-2"); len(clients) != 0 {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+
+	resp, err := s.InvokeClientSync(context.Background(), "client-1", protocol.NewPacket(2, []byte("ping"), nil), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "client-1:ping" {
+		t.Fatalf("unexpected response: %s", resp.Body)
+	}
+	if _, err = s.InvokeClientSync(context.Background(), "client-2", protocol.NewPacket(2, nil, nil), time.Second); err != internal.ErrClientNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the client is unregistered with its last connection
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.Clients("")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client is not unregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
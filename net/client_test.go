@@ -3,27 +3,178 @@ package net
 import (
 	"context"
 	"net"
+	"strconv"
+	"sync"
 	"testing"
 	"thunder/config"
+	"thunder/internal"
 	"thunder/protocol"
 	"time"
 )
 
 func TestInvokeSync(t *testing.T) {
-	addr, err := net.ResolveTCPAddr("", "127.0.0.1:9003")
+	_, addr := startTestServer(t, nil)
+	c := NewRPCClient(config.NewClientConfig())
+	p, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, []byte("Creams"), nil), 3*time.Second)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	if !p.IsResponseType() || string(p.Body) != "Creams" {
+		t.Fatalf("unexpected response: %+v", p)
+	}
+}
+
+func TestInvokeAsync(t *testing.T) {
+	_, addr := startTestServer(t, nil)
+	c := NewRPCClient(config.NewClientConfig())
+	done := make(chan *ResponseFuture, 1)
+	err := c.InvokeAsync(context.Background(), addr, protocol.NewPacket(1, []byte("Creams"), nil), func(future *ResponseFuture) {
+		done <- future
+	}, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case f := <-done:
+		if f.Err != nil || string(f.Response.Body) != "Creams" {
+			t.Fatalf("unexpected response: %+v, err: %v", f.Response, f.Err)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("callback is not invoked")
 	}
+}
+
+func TestPing(t *testing.T) {
+	_, addr := startTestServer(t, nil)
 	c := NewRPCClient(config.NewClientConfig())
-	err = c.InvokeAsync(context.Background(), addr, protocol.NewPacket(1, []byte("Creams"), nil), func(future *ResponseFuture) {
-		c.logger.Infof("%+v", future.Response)
-	}, time.Second * 3000)
+	if err := c.Ping(context.Background(), addr, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	_ = l.Close()
+	if err := c.Ping(context.Background(), l.Addr(), time.Second); err == nil {
+		t.Fatal("unreachable address answers the ping")
+	}
+}
+
+func TestInvokeTimeout(t *testing.T) {
+	// the late responses must be written before the server stops
+	var slow sync.WaitGroup
+	slow.Add(3)
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(2, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			defer slow.Done()
+			time.Sleep(200 * time.Millisecond)
+			return protocol.NewPacket(2, nil, nil)
+		})
+	})
+	t.Cleanup(slow.Wait)
+	c := NewRPCClient(config.NewClientConfig())
+
+	start := time.Now()
+	_, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(2, nil, nil), 50*time.Millisecond)
+	if err != internal.ErrRequestTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Fatalf("timeout fired after %v", elapsed)
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 4*time.Second)
+	done := make(chan error, 1)
+	err = c.InvokeAsync(context.Background(), addr, protocol.NewPacket(2, nil, nil), func(future *ResponseFuture) {
+		done <- future.Err
+	}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
 	select {
-	case <-ctx.Done():
+	case err = <-done:
+		if err != internal.ErrRequestTimeout {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback is not invoked")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err = c.InvokeSync(ctx, addr, protocol.NewPacket(2, nil, nil), time.Second); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.responseTable.futures.Range(func(key, value interface{}) bool {
+		t.Fatalf("future %v is left in the response table", key)
+		return true
+	})
+	if n := c.ConnectionStats(addr)[0].Pending; n != 0 {
+		t.Fatalf("%d requests are left pending", n)
+	}
+}
+
+func TestPacketPool(t *testing.T) {
+	protocol.EnablePoolDebug(true)
+	defer protocol.EnablePoolDebug(false)
+
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.PacketPool = true
+	})
+	clientConfig := config.NewClientConfig()
+	clientConfig.PacketPool = true
+	c := NewRPCClient(clientConfig)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		body := []byte(strconv.Itoa(i))
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			p, err := c.InvokeSync(context.Background(), addr, protocol.AcquirePacket(1, body, nil), 3*time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(p.Body) != string(body) {
+				t.Errorf("unexpected response: %+v", p)
+			}
+			p.Release()
+		}()
+
+		err := c.InvokeAsync(context.Background(), addr, protocol.AcquirePacket(1, body, nil), func(future *ResponseFuture) {
+			defer wg.Done()
+			if future.Err != nil || string(future.Response.Body) != string(body) {
+				t.Errorf("unexpected response: %+v, err: %v", future.Response, future.Err)
+			}
+		}, 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestPacketPoolSharedResponse(t *testing.T) {
+	protocol.EnablePoolDebug(true)
+	defer protocol.EnablePoolDebug(false)
+
+	// a response the processor did not acquire from the pool is not released
+	cached := protocol.NewPacket(7, []byte("cached"), nil)
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.PacketPool = true
+		s.RegisterProcessor(7, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			return cached
+		})
+	})
+	c := NewRPCClient(config.NewClientConfig())
+	for i := 0; i < 3; i++ {
+		resp, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(7, nil, nil), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body) != "cached" {
+			t.Fatalf("unexpected response: %+v", resp)
+		}
 	}
 }
@@ -0,0 +1,264 @@
+package net
+
+import (
+	"context"
+	"crypto/sha256"
+	"net"
+	"sync/atomic"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/internal/timingwheel"
+	"thunder/protocol"
+	"time"
+)
+
+// CoalesceStats counts the coalesced calls of a client.
+type CoalesceStats struct {
+	// Calls is the number of calls of the codes with a coalesce policy and
+	// Coalesced the number of them which shared the request of another.
+	Calls     uint64
+	Coalesced uint64
+}
+
+type coalesceStats struct {
+	calls     uint64
+	coalesced uint64
+}
+
+// CoalesceStats returns the counts of the coalesced calls.
+func (R *RPCClient) CoalesceStats() CoalesceStats {
+	return CoalesceStats{
+		Calls:     atomic.LoadUint64(&R.coalesceStats.calls),
+		Coalesced: atomic.LoadUint64(&R.coalesceStats.coalesced),
+	}
+}
+
+type flightKey struct {
+	addr string
+	code int16
+	// hashed tells the keys hashed from the body from the ext data ones
+	hashed bool
+	key    string
+}
+
+type flightResult struct {
+	resp *protocol.Packet
+	err  error
+}
+
+// flight is a request shared by the calls with the same key, every call
+// waits for the result on a channel of its own. The request is canceled once
+// all the calls have stopped waiting, or once the latest deadline of the calls
+// has passed.
+type flight struct {
+	ctx     context.Context
+	cancel  func()
+	started time.Time
+	// deadline is the latest deadline of the waiters, unbounded is set once
+	// a waiter has no timeout
+	deadline  time.Time
+	unbounded bool
+	timer     timingwheel.Timer
+	expired   int32
+
+	waiters []*waiter
+	left    int
+	landed  bool
+	// delivered is set once the result is handed to the waiters
+	delivered bool
+}
+
+type waiter struct {
+	result chan flightResult
+	left   bool
+}
+
+func coalesceKey(policy *config.CoalescePolicy, addr net.Addr, packet *protocol.Packet) flightKey {
+	if key, ok := packet.ExtData[policy.Key]; ok && policy.Key != "" {
+		return flightKey{addr: addr.String(), code: packet.Code, key: key}
+	}
+	sum := sha256.Sum256(packet.Body)
+	return flightKey{addr: addr.String(), code: packet.Code, hashed: true, key: string(sum[:])}
+}
+
+// invokeCoalesced joins the call to the request in flight with the same key,
+// or sends one. The request is not canceled with the call which sent it, every
+// call waits for its response within its own timeout and context. A call does
+// not join a request older than its timeout, whose response is likely lost.
+func (R *RPCClient) invokeCoalesced(ctx context.Context, policy *config.CoalescePolicy, addr net.Addr, packet *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
+	atomic.AddUint64(&R.coalesceStats.calls, 1)
+	key := coalesceKey(policy, addr, packet)
+	w := &waiter{result: make(chan flightResult, 1)}
+	now := time.Now()
+
+	R.flightsLock.Lock()
+	f, ok := R.flights[key]
+	if ok && (timeout > 0 && now.Sub(f.started) >= timeout || !f.unbounded && !now.Before(f.deadline)) {
+		ok = false
+	}
+	if !ok {
+		if R.flights == nil {
+			R.flights = make(map[flightKey]*flight)
+		}
+		f = &flight{started: now}
+		f.ctx, f.cancel = context.WithCancel(detachedContext{ctx})
+		R.flights[key] = f
+	}
+	f.waiters = append(f.waiters, w)
+	R.extendFlight(f, now, timeout)
+	R.flightsLock.Unlock()
+
+	if ok {
+		atomic.AddUint64(&R.coalesceStats.coalesced, 1)
+	} else {
+		go R.fly(key, f, addr, packet)
+	}
+
+	var timer timingwheel.Timer
+	expired := make(chan struct{})
+	if timeout > 0 {
+		R.responseTable.wheel.Add(&timer, timeout, func() {
+			close(expired)
+		})
+		defer R.responseTable.wheel.Stop(&timer)
+	}
+	select {
+	case r := <-w.result:
+		return r.resp, r.err
+	case <-expired:
+		R.leave(key, f, w)
+		return nil, internal.ErrRequestTimeout
+	case <-ctx.Done():
+		R.leave(key, f, w)
+		return nil, contextError(ctx)
+	}
+}
+
+// extendFlight pushes the deadline of the flight to the deadline of the
+// joining call, the flight has none once a call without timeout joins it.
+func (R *RPCClient) extendFlight(f *flight, now time.Time, timeout time.Duration) {
+	if f.unbounded {
+		return
+	}
+	wheel := R.responseTable.wheel
+	if timeout <= 0 {
+		f.unbounded = true
+		wheel.Stop(&f.timer)
+		return
+	}
+	deadline := now.Add(timeout)
+	if !deadline.After(f.deadline) {
+		return
+	}
+	f.deadline = deadline
+	wheel.Stop(&f.timer)
+	wheel.Add(&f.timer, timeout, func() {
+		atomic.StoreInt32(&f.expired, 1)
+		f.cancel()
+	})
+}
+
+// leave stops a call waiting for the flight, the last one cancels it. A call
+// leaving once the result is handed out releases its share of it.
+func (R *RPCClient) leave(key flightKey, f *flight, w *waiter) {
+	R.flightsLock.Lock()
+	w.left = true
+	if f.delivered {
+		R.flightsLock.Unlock()
+		if r := <-w.result; r.resp != nil {
+			R.releasePacket(r.resp)
+		}
+		return
+	}
+	defer R.flightsLock.Unlock()
+	if f.left++; f.left < len(f.waiters) || f.landed {
+		return
+	}
+	R.land(key, f)
+	f.cancel()
+}
+
+// land removes the flight from the flights, unless it was replaced by a newer
+// one, the caller holds the flights lock.
+func (R *RPCClient) land(key flightKey, f *flight) {
+	f.landed = true
+	R.responseTable.wheel.Stop(&f.timer)
+	if R.flights[key] == f {
+		delete(R.flights, key)
+	}
+}
+
+// fly sends the request of the flight and hands its response to the waiting
+// calls, each of which gets a copy it can release. The response is released
+// if no call waits for it anymore.
+func (R *RPCClient) fly(key flightKey, f *flight, addr net.Addr, packet *protocol.Packet) {
+	resp, err := R.invokeSync(f.ctx, addr, packet, 0)
+	if err == context.Canceled && atomic.LoadInt32(&f.expired) == 1 {
+		err = internal.ErrRequestTimeout
+	}
+
+	R.flightsLock.Lock()
+	if !f.landed {
+		R.land(key, f)
+	}
+	f.delivered = true
+	var waiting []*waiter
+	for _, w := range f.waiters {
+		if !w.left {
+			waiting = append(waiting, w)
+		}
+	}
+	R.flightsLock.Unlock()
+	f.cancel()
+
+	if len(waiting) == 0 {
+		if resp != nil {
+			R.releasePacket(resp)
+		}
+		return
+	}
+	// the copies are made before the response is handed out, the waiter
+	// given the response may release it right away
+	results := make([]flightResult, len(waiting))
+	for i := range waiting {
+		results[i] = flightResult{resp: resp, err: err}
+		if resp != nil && i > 0 {
+			results[i].resp = clonePacket(resp)
+		}
+	}
+	for i, w := range waiting {
+		w.result <- results[i]
+	}
+}
+
+// clonePacket copies the packet, its body and its ext data.
+func clonePacket(packet *protocol.Packet) *protocol.Packet {
+	p := copyPacket(packet)
+	p.PacketId = packet.PacketId
+	p.Body = append([]byte(nil), packet.Body...)
+	if packet.ExtData != nil {
+		p.ExtData = make(map[string]string, len(packet.ExtData))
+		for k, v := range packet.ExtData {
+			p.ExtData[k] = v
+		}
+	}
+	return p
+}
+
+// detachedContext keeps the values of its parent but not its deadline nor
+// its cancellation, a shared request outlives the call which sent it.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
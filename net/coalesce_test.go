@@ -0,0 +1,197 @@
+package net
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	var calls int32
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(6, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(100 * time.Millisecond)
+			return protocol.NewPacket(6, p.Body, nil)
+		})
+	})
+	clientConfig := config.NewClientConfig()
+	clientConfig.CoalescePolicies = map[int16]*config.CoalescePolicy{6: {Key: "key"}}
+	c := NewRPCClient(clientConfig)
+
+	// the calls with the same body share a request, each gets its own copy
+	// of the response
+	var wg sync.WaitGroup
+	resps := make([]*protocol.Packet, 10)
+	for i := range resps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(6, []byte("same"), nil), time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resps[i] = resp
+		}(i)
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("%d requests sent for 10 calls", n)
+	}
+	for i, resp := range resps {
+		if resp == nil || string(resp.Body) != "same" {
+			t.Fatalf("unexpected response: %+v", resp)
+		}
+		for _, other := range resps[:i] {
+			if other == resp {
+				t.Fatal("calls share a response packet")
+			}
+		}
+	}
+	if stats := c.CoalesceStats(); stats.Calls != 10 || stats.Coalesced != 9 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// the ext data key takes over the body
+	atomic.StoreInt32(&calls, 0)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := protocol.NewPacket(6, []byte("same"), nil)
+			p.ExtData = map[string]string{"key": strconv.Itoa(i % 2)}
+			if _, err := c.InvokeSync(context.Background(), addr, p, time.Second); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("%d requests sent for 2 keys", n)
+	}
+}
+
+func TestCoalesceCancel(t *testing.T) {
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(6, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			time.Sleep(100 * time.Millisecond)
+			return protocol.NewPacket(6, p.Body, nil)
+		})
+	})
+	clientConfig := config.NewClientConfig()
+	clientConfig.CoalescePolicies = map[int16]*config.CoalescePolicy{6: {}}
+	c := NewRPCClient(clientConfig)
+
+	// the call which sent the request gives up, the others still get the
+	// response, each within its own timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 3)
+	invoke := func(ctx context.Context, timeout time.Duration) {
+		_, err := c.InvokeSync(ctx, addr, protocol.NewPacket(6, []byte("same"), nil), timeout)
+		errs <- err
+	}
+	go invoke(ctx, time.Second)
+	time.Sleep(10 * time.Millisecond)
+	go invoke(context.Background(), 20*time.Millisecond)
+	go invoke(context.Background(), time.Second)
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	want := []error{context.Canceled, internal.ErrRequestTimeout, nil}
+	for _, w := range want {
+		if err := <-errs; err != w {
+			t.Fatalf("unexpected error: %v, want %v", err, w)
+		}
+	}
+	if stats := c.CoalesceStats(); stats.Coalesced != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCoalesceTimeout(t *testing.T) {
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(6, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			time.Sleep(100 * time.Millisecond)
+			return protocol.NewPacket(6, p.Body, nil)
+		})
+	})
+	clientConfig := config.NewClientConfig()
+	clientConfig.CoalescePolicies = map[int16]*config.CoalescePolicy{6: {}}
+	c := NewRPCClient(clientConfig)
+
+	// the request outlives the timeout of the call which sent it, and a
+	// timeout of 0 waits for the response as it does without coalescing
+	errs := make(chan error, 3)
+	invoke := func(timeout time.Duration) {
+		_, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(6, []byte("same"), nil), timeout)
+		errs <- err
+	}
+	go invoke(20 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	go invoke(time.Second)
+	go invoke(0)
+	for _, w := range []error{internal.ErrRequestTimeout, nil, nil} {
+		if err := <-errs; err != w {
+			t.Fatalf("unexpected error: %v, want %v", err, w)
+		}
+	}
+
+	// the request is dropped once no call waits for it
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(6, []byte("other"), nil), 20*time.Millisecond); err != internal.ErrRequestTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.flightsLock.Lock()
+	defer c.flightsLock.Unlock()
+	if len(c.flights) != 0 {
+		t.Fatalf("%d requests in flight", len(c.flights))
+	}
+}
+
+func TestCoalesceLostResponse(t *testing.T) {
+	var calls int32
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		// the first request is answered far too late, as if lost
+		s.RegisterProcessor(6, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				time.Sleep(300 * time.Millisecond)
+			}
+			return protocol.NewPacket(6, p.Body, nil)
+		})
+	})
+	clientConfig := config.NewClientConfig()
+	clientConfig.CoalescePolicies = map[int16]*config.CoalescePolicy{6: {}}
+	c := NewRPCClient(clientConfig)
+
+	// a call without timeout keeps the request waiting
+	errs := make(chan error, 2)
+	invoke := func(timeout time.Duration) {
+		_, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(6, []byte("same"), nil), timeout)
+		errs <- err
+	}
+	go invoke(50 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	go invoke(0)
+	if err := <-errs; err != internal.ErrRequestTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a call does not join a request older than its timeout
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(6, []byte("same"), nil), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("%d requests sent, want 2", n)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,48 @@
+package net
+
+import (
+	"encoding/binary"
+	"github.com/panjf2000/gnet"
+	"thunder/protocol"
+)
+
+// frameCodec is the length field based codec of the server, it rejects a
+// frame larger than the decode limits before buffering it and closes the
+// connection which sent it.
+type frameCodec struct {
+	*gnet.LengthFieldBasedFrameCodec
+	server *RPCServer
+}
+
+func (fc *frameCodec) Decode(c gnet.Conn) ([]byte, error) {
+	limits := fc.server.serverConfig.DecodeLimits
+	if limits != nil && limits.MaxFrameSize > 0 {
+		if in := c.Read(); len(in) >= 4 && binary.BigEndian.Uint32(in) > uint32(limits.MaxFrameSize) {
+			c.ResetBuffer()
+			err := &protocol.DecodeError{Field: "frame", Err: protocol.ErrLimitExceeded}
+			fc.server.onDecodeError(c, err)
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	return fc.LengthFieldBasedFrameCodec.Decode(c)
+}
+
+// Encode prepends the length field to the frame, copying it, so a pooled
+// buffer written by the server can be released right after.
+func (fc *frameCodec) Encode(c gnet.Conn, buf []byte) ([]byte, error) {
+	out, err := fc.LengthFieldBasedFrameCodec.Encode(c, buf)
+	if fc.server.serverConfig.PacketPool {
+		if pooled := connContextOf(c).untrackWrite(buf); pooled != nil {
+			pooled.Release()
+		}
+	}
+	return out, err
+}
+
+func encodePacket(packet *protocol.Packet, checksum bool) ([]byte, error) {
+	if checksum {
+		return protocol.EncodeWithChecksum(packet)
+	}
+	return protocol.Encode(packet)
+}
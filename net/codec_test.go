@@ -0,0 +1,254 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+func writeTestFrame(conn net.Conn, frame []byte) error {
+	data := make([]byte, lengthFieldLength, lengthFieldLength+len(frame))
+	binary.BigEndian.PutUint32(data, uint32(len(frame)))
+	_, err := conn.Write(append(data, frame...))
+	return err
+}
+
+func readTestFrame(conn net.Conn) ([]byte, error) {
+	var lengthField [lengthFieldLength]byte
+	if _, err := io.ReadFull(conn, lengthField[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(lengthField[:]))
+	_, err := io.ReadFull(conn, frame)
+	return frame, err
+}
+
+// malform makes the header length of the frame run past its end.
+func malform(frame []byte) []byte {
+	binary.BigEndian.PutUint32(frame[1:5], 1000)
+	return frame
+}
+
+// corrupt flips a bit in front of the checksum trailer of the frame.
+func corrupt(frame []byte) []byte {
+	frame[len(frame)-5] ^= 1
+	return frame
+}
+
+// serveTestFrames accepts connections and answers the n-th request of every
+// connection with the frame returned by answer, the response to the request.
+func serveTestFrames(t *testing.T, answer func(n int, resp *protocol.Packet) []byte) net.Addr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for n := 0; ; n++ {
+					frame, err := readTestFrame(conn)
+					if err != nil {
+						return
+					}
+					req, err := protocol.Decode(frame)
+					if err != nil {
+						return
+					}
+					resp := protocol.NewPacket(req.Code, req.Body, nil)
+					resp.PacketId = req.PacketId
+					resp.MarkResponseType()
+					if writeTestFrame(conn, answer(n, resp)) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr()
+}
+
+// dialTestServer connects to the server with a decode error hook on it, and
+// the limits unless nil.
+func dialTestServer(t *testing.T, limits *protocol.DecodeLimits) (net.Conn, chan *protocol.DecodeError) {
+	t.Helper()
+	decodeErrs := make(chan *protocol.DecodeError, 1)
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		if limits != nil {
+			s.serverConfig.DecodeLimits = limits
+		}
+		s.serverConfig.DecodeErrorHook = func(addr net.Addr, err *protocol.DecodeError) {
+			decodeErrs <- err
+		}
+	})
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn, decodeErrs
+}
+
+// expectClosed checks the server closes the connection after reporting the
+// decode error.
+func expectClosed(t *testing.T, conn net.Conn, decodeErrs chan *protocol.DecodeError, want error) {
+	t.Helper()
+	select {
+	case err := <-decodeErrs:
+		if !errors.Is(err, want) {
+			t.Fatalf("unexpected decode error: %v, want %v", err, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("decode error hook is not called")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := readTestFrame(conn); err != io.EOF {
+		t.Fatalf("connection is not closed, err: %v", err)
+	}
+}
+
+func TestClientChecksumMismatch(t *testing.T) {
+	addr := serveTestFrames(t, func(n int, resp *protocol.Packet) []byte {
+		frame, _ := protocol.EncodeWithChecksum(resp)
+		return corrupt(frame)
+	})
+	decodeErrs := make(chan *protocol.DecodeError, 1)
+	clientConfig := config.NewClientConfig()
+	clientConfig.DecodeErrorHook = func(addr net.Addr, err *protocol.DecodeError) {
+		decodeErrs <- err
+	}
+	c := NewRPCClient(clientConfig)
+
+	// the pending request fails with the error closing the connection
+	_, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, []byte("thunder"), nil), time.Second)
+	if !errors.Is(err, protocol.ErrChecksumMismatch) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := <-decodeErrs; !errors.Is(err, protocol.ErrChecksumMismatch) {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+}
+
+func TestClientChecksumSticky(t *testing.T) {
+	// the first response of a connection is checksummed, the next ones not
+	addr := serveTestFrames(t, func(n int, resp *protocol.Packet) []byte {
+		if n == 0 {
+			frame, _ := protocol.EncodeWithChecksum(resp)
+			return frame
+		}
+		frame, _ := protocol.Encode(resp)
+		return frame
+	})
+	c := NewRPCClient(config.NewClientConfig())
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second)
+	if !errors.Is(err, protocol.ErrChecksumMissing) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestServerChecksumMismatch(t *testing.T) {
+	conn, decodeErrs := dialTestServer(t, nil)
+	frame, _ := protocol.EncodeWithChecksum(protocol.NewPacket(1, []byte("thunder"), nil))
+	if err := writeTestFrame(conn, corrupt(frame)); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn, decodeErrs, protocol.ErrChecksumMismatch)
+}
+
+func TestServerChecksumSticky(t *testing.T) {
+	conn, decodeErrs := dialTestServer(t, nil)
+	frame, _ := protocol.EncodeWithChecksum(protocol.NewPacket(1, []byte("thunder"), nil))
+	if err := writeTestFrame(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := readTestFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !protocol.HasChecksum(resp) {
+		t.Fatal("response to a checksummed request has no checksum")
+	}
+
+	// the flag cleared skips no verification
+	frame, _ = protocol.Encode(protocol.NewPacket(1, []byte("thunder"), nil))
+	if err := writeTestFrame(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn, decodeErrs, protocol.ErrChecksumMissing)
+}
+
+func testClientDecodeError(t *testing.T, answer func(n int, resp *protocol.Packet) []byte, want error) {
+	t.Helper()
+	addr := serveTestFrames(t, answer)
+	decodeErrs := make(chan *protocol.DecodeError, 1)
+	clientConfig := config.NewClientConfig()
+	clientConfig.DecodeLimits = &protocol.DecodeLimits{MaxFrameSize: 256}
+	clientConfig.DecodeErrorHook = func(addr net.Addr, err *protocol.DecodeError) {
+		decodeErrs <- err
+	}
+	c := NewRPCClient(clientConfig)
+
+	_, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second)
+	if !errors.Is(err, want) {
+		t.Fatalf("unexpected error: %v, want %v", err, want)
+	}
+	if err := <-decodeErrs; !errors.Is(err, want) {
+		t.Fatalf("unexpected decode error: %v, want %v", err, want)
+	}
+	// the connection is closed
+	if stats := c.ConnectionStats(addr); len(stats) != 0 {
+		t.Fatalf("connections left open: %+v", stats)
+	}
+}
+
+func TestClientFrameLimit(t *testing.T) {
+	testClientDecodeError(t, func(n int, resp *protocol.Packet) []byte {
+		resp.Body = make([]byte, 1024)
+		frame, _ := protocol.Encode(resp)
+		return frame
+	}, protocol.ErrLimitExceeded)
+}
+
+func TestClientMalformedFrame(t *testing.T) {
+	testClientDecodeError(t, func(n int, resp *protocol.Packet) []byte {
+		frame, _ := protocol.Encode(resp)
+		return malform(frame)
+	}, protocol.ErrTruncated)
+}
+
+func TestServerFrameLimit(t *testing.T) {
+	conn, decodeErrs := dialTestServer(t, &protocol.DecodeLimits{MaxFrameSize: 256})
+	frame, _ := protocol.Encode(protocol.NewPacket(1, make([]byte, 1024), nil))
+	if err := writeTestFrame(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn, decodeErrs, protocol.ErrLimitExceeded)
+}
+
+func TestServerMalformedFrame(t *testing.T) {
+	conn, decodeErrs := dialTestServer(t, nil)
+	frame, _ := protocol.Encode(protocol.NewPacket(1, []byte("thunder"), nil))
+	if err := writeTestFrame(conn, malform(frame)); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn, decodeErrs, protocol.ErrTruncated)
+}
@@ -0,0 +1,125 @@
+package net
+
+import (
+	"github.com/panjf2000/gnet"
+	"net"
+	"sync"
+	"sync/atomic"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+// connContext is the per connection state of the server, it is stored in
+// gnet.Conn.Context when the connection is opened. It is also the connection
+// passed to the event listener, as gnet.Conn is recycled once closed.
+type connContext struct {
+	conn       gnet.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	attrs      attributes
+	// clientId is the id the client registered, guarded by the lock of the
+	// client registry.
+	clientId string
+	// topics holds the subscriptions of the connection, guarded by the lock
+	// of the topic registry.
+	topics map[string]struct{}
+
+	heartbeatState
+	checksum int32
+
+	// lastRead and lastWrite are the times of the last packets read and
+	// written, control packets aside, closing is set once the connection is
+	// being closed for being idle.
+	lastRead  int64
+	lastWrite int64
+	closing   int32
+
+	writesLocker sync.Mutex
+	// pendingWrites holds the pooled buffers passed to AsyncWrite which have
+	// not been copied by the codec yet, keyed by their first byte.
+	pendingWrites map[*byte]*protocol.Buffer
+}
+
+func newConnContext(c gnet.Conn) *connContext {
+	now := time.Now()
+	ctx := &connContext{
+		conn:       c,
+		localAddr:  c.LocalAddr(),
+		remoteAddr: c.RemoteAddr(),
+		lastRead:   now.UnixNano(),
+		lastWrite:  now.UnixNano(),
+	}
+	ctx.touch(now)
+	return ctx
+}
+
+// idleFor returns how long the connection has neither read nor written a
+// packet.
+func (ctx *connContext) idleFor(now time.Time) time.Duration {
+	last := atomic.LoadInt64(&ctx.lastRead)
+	if lastWrite := atomic.LoadInt64(&ctx.lastWrite); lastWrite > last {
+		last = lastWrite
+	}
+	return time.Duration(now.UnixNano() - last)
+}
+
+func connContextOf(c gnet.Conn) *connContext {
+	if ctx, ok := c.Context().(*connContext); ok {
+		return ctx
+	}
+	return newConnContext(c)
+}
+
+func (ctx *connContext) LocalAddr() net.Addr {
+	return ctx.localAddr
+}
+
+func (ctx *connContext) RemoteAddr() net.Addr {
+	return ctx.remoteAddr
+}
+
+func (ctx *connContext) Attributes() config.Attributes {
+	return &ctx.attrs
+}
+
+func (c *connContext) checksumEnabled() bool {
+	return atomic.LoadInt32(&c.checksum) == 1
+}
+
+func (c *connContext) enableChecksum() {
+	atomic.StoreInt32(&c.checksum, 1)
+}
+
+func (c *connContext) trackWrite(buf *protocol.Buffer) {
+	c.writesLocker.Lock()
+	if c.pendingWrites == nil {
+		c.pendingWrites = make(map[*byte]*protocol.Buffer)
+	}
+	c.pendingWrites[&buf.B[0]] = buf
+	c.writesLocker.Unlock()
+}
+
+func (c *connContext) untrackWrite(data []byte) *protocol.Buffer {
+	if len(data) == 0 {
+		return nil
+	}
+	c.writesLocker.Lock()
+	defer c.writesLocker.Unlock()
+	buf, ok := c.pendingWrites[&data[0]]
+	if ok {
+		delete(c.pendingWrites, &data[0])
+	}
+	return buf
+}
+
+// releaseWrites releases the pooled buffers which will never be written since
+// the connection is closed.
+func (c *connContext) releaseWrites() {
+	c.writesLocker.Lock()
+	defer c.writesLocker.Unlock()
+	for key, buf := range c.pendingWrites {
+		delete(c.pendingWrites, key)
+		buf.Release()
+	}
+}
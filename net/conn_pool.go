@@ -0,0 +1,255 @@
+package net
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"thunder/config"
+	"thunder/internal/timingwheel"
+)
+
+type routingKey struct{}
+
+// WithRoutingKey returns a context which makes the client send the requests
+// with the same routing key on the same connection, as long as the number of
+// connections to the address does not change, when the connections are
+// selected by config.RoutingKeyHash.
+func WithRoutingKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, routingKey{}, key)
+}
+
+func routingKeyOf(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(routingKey{}).(string)
+	return key, ok
+}
+
+// ConnectionStats is a snapshot of the traffic of a client connection.
+type ConnectionStats struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// Pending is the number of requests waiting for a response.
+	Pending int64
+	// Sent and Received count the packets written and read, heartbeats
+	// excluded.
+	Sent     uint64
+	Received uint64
+}
+
+// connPool holds the connections of a client to an address. It keeps at least
+// ConnectionsPerAddr connections, grows up to MaxConnectionsPerAddr while all
+// of them are loaded and closes the extra connections once the load drops.
+type connPool struct {
+	addr         net.Addr
+	clientConfig *config.ClientConfig
+
+	// dialLocker serializes the dials of the pool, connsLocker guards conns,
+	// which is replaced rather than modified so it can be read by select
+	// without locking.
+	dialLocker  sync.Mutex
+	connsLocker sync.Mutex
+	conns       atomic.Value
+	next        uint32
+	growing     int32
+	// drained is set once the address is no longer an endpoint of the
+	// services, the pool does not dial anymore. removed is set once the pool
+	// has no connections left and is removed from the client.
+	drained int32
+	removed int32
+
+	// draining holds the connections removed from the pool which still
+	// have pending requests.
+	draining    []*connWrapper
+	shrinkTimer timingwheel.Timer
+
+	// topicsLocker guards topics, the topics subscribed to at the address,
+	// and subscriber, the connection carrying the subscriptions.
+	topicsLocker     sync.Mutex
+	topics           map[string]struct{}
+	subscriber       *connWrapper
+	resubscribeTimer timingwheel.Timer
+}
+
+func newConnPool(addr net.Addr, clientConfig *config.ClientConfig) *connPool {
+	p := &connPool{
+		addr:         addr,
+		clientConfig: clientConfig,
+		topics:       make(map[string]struct{}),
+	}
+	p.conns.Store([]*connWrapper(nil))
+	return p
+}
+
+func (p *connPool) list() []*connWrapper {
+	return p.conns.Load().([]*connWrapper)
+}
+
+func (p *connPool) minConns() int {
+	if p.clientConfig.ConnectionsPerAddr < 1 {
+		return 1
+	}
+	return p.clientConfig.ConnectionsPerAddr
+}
+
+func (p *connPool) maxConns() int {
+	if max := p.clientConfig.MaxConnectionsPerAddr; max > p.minConns() {
+		return max
+	}
+	return p.minConns()
+}
+
+// selectConn picks the connection of a request, it returns nil when the pool
+// needs a new connection first.
+func (p *connPool) selectConn(ctx context.Context) *connWrapper {
+	conns := p.list()
+	if len(conns) < p.minConns() {
+		return nil
+	}
+
+	var cw *connWrapper
+	switch p.clientConfig.ConnectionSelector {
+	case config.LeastPending:
+		for _, c := range conns {
+			if cw == nil || c.pendingCount() < cw.pendingCount() {
+				cw = c
+			}
+		}
+	case config.RoutingKeyHash:
+		if key, ok := routingKeyOf(ctx); ok {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(key))
+			cw = conns[h.Sum32()%uint32(len(conns))]
+			break
+		}
+		fallthrough
+	default:
+		cw = conns[atomic.AddUint32(&p.next, 1)%uint32(len(conns))]
+	}
+	return cw
+}
+
+// overloaded reports whether the pool can grow and all its connections have
+// ConnectionGrowPending pending requests or more.
+func (p *connPool) overloaded() bool {
+	threshold := int64(p.clientConfig.ConnectionGrowPending)
+	conns := p.list()
+	if threshold <= 0 || len(conns) >= p.maxConns() {
+		return false
+	}
+	for _, cw := range conns {
+		if cw.pendingCount() < threshold {
+			return false
+		}
+	}
+	return true
+}
+
+// add adds the connection to the pool, it returns false if the pool is
+// drained or removed.
+func (p *connPool) add(cw *connWrapper) bool {
+	p.connsLocker.Lock()
+	defer p.connsLocker.Unlock()
+	if p.isDrained() || p.isRemoved() {
+		return false
+	}
+	conns := p.list()
+	updated := make([]*connWrapper, len(conns), len(conns)+1)
+	copy(updated, conns)
+	p.conns.Store(append(updated, cw))
+	return true
+}
+
+// removeConn removes the connection from the pool, it returns false if the
+// connection is not in the pool.
+func (p *connPool) removeConn(cw *connWrapper) bool {
+	p.connsLocker.Lock()
+	defer p.connsLocker.Unlock()
+	conns := p.list()
+	for i, c := range conns {
+		if c == cw {
+			updated := make([]*connWrapper, 0, len(conns)-1)
+			updated = append(updated, conns[:i]...)
+			p.conns.Store(append(updated, conns[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+// shrink removes the newest connection above the minimum when the pending
+// requests of the pool would fit in one connection less at half the growth
+// threshold. It returns the removed connections which can be closed and
+// reports whether the pool still has extra connections to check.
+func (p *connPool) shrink() (closable []*connWrapper, extra bool) {
+	p.connsLocker.Lock()
+	defer p.connsLocker.Unlock()
+
+	draining := p.draining[:0]
+	for _, cw := range p.draining {
+		if cw.pendingCount() == 0 {
+			closable = append(closable, cw)
+		} else {
+			draining = append(draining, cw)
+		}
+	}
+
+	conns := p.list()
+	if n := len(conns); n > p.minConns() {
+		var pending int64
+		for _, cw := range conns {
+			pending += cw.pendingCount()
+		}
+		if 2*pending < int64(p.clientConfig.ConnectionGrowPending)*int64(n-1) {
+			cw := conns[n-1]
+			conns = conns[: n-1 : n-1]
+			p.conns.Store(conns)
+			if cw.pendingCount() == 0 {
+				closable = append(closable, cw)
+			} else {
+				draining = append(draining, cw)
+			}
+		}
+	}
+	p.draining = draining
+	return closable, len(conns) > p.minConns() || len(draining) > 0
+}
+
+// drain empties the pool, its connections are closed by shrink once their
+// pending requests complete.
+func (p *connPool) drain() {
+	atomic.StoreInt32(&p.drained, 1)
+	p.connsLocker.Lock()
+	defer p.connsLocker.Unlock()
+	p.draining = append(p.draining, p.list()...)
+	p.conns.Store([]*connWrapper(nil))
+}
+
+func (p *connPool) isDrained() bool {
+	return atomic.LoadInt32(&p.drained) == 1
+}
+
+// remove marks the pool removed if it has no connections left, a drained pool
+// is not in the client anymore and is left alone. It returns false if the
+// pool is still in use.
+func (p *connPool) remove() bool {
+	p.connsLocker.Lock()
+	defer p.connsLocker.Unlock()
+	if p.isDrained() || len(p.list()) > 0 || len(p.draining) > 0 {
+		return false
+	}
+	return atomic.CompareAndSwapInt32(&p.removed, 0, 1)
+}
+
+func (p *connPool) isRemoved() bool {
+	return atomic.LoadInt32(&p.removed) == 1
+}
+
+func (p *connPool) stats() []ConnectionStats {
+	conns := p.list()
+	stats := make([]ConnectionStats, 0, len(conns))
+	for _, cw := range conns {
+		stats = append(stats, cw.stats())
+	}
+	return stats
+}
@@ -0,0 +1,139 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+func invokeN(t *testing.T, ctx context.Context, c *RPCClient, addr net.Addr, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := c.InvokeSync(ctx, addr, protocol.NewPacket(1, nil, nil), 3*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnectionSelector(t *testing.T) {
+	_, addr := startTestServer(t, nil)
+
+	clientConfig := config.NewClientConfig()
+	clientConfig.ConnectionsPerAddr = 3
+	clientConfig.MaxConnectionsPerAddr = 3
+	c := NewRPCClient(clientConfig)
+	invokeN(t, context.Background(), c, addr, 30)
+	stats := c.ConnectionStats(addr)
+	if len(stats) != 3 {
+		t.Fatalf("%d connections, expected 3", len(stats))
+	}
+	for _, s := range stats {
+		if s.Sent != 10 || s.Received != 10 || s.Pending != 0 {
+			t.Fatalf("traffic is not balanced: %+v", stats)
+		}
+	}
+
+	clientConfig = config.NewClientConfig()
+	clientConfig.ConnectionsPerAddr = 3
+	clientConfig.ConnectionSelector = config.RoutingKeyHash
+	c = NewRPCClient(clientConfig)
+	invokeN(t, context.Background(), c, addr, 3)
+	invokeN(t, WithRoutingKey(context.Background(), "thunder"), c, addr, 30)
+	var routed int
+	for _, s := range c.ConnectionStats(addr) {
+		if s.Sent > 1 {
+			routed++
+			if s.Sent != 31 {
+				t.Fatalf("routing key is spread: %+v", c.ConnectionStats(addr))
+			}
+		}
+	}
+	if routed != 1 {
+		t.Fatalf("routing key is spread: %+v", c.ConnectionStats(addr))
+	}
+}
+
+func TestConnectionPoolGrowAndShrink(t *testing.T) {
+	var slow sync.WaitGroup
+	slow.Add(20)
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(2, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			defer slow.Done()
+			time.Sleep(100 * time.Millisecond)
+			return protocol.NewPacket(2, nil, nil)
+		})
+	})
+	t.Cleanup(slow.Wait)
+
+	clientConfig := config.NewClientConfig()
+	clientConfig.MaxConnectionsPerAddr = 3
+	clientConfig.ConnectionGrowPending = 2
+	clientConfig.ConnectionShrinkInterval = 50 * time.Millisecond
+	clientConfig.ConnectionSelector = config.LeastPending
+	c := NewRPCClient(clientConfig)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		err := c.InvokeAsync(context.Background(), addr, protocol.NewPacket(2, nil, nil), func(future *ResponseFuture) {
+			defer wg.Done()
+			if future.Err != nil {
+				t.Error(future.Err)
+			}
+		}, 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(c.ConnectionStats(addr)); n != 3 {
+		t.Fatalf("%d connections under load, expected 3", n)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.ConnectionStats(addr)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections once idle, expected 1", len(c.ConnectionStats(addr)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionPoolRemoved(t *testing.T) {
+	// the first response is malformed, which closes the only connection
+	var answered int32
+	addr := serveTestFrames(t, func(n int, resp *protocol.Packet) []byte {
+		frame, _ := protocol.Encode(resp)
+		if atomic.AddInt32(&answered, 1) == 1 {
+			return malform(frame)
+		}
+		return frame
+	})
+	c := NewRPCClient(config.NewClientConfig())
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err == nil {
+		t.Fatal("malformed response is accepted")
+	}
+	pools := func() int {
+		n := 0
+		c.connectionTable.Range(func(_, _ interface{}) bool {
+			n++
+			return true
+		})
+		return n
+	}
+	if n := pools(); n != 0 {
+		t.Fatalf("%d pools left once their connections closed", n)
+	}
+
+	// the address gets a new pool, which is kept while it has connections
+	invokeN(t, context.Background(), c, addr, 2)
+	if n := pools(); n != 1 || len(c.ConnectionStats(addr)) != 1 {
+		t.Fatalf("%d pools, connections: %+v", n, c.ConnectionStats(addr))
+	}
+}
@@ -0,0 +1,68 @@
+package net
+
+import (
+	"context"
+	"net"
+	"thunder/config"
+)
+
+// dialConn opens a TCP connection to the address with the dial options of the
+// config, the dial ends with the context or after the dial timeout.
+func dialConn(ctx context.Context, addr net.Addr, clientConfig *config.ClientConfig) (net.Conn, error) {
+	if clientConfig.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, clientConfig.DialTimeout)
+		defer cancel()
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if clientConfig.Dialer != nil {
+		conn, err = clientConfig.Dialer(ctx, "tcp", addr.String())
+	} else {
+		// keep-alives are set up with the other socket options
+		dialer := net.Dialer{KeepAlive: -1}
+		if clientConfig.LocalAddr != nil {
+			dialer.LocalAddr = clientConfig.LocalAddr
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", addr.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err = setSocketOptions(tcpConn, clientConfig); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func setSocketOptions(conn *net.TCPConn, clientConfig *config.ClientConfig) error {
+	if err := conn.SetNoDelay(clientConfig.TcpNoDelay); err != nil {
+		return err
+	}
+	if err := conn.SetKeepAlive(clientConfig.TcpKeepAlive > 0); err != nil {
+		return err
+	}
+	if clientConfig.TcpKeepAlive > 0 {
+		if err := conn.SetKeepAlivePeriod(clientConfig.TcpKeepAlive); err != nil {
+			return err
+		}
+	}
+	if clientConfig.ReadBufferSize > 0 {
+		if err := conn.SetReadBuffer(clientConfig.ReadBufferSize); err != nil {
+			return err
+		}
+	}
+	if clientConfig.WriteBufferSize > 0 {
+		if err := conn.SetWriteBuffer(clientConfig.WriteBufferSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package net
+
+import (
+	"context"
+	"net"
+	"testing"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+func TestDialTimeout(t *testing.T) {
+	_, addr := startTestServer(t, nil)
+	blackholed := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	clientConfig := config.NewClientConfig()
+	clientConfig.DialTimeout = 200 * time.Millisecond
+	clientConfig.Dialer = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == blackholed.String() {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	c := NewRPCClient(clientConfig)
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := c.InvokeSync(context.Background(), blackholed, protocol.NewPacket(1, nil, nil), time.Second)
+		done <- err
+	}()
+
+	// a slow dial does not hold up the calls to the other addresses
+	time.Sleep(20 * time.Millisecond)
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Fatal("dial to the blackholed address ended early")
+	default:
+	}
+
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial timed out after %v", elapsed)
+	}
+}
+
+func TestDialOptions(t *testing.T) {
+	_, addr := startTestServer(t, nil)
+
+	clientConfig := config.NewClientConfig()
+	clientConfig.LocalAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	clientConfig.ReadBufferSize = 64 << 10
+	clientConfig.WriteBufferSize = 64 << 10
+	clientConfig.TcpKeepAlive = 0
+	clientConfig.TcpNoDelay = false
+	c := NewRPCClient(clientConfig)
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	stats := c.ConnectionStats(addr)
+	if len(stats) != 1 || !stats[0].LocalAddr.(*net.TCPAddr).IP.Equal(clientConfig.LocalAddr.IP) {
+		t.Fatalf("connection is not bound to the local address: %+v", stats)
+	}
+}
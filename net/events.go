@@ -0,0 +1,124 @@
+package net
+
+import (
+	"sync"
+	"thunder/config"
+	"thunder/internal/logging"
+)
+
+// eventDispatcher delivers the connection events to the listener in order on a
+// goroutine of its own, which only runs while there are events to deliver. A
+// nil dispatcher drops the events, it is used when there is no listener.
+type eventDispatcher struct {
+	listener config.ConnectionEventListener
+	logger   logging.Logger
+
+	lock    sync.Mutex
+	events  []func()
+	running bool
+}
+
+func newEventDispatcher(listener config.ConnectionEventListener, logger logging.Logger) *eventDispatcher {
+	if listener == nil {
+		return nil
+	}
+	return &eventDispatcher{
+		listener: listener,
+		logger:   logger,
+	}
+}
+
+// eventListeners passes the events to every listener in turn.
+type eventListeners []config.ConnectionEventListener
+
+func (l eventListeners) OnConnect(conn config.Connection) {
+	for _, listener := range l {
+		listener.OnConnect(conn)
+	}
+}
+
+func (l eventListeners) OnClose(conn config.Connection) {
+	for _, listener := range l {
+		listener.OnClose(conn)
+	}
+}
+
+func (l eventListeners) OnIdle(conn config.Connection) {
+	for _, listener := range l {
+		listener.OnIdle(conn)
+	}
+}
+
+func (l eventListeners) OnException(conn config.Connection, err error) {
+	for _, listener := range l {
+		listener.OnException(conn, err)
+	}
+}
+
+func (d *eventDispatcher) onConnect(conn config.Connection) {
+	if d != nil {
+		d.dispatch(func() { d.listener.OnConnect(conn) })
+	}
+}
+
+// onClose also clears the attributes of the connection, once the listener has
+// seen them.
+func (d *eventDispatcher) onClose(conn config.Connection, attrs *attributes) {
+	if d == nil {
+		attrs.clear()
+		return
+	}
+	d.dispatch(func() {
+		defer attrs.clear()
+		d.listener.OnClose(conn)
+	})
+}
+
+func (d *eventDispatcher) onIdle(conn config.Connection) {
+	if d != nil {
+		d.dispatch(func() { d.listener.OnIdle(conn) })
+	}
+}
+
+func (d *eventDispatcher) onException(conn config.Connection, err error) {
+	if d != nil {
+		d.dispatch(func() { d.listener.OnException(conn, err) })
+	}
+}
+
+func (d *eventDispatcher) dispatch(event func()) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.events = append(d.events, event)
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+}
+
+func (d *eventDispatcher) run() {
+	for {
+		d.lock.Lock()
+		events := d.events
+		d.events = nil
+		if len(events) == 0 {
+			d.running = false
+			d.lock.Unlock()
+			return
+		}
+		d.lock.Unlock()
+
+		for _, event := range events {
+			d.deliver(event)
+		}
+	}
+}
+
+func (d *eventDispatcher) deliver(event func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			d.logger.Errorf("connection event listener error: %v", err)
+		}
+	}()
+	event()
+}
@@ -0,0 +1,104 @@
+package net
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+type recordingListener struct {
+	events chan string
+	delay  time.Duration
+}
+
+func newRecordingListener(delay time.Duration) *recordingListener {
+	return &recordingListener{events: make(chan string, 16), delay: delay}
+}
+
+func (l *recordingListener) OnConnect(conn config.Connection) {
+	time.Sleep(l.delay)
+	l.events <- "connect"
+}
+
+func (l *recordingListener) OnClose(conn config.Connection) {
+	l.events <- "close"
+}
+
+func (l *recordingListener) OnIdle(conn config.Connection) {
+	l.events <- "idle"
+}
+
+func (l *recordingListener) OnException(conn config.Connection, err error) {
+	l.events <- "exception: " + err.Error()
+}
+
+func (l *recordingListener) expect(t *testing.T, events ...string) {
+	t.Helper()
+	for _, expected := range events {
+		select {
+		case event := <-l.events:
+			if event != expected {
+				t.Fatalf("unexpected event: %s, expected: %s", event, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("event %s is not delivered", expected)
+		}
+	}
+}
+
+func TestConnectionEvents(t *testing.T) {
+	serverListener := newRecordingListener(0)
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.IdleTimeout = 100 * time.Millisecond
+		s.events = newEventDispatcher(serverListener, s.logger)
+	})
+	// the probe connection of startTestServer
+	serverListener.expect(t, "connect", "close")
+
+	// a slow listener does not hold up the connection
+	clientListener := newRecordingListener(200 * time.Millisecond)
+	clientConfig := config.NewClientConfig()
+	clientConfig.EventListener = clientListener
+	c := NewRPCClient(clientConfig)
+	start := time.Now()
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Fatalf("invoke is held up by the listener for %v", elapsed)
+	}
+
+	serverListener.expect(t, "connect", "idle", "close")
+	clientListener.expect(t, "connect", "idle", "close")
+}
+
+func TestConnectionExceptionEvents(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			_, _ = io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	listener := newRecordingListener(0)
+	clientConfig := config.NewClientConfig()
+	clientConfig.HeartbeatInterval = 20 * time.Millisecond
+	clientConfig.HeartbeatMaxMissed = 1
+	clientConfig.EventListener = listener
+	c := NewRPCClient(clientConfig)
+	if err = c.InvokeOneway(context.Background(), l.Addr(), protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	listener.expect(t, "connect", "exception: "+internal.ErrHeartbeatTimeout.Error(), "close")
+}
@@ -0,0 +1,56 @@
+package net
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/smallnest/goframe"
+	"io"
+	"thunder/protocol"
+)
+
+// limitedFrameConn reads the length field based frames itself so that the
+// frame length is validated before anything is allocated for the frame and
+// frames can be read into pooled buffers, writing is left to the wrapped
+// goframe.FrameConn. A maxFrameSize <= 0 means unlimited.
+type limitedFrameConn struct {
+	goframe.FrameConn
+	reader       *bufio.Reader
+	maxFrameSize int32
+}
+
+func newLimitedFrameConn(fc goframe.FrameConn, maxFrameSize int32) *limitedFrameConn {
+	return &limitedFrameConn{
+		FrameConn:    fc,
+		reader:       bufio.NewReader(fc.Conn()),
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+func (fc *limitedFrameConn) ReadFrame() ([]byte, error) {
+	return fc.appendFrame(nil)
+}
+
+// appendFrame reads the next frame into dst, reusing its capacity, and
+// returns the extended buffer.
+func (fc *limitedFrameConn) appendFrame(dst []byte) ([]byte, error) {
+	var lengthField [4]byte
+	if _, err := io.ReadFull(fc.reader, lengthField[:]); err != nil {
+		return dst, err
+	}
+	length := binary.BigEndian.Uint32(lengthField[:])
+	if fc.maxFrameSize > 0 && length > uint32(fc.maxFrameSize) {
+		return dst, &protocol.DecodeError{Field: "frame", Err: protocol.ErrLimitExceeded}
+	}
+	start := len(dst)
+	if n := start + int(length); n <= cap(dst) {
+		dst = dst[:n]
+	} else {
+		grown := make([]byte, n)
+		copy(grown, dst)
+		dst = grown
+	}
+	if _, err := io.ReadFull(fc.reader, dst[start:]); err != nil {
+		return dst[:start], err
+	}
+	return dst, nil
+}
@@ -3,7 +3,7 @@ package net
 import (
 	"context"
 	"sync"
-	"thunder/internal"
+	"thunder/internal/timingwheel"
 	"thunder/protocol"
 )
 
@@ -14,7 +14,17 @@ type ResponseFuture struct {
 	callback     func(*ResponseFuture)
 	Done         chan bool
 	callbackOnce sync.Once
+	doneOnce     sync.Once
 	ctx          context.Context
+	// conn is the connection the request was written to, it is used to
+	// fail the pending futures when the connection breaks.
+	conn interface{}
+	// timer drives the timeout of the future in the timing wheel of the
+	// response table.
+	timer timingwheel.Timer
+	// observe, when set, is passed the result of the future once it
+	// completes.
+	observe func(pkt *protocol.Packet, err error)
 }
 
 func NewResponseFuture(ctx context.Context, opaque int32, callback func(*ResponseFuture)) *ResponseFuture {
@@ -34,18 +44,26 @@ func (r *ResponseFuture) executeInvokeCallback() {
 	})
 }
 
+// complete sets the result of the future and wakes up the waiters, only the
+// first call takes effect.
+func (r *ResponseFuture) complete(pkt *protocol.Packet, err error) bool {
+	completed := false
+	r.doneOnce.Do(func() {
+		r.Response, r.Err = pkt, err
+		if r.observe != nil {
+			r.observe(pkt, err)
+		}
+		close(r.Done)
+		completed = true
+	})
+	return completed
+}
+
 func (r *ResponseFuture) waitResponse() (*protocol.Packet, error) {
-	var (
-		pkt *protocol.Packet
-		err error
-	)
 	select {
 	case <-r.Done:
-		pkt, err = r.Response, r.Err
 	case <-r.ctx.Done():
-		err = internal.ErrRequestTimeout
-		r.Err = err
+		r.complete(nil, contextError(r.ctx))
 	}
-	return pkt, err
+	return r.Response, r.Err
 }
-
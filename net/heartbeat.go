@@ -0,0 +1,33 @@
+package net
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// heartbeatState tracks the liveness of a connection, every frame read counts
+// as a sign of life, not only the heartbeat responses.
+type heartbeatState struct {
+	lastSeen int64
+	missed   int32
+}
+
+func (h *heartbeatState) touch(now time.Time) {
+	atomic.StoreInt64(&h.lastSeen, now.UnixNano())
+	if atomic.LoadInt32(&h.missed) != 0 {
+		atomic.StoreInt32(&h.missed, 0)
+	}
+}
+
+// check is called every heartbeat interval, it reports whether a heartbeat has
+// to be sent because the connection is idle, and whether the connection is
+// dead because maxMissed heartbeats in a row went unanswered.
+func (h *heartbeatState) check(now time.Time, interval time.Duration, maxMissed int) (send, dead bool) {
+	if now.UnixNano()-atomic.LoadInt64(&h.lastSeen) < int64(interval) {
+		return false, false
+	}
+	if missed := atomic.AddInt32(&h.missed, 1); int(missed) > maxMissed {
+		return false, true
+	}
+	return true, false
+}
@@ -0,0 +1,125 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+func TestHeartbeatKeepsConnection(t *testing.T) {
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.HeartbeatInterval = 20 * time.Millisecond
+		s.RegisterProcessor(0, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			t.Errorf("heartbeat reached the processor: %+v", p)
+			return nil
+		})
+	})
+
+	clientConfig := config.NewClientConfig()
+	clientConfig.HeartbeatInterval = 20 * time.Millisecond
+	clientConfig.HeartbeatMaxMissed = 2
+	c := NewRPCClient(clientConfig)
+	c.RegisterProcessor(0, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+		t.Errorf("heartbeat reached the processor: %+v", p)
+		return nil
+	})
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	local := c.ConnectionStats(addr)[0].LocalAddr
+
+	time.Sleep(200 * time.Millisecond)
+	stats := c.ConnectionStats(addr)
+	if len(stats) != 1 || stats[0].LocalAddr.String() != local.String() {
+		t.Fatalf("connection is not kept alive: %+v", stats)
+	}
+	if stats[0].Sent != 1 || stats[0].Received != 1 {
+		t.Fatalf("heartbeats are counted in the stats: %+v", stats)
+	}
+}
+
+// readFrame reads a frame written by thunder from the raw connection.
+func readFrame(t *testing.T, conn net.Conn) *protocol.Packet {
+	t.Helper()
+	var lengthField [4]byte
+	if _, err := io.ReadFull(conn, lengthField[:]); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(lengthField[:]))
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	p, err := protocol.Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestClientClosesDeadConnection(t *testing.T) {
+	// a peer which reads everything and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			_, _ = io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	clientConfig := config.NewClientConfig()
+	clientConfig.HeartbeatInterval = 20 * time.Millisecond
+	clientConfig.HeartbeatMaxMissed = 2
+	c := NewRPCClient(clientConfig)
+	done := make(chan error, 1)
+	err = c.InvokeAsync(context.Background(), l.Addr(), protocol.NewPacket(1, nil, nil), func(future *ResponseFuture) {
+		done <- future.Err
+	}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-done:
+		if err != internal.ErrConnectionClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dead connection is not closed")
+	}
+	if n := len(c.ConnectionStats(l.Addr())); n != 0 {
+		t.Fatalf("dead connection is still in the pool")
+	}
+}
+
+func TestServerClosesDeadConnection(t *testing.T) {
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.HeartbeatInterval = 20 * time.Millisecond
+		s.serverConfig.HeartbeatMaxMissed = 2
+	})
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	for i := 0; i < 2; i++ {
+		if p := readFrame(t, conn); !p.IsHeartbeat() || p.IsResponseType() {
+			t.Fatalf("unexpected packet: %+v", p)
+		}
+	}
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("dead connection is not closed: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package net
+
+import (
+	"context"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+// HedgeStats counts the hedged calls of a client.
+type HedgeStats struct {
+	// Calls is the number of calls of the codes with a hedge policy,
+	// Hedges the number of hedges sent for them and Wins the number of
+	// calls answered first by a hedge.
+	Calls  uint64
+	Hedges uint64
+	Wins   uint64
+}
+
+type hedgeStats struct {
+	calls  uint64
+	hedges uint64
+	wins   uint64
+}
+
+// HedgeStats returns the counts of the hedged calls.
+func (R *RPCClient) HedgeStats() HedgeStats {
+	return HedgeStats{
+		Calls:  atomic.LoadUint64(&R.hedgeStats.calls),
+		Hedges: atomic.LoadUint64(&R.hedgeStats.hedges),
+		Wins:   atomic.LoadUint64(&R.hedgeStats.wins),
+	}
+}
+
+// hedgeSamples is the number of the last response times of a code the hedge
+// delay is computed from, it is computed again every hedgeUpdate responses.
+const (
+	hedgeSamples = 256
+	hedgeUpdate  = 32
+)
+
+// hedger holds the hedge delay and the hedge budget of a code.
+type hedger struct {
+	policy *config.HedgePolicy
+	budget *budget
+
+	lock    sync.Mutex
+	samples [hedgeSamples]time.Duration
+	count   int
+	delay   time.Duration
+}
+
+func (R *RPCClient) hedger(code int16) *hedger {
+	if h, ok := R.hedgers.Load(code); ok {
+		return h.(*hedger)
+	}
+	policy := R.clientConfig.HedgePolicies[code]
+	if policy == nil || policy.MaxHedges <= 0 {
+		return nil
+	}
+	h, _ := R.hedgers.LoadOrStore(code, &hedger{
+		policy: policy,
+		budget: newBudget(policy.MaxRatio, 0),
+	})
+	return h.(*hedger)
+}
+
+// observe adds the response time of a call to the samples.
+func (h *hedger) observe(rtt time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.samples[h.count%hedgeSamples] = rtt
+	h.count++
+	if h.count%hedgeUpdate != 0 {
+		return
+	}
+	n := h.count
+	if n > hedgeSamples {
+		n = hedgeSamples
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, h.samples[:n])
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	i := int(math.Ceil(h.policy.Percentile*float64(n))) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= n {
+		i = n - 1
+	}
+	h.delay = sorted[i]
+}
+
+func (h *hedger) hedgeDelay() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.delay < h.policy.MinDelay {
+		return h.policy.MinDelay
+	}
+	return h.delay
+}
+
+// hedgeCall is a request of a hedged call.
+type hedgeCall struct {
+	future *ResponseFuture
+	done   func(err error)
+	ended  bool
+}
+
+func (c *hedgeCall) end(err error) {
+	c.ended = true
+	if c.done != nil {
+		c.done(err)
+	}
+}
+
+// invokeHedged sends the request to the address and hedges it to the other
+// addresses returned by pick until one of the requests is answered, or they
+// all fail. The requests which lost are ignored, not canceled: the servers
+// still process them, which the budget of the hedger bounds, and their
+// responses are dropped when they come.
+// The addresses the requests are sent to are added to tried.
+func (R *RPCClient) invokeHedged(ctx context.Context, h *hedger, pick PickFunc, packet *protocol.Packet, timeout time.Duration, addr net.Addr, done func(error), tried *[]net.Addr) (*protocol.Packet, bool, error) {
+	atomic.AddUint64(&R.hedgeStats.calls, 1)
+	h.budget.call()
+	start := time.Now()
+	results := make(chan *hedgeCall, h.policy.MaxHedges+1)
+	var calls []*hedgeCall
+	send := func(p *protocol.Packet, addr net.Addr, done func(error)) error {
+		*tried = append(*tried, addr)
+		f, err := R.send(ctx, addr, p, nil, timeout)
+		if err != nil {
+			if done != nil {
+				done(err)
+			}
+			return err
+		}
+		call := &hedgeCall{future: f, done: done}
+		calls = append(calls, call)
+		go func() {
+			<-f.Done
+			results <- call
+		}()
+		return nil
+	}
+	if err := send(packet, addr, done); err != nil {
+		return nil, false, err
+	}
+
+	delay := h.hedgeDelay()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	hedges, pending := 0, 1
+	for {
+		select {
+		case call := <-results:
+			pending--
+			f := call.future
+			call.end(f.Err)
+			if f.Err != nil && pending > 0 {
+				continue
+			}
+			R.dropHedges(calls, context.Canceled)
+			if f.Err == nil {
+				h.observe(time.Since(start))
+				if call != calls[0] {
+					atomic.AddUint64(&R.hedgeStats.wins, 1)
+				}
+			}
+			return f.Response, true, f.Err
+		case <-timer.C:
+			if hedges >= h.policy.MaxHedges {
+				continue
+			}
+			hedges++
+			if hedges < h.policy.MaxHedges {
+				timer.Reset(delay)
+			}
+			p := copyPacket(packet)
+			addr, done, err := pick(ctx, p, *tried)
+			if err != nil {
+				continue
+			}
+			// a hedge is only worth sending to another address
+			if containsAddr(*tried, addr) || !h.budget.take() {
+				if done != nil {
+					done(context.Canceled)
+				}
+				continue
+			}
+			if send(p, addr, done) == nil {
+				pending++
+				atomic.AddUint64(&R.hedgeStats.hedges, 1)
+			}
+		case <-ctx.Done():
+			err := contextError(ctx)
+			R.dropHedges(calls, err)
+			return nil, true, err
+		}
+	}
+}
+
+// dropHedges fails the requests of a hedged call which have not ended, their
+// responses are dropped if they come. Nothing is sent to the servers.
+func (R *RPCClient) dropHedges(calls []*hedgeCall, err error) {
+	for _, call := range calls {
+		if call.ended {
+			continue
+		}
+		if R.responseTable.removeFuture(call.future) {
+			call.future.complete(nil, err)
+		}
+		call.end(err)
+	}
+}
@@ -0,0 +1,143 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+func TestHedge(t *testing.T) {
+	slow := func(s *RPCServer) {
+		s.RegisterProcessor(5, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			time.Sleep(300 * time.Millisecond)
+			return protocol.NewPacket(5, []byte("slow"), nil)
+		})
+	}
+	fast := func(s *RPCServer) {
+		s.RegisterProcessor(5, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			return protocol.NewPacket(5, []byte("fast"), nil)
+		})
+	}
+	_, slowAddr := startTestServer(t, slow)
+	_, fastAddr := startTestServer(t, fast)
+	resolver := newStaticResolver()
+	resolver.set("echo", slowAddr, fastAddr)
+	policy := config.NewDefaultHedgePolicy()
+	policy.MinDelay = 20 * time.Millisecond
+	policy.MaxRatio = 0
+	clientConfig := config.NewClientConfig()
+	clientConfig.Resolver = resolver
+	clientConfig.HedgePolicies = map[int16]*config.HedgePolicy{5: policy}
+	c := NewRPCClient(clientConfig)
+
+	for i := 0; i < 4; i++ {
+		packet := protocol.NewPacket(5, nil, nil)
+		packet.MarkIdempotent()
+		start := time.Now()
+		resp, err := c.InvokeServiceSync(context.Background(), "echo", packet, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body) != "fast" || time.Since(start) > 200*time.Millisecond {
+			t.Fatalf("call answered by the %s endpoint after %v", resp.Body, time.Since(start))
+		}
+	}
+	if stats := c.HedgeStats(); stats.Calls != 4 || stats.Hedges < 2 || stats.Wins != stats.Hedges {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// the requests which are not idempotent are not hedged
+	for i := 0; i < 2; i++ {
+		if _, err := c.InvokeServiceSync(context.Background(), "echo", protocol.NewPacket(5, nil, nil), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := c.HedgeStats(); stats.Calls != 4 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// the hedges are bounded to a share of the calls
+	capped := *policy
+	capped.MaxRatio = 0.01
+	clientConfig.HedgePolicies = map[int16]*config.HedgePolicy{5: &capped}
+	c = NewRPCClient(clientConfig)
+	for i := 0; i < 2; i++ {
+		packet := protocol.NewPacket(5, nil, nil)
+		packet.MarkIdempotent()
+		if _, err := c.InvokeServiceSync(context.Background(), "echo", packet, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := c.HedgeStats(); stats.Hedges != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	var processed int32
+	slow := func(s *RPCServer) {
+		s.RegisterProcessor(5, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			atomic.AddInt32(&processed, 1)
+			time.Sleep(100 * time.Millisecond)
+			return protocol.NewPacket(5, nil, nil)
+		})
+	}
+	_, addr1 := startTestServer(t, slow)
+	_, addr2 := startTestServer(t, slow)
+	resolver := newStaticResolver()
+	resolver.set("echo", addr1, addr2)
+	policy := config.NewDefaultHedgePolicy()
+	policy.MinDelay = 5 * time.Millisecond
+	policy.MaxRatio = 0.1
+	clientConfig := config.NewClientConfig()
+	clientConfig.Resolver = resolver
+	clientConfig.HedgePolicies = map[int16]*config.HedgePolicy{5: policy}
+	c := NewRPCClient(clientConfig)
+
+	// every call is slow enough to be hedged, the budget holds the hedges to
+	// a tenth of the calls
+	const calls = 50
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			packet := protocol.NewPacket(5, nil, nil)
+			packet.MarkIdempotent()
+			if _, err := c.InvokeServiceSync(context.Background(), "echo", packet, time.Second); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	stats := c.HedgeStats()
+	if stats.Calls != calls || stats.Hedges == 0 || stats.Hedges > calls/10 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// the hedges which lost are not canceled, the servers process them
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&processed); n != int32(stats.Calls+stats.Hedges) {
+		t.Fatalf("servers processed %d requests of %d calls and %d hedges", n, stats.Calls, stats.Hedges)
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	policy := config.NewDefaultHedgePolicy()
+	policy.MinDelay = 5 * time.Millisecond
+	h := &hedger{policy: policy}
+	if d := h.hedgeDelay(); d != policy.MinDelay {
+		t.Fatalf("delay without samples is %v", d)
+	}
+	for i := 1; i <= 320; i++ {
+		h.observe(time.Duration(i%100+1) * time.Millisecond)
+	}
+	if d := h.hedgeDelay(); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("95th percentile of 1 to 100ms is %v", d)
+	}
+}
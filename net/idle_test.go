@@ -0,0 +1,71 @@
+package net
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+func TestIdleEviction(t *testing.T) {
+	s, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.IdleTimeout = 100 * time.Millisecond
+		s.serverConfig.HeartbeatInterval = 20 * time.Millisecond
+	})
+	clientConfig := config.NewClientConfig()
+	clientConfig.HeartbeatInterval = 20 * time.Millisecond
+	c := NewRPCClient(clientConfig)
+
+	// a busy connection is kept, heartbeats do not keep an idle one
+	for i := 0; i < 10; i++ {
+		if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	if stats := s.Stats(); stats.IdleClosed != 0 || stats.Connections != 1 {
+		t.Fatalf("busy connection is evicted: %+v", stats)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(c.ConnectionStats(addr)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection is not evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := s.Stats(); stats.IdleClosed != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// the client dials again once its connection is evicted
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleGoodbye(t *testing.T) {
+	s, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.IdleTimeout = 50 * time.Millisecond
+		s.serverConfig.HeartbeatInterval = 0
+	})
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if p := readFrame(t, conn); !p.IsGoodbye() {
+		t.Fatalf("unexpected packet: %+v", p)
+	}
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle connection is not closed: %v", err)
+	}
+	if stats := s.Stats(); stats.IdleClosed != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
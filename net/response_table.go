@@ -0,0 +1,155 @@
+package net
+
+import (
+	"context"
+	"github.com/panjf2000/gnet/pool/goroutine"
+	"sync"
+	"thunder/internal"
+	"thunder/internal/logging"
+	"thunder/internal/timingwheel"
+	"thunder/protocol"
+	"time"
+)
+
+// responseTable holds the futures waiting for a response, keyed by packet id.
+// Their timeouts are driven by a single timing wheel, so a pending request
+// costs neither a runtime timer nor a goroutine.
+type responseTable struct {
+	futures    sync.Map
+	wheel      *timingwheel.TimingWheel
+	workerPool *goroutine.Pool
+	logger     logging.Logger
+}
+
+func newResponseTable(tick time.Duration, workerPool *goroutine.Pool, logger logging.Logger) *responseTable {
+	return &responseTable{
+		wheel:      timingwheel.New(tick, timingwheel.DefaultSlots),
+		workerPool: workerPool,
+		logger:     logger,
+	}
+}
+
+// pendingTracker is implemented by the connections counting the requests
+// waiting for a response from them.
+type pendingTracker interface {
+	addPending(delta int64)
+}
+
+func addPending(f *ResponseFuture, delta int64) {
+	if tracker, ok := f.conn.(pendingTracker); ok {
+		tracker.addPending(delta)
+	}
+}
+
+// put registers the future and schedules its timeout, a timeout <= 0 means
+// the future only ends with a response, a broken connection or its context.
+func (t *responseTable) put(f *ResponseFuture, timeout time.Duration) {
+	t.futures.Store(f.PacketId, f)
+	addPending(f, 1)
+	if timeout > 0 {
+		t.wheel.Add(&f.timer, timeout, func() {
+			t.expire(f)
+		})
+	}
+}
+
+// remove unregisters the future of the packet id and stops its timeout, it
+// returns nil if there is no such future.
+func (t *responseTable) remove(packetId int32) *ResponseFuture {
+	value, ok := t.futures.LoadAndDelete(packetId)
+	if !ok {
+		return nil
+	}
+	f := value.(*ResponseFuture)
+	t.wheel.Stop(&f.timer)
+	addPending(f, -1)
+	return f
+}
+
+// removeFuture unregisters the future if it is still the one registered for
+// its packet id.
+func (t *responseTable) removeFuture(f *ResponseFuture) bool {
+	if value, ok := t.futures.Load(f.PacketId); !ok || value != f {
+		return false
+	}
+	t.futures.Delete(f.PacketId)
+	t.wheel.Stop(&f.timer)
+	addPending(f, -1)
+	return true
+}
+
+// expire runs on the goroutine of the wheel, so the callback is handed over
+// to the worker pool.
+func (t *responseTable) expire(f *ResponseFuture) {
+	if t.removeFuture(f) {
+		t.fail(f, internal.ErrRequestTimeout)
+	}
+}
+
+// fail completes the future with the error and runs its callback.
+func (t *responseTable) fail(f *ResponseFuture, err error) {
+	if !f.complete(nil, err) || f.callback == nil {
+		return
+	}
+	submitErr := t.workerPool.Submit(func() {
+		defer func() {
+			if err := recover(); err != nil {
+				t.logger.Errorf("executeCallback error: %v", err)
+			}
+		}()
+		f.executeInvokeCallback()
+	})
+	if submitErr != nil {
+		t.logger.Warnf("submit func to workerpool error, err: %v", submitErr)
+	}
+}
+
+// failConn fails all the futures waiting for a response from the connection.
+func (t *responseTable) failConn(conn interface{}, err error) {
+	t.futures.Range(func(key, value interface{}) bool {
+		f := value.(*ResponseFuture)
+		if f.conn == conn && t.removeFuture(f) {
+			t.fail(f, err)
+		}
+		return true
+	})
+}
+
+// wait blocks until the future is done or its context ends, in which case
+// the future is failed with ErrRequestTimeout, or context.Canceled if the
+// context was canceled.
+func (t *responseTable) wait(f *ResponseFuture) (*protocol.Packet, error) {
+	select {
+	case <-f.Done:
+	case <-f.ctx.Done():
+		if t.removeFuture(f) {
+			t.fail(f, contextError(f.ctx))
+		}
+		<-f.Done
+	}
+	return f.Response, f.Err
+}
+
+// watch fails the future of an asynchronous call when its context ends, a
+// goroutine is only parked for the contexts which can end.
+func (t *responseTable) watch(f *ResponseFuture) {
+	if f.ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-f.Done:
+		case <-f.ctx.Done():
+			if t.removeFuture(f) {
+				t.fail(f, contextError(f.ctx))
+			}
+		}
+	}()
+}
+
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.Canceled {
+		return context.Canceled
+	}
+	return internal.ErrRequestTimeout
+}
@@ -0,0 +1,157 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicy returns a context making the synchronous calls made with it
+// follow the retry policy rather than the policy of their code, a nil policy
+// disables the retries.
+func WithRetryPolicy(ctx context.Context, policy *config.RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+func (R *RPCClient) retryPolicy(ctx context.Context, code int16) *config.RetryPolicy {
+	if policy, ok := ctx.Value(retryPolicyKey{}).(*config.RetryPolicy); ok {
+		return policy
+	}
+	return R.clientConfig.RetryPolicies[code]
+}
+
+// PickFunc picks the address of an attempt of a call, other than the tried
+// addresses when it can. done, when not nil, is passed the result of the
+// attempt.
+type PickFunc func(ctx context.Context, packet *protocol.Packet, tried []net.Addr) (addr net.Addr, done func(err error), err error)
+
+// InvokePickedSync is InvokeSync on the address returned by pick, which is
+// asked again for every retry so the retries can go to other addresses. The
+// retries are sent under new packet ids. The idempotent requests of a code
+// with a hedge policy are hedged to the other addresses returned by pick.
+func (R *RPCClient) InvokePickedSync(ctx context.Context, pick PickFunc, packet *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
+	return R.invokePicked(ctx, pick, packet, timeout, true)
+}
+
+func (R *RPCClient) invokePicked(ctx context.Context, pick PickFunc, packet *protocol.Packet, timeout time.Duration, hedge bool) (*protocol.Packet, error) {
+	policy := R.retryPolicy(ctx, packet.Code)
+	if policy != nil {
+		R.retryBudget.call()
+	}
+
+	var tried []net.Addr
+	var resp *protocol.Packet
+	var err error
+	var openErr *CircuitOpenError
+	for attempt := 1; ; attempt++ {
+		p := packet
+		if attempt > 1 {
+			p = copyPacket(packet)
+		}
+		addr, done, pickErr := pick(ctx, p, tried)
+		if pickErr != nil {
+			if attempt == 1 {
+				return nil, pickErr
+			}
+			return resp, err
+		}
+		// a call rejected by a circuit breaker is only retried on another
+		// address
+		if openErr != nil && addr.String() == openErr.Addr.String() {
+			if done != nil {
+				done(err)
+			}
+			return resp, err
+		}
+		if resp != nil {
+			R.releasePacket(resp)
+		}
+		var sent bool
+		var h *hedger
+		if hedge && packet.IsIdempotent() {
+			h = R.hedger(packet.Code)
+		}
+		if h != nil {
+			resp, sent, err = R.invokeHedged(ctx, h, pick, p, timeout, addr, done, &tried)
+		} else {
+			resp, sent, err = R.invokeOnce(ctx, addr, p, timeout)
+			if done != nil {
+				done(err)
+			}
+			tried = append(tried, addr)
+		}
+
+		if policy == nil || attempt >= policy.MaxAttempts || !retryable(policy, p, resp, sent, err) {
+			return resp, err
+		}
+		// the rejected request never reached a server, it goes to the next
+		// address right away and does not take from the budget
+		if openErr = nil; errors.As(err, &openErr) {
+			continue
+		}
+		if !R.retryBudget.take() {
+			R.logger.Warnf("retry budget exhausted, code: %d, addr: %s, err: %v", packet.Code, addr.String(), err)
+			return resp, err
+		}
+		if !sleep(ctx, backoff(policy, attempt)) {
+			return resp, err
+		}
+	}
+}
+
+// retryable reports whether the policy retries the attempt, see
+// config.RetryPolicy.
+func retryable(policy *config.RetryPolicy, packet, resp *protocol.Packet, sent bool, err error) bool {
+	if err == nil {
+		for _, code := range policy.RetryableCodes {
+			if resp.Code == code {
+				return true
+			}
+		}
+		return false
+	}
+	if !sent {
+		return true
+	}
+	if !packet.IsIdempotent() {
+		return false
+	}
+	for _, retryableErr := range policy.RetryableErrors {
+		if errors.Is(err, retryableErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the retry following the attempt.
+func backoff(policy *config.RetryPolicy, attempt int) time.Duration {
+	delay := float64(policy.InitialBackoff) * math.Pow(math.Max(policy.BackoffMultiplier, 1), float64(attempt-1))
+	if max := float64(policy.MaxBackoff); max > 0 && delay > max {
+		delay = max
+	}
+	delay -= delay * policy.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
+
+// sleep waits for the delay, it returns false if the context ends first.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
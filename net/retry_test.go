@@ -0,0 +1,134 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	var slowCalls, fullCalls int32
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		// code 3 answers the first two calls too late
+		s.RegisterProcessor(3, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			if atomic.AddInt32(&slowCalls, 1) <= 2 {
+				time.Sleep(200 * time.Millisecond)
+			}
+			return protocol.NewPacket(3, nil, nil)
+		})
+		// code 4 is rejected twice in a row
+		s.RegisterProcessor(4, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			if atomic.AddInt32(&fullCalls, 1)%3 != 0 {
+				return protocol.NewPacket(internal.QueueFull, nil, nil)
+			}
+			return protocol.NewPacket(internal.Success, nil, nil)
+		})
+	})
+	policy := config.NewDefaultRetryPolicy()
+	policy.InitialBackoff = 10 * time.Millisecond
+	clientConfig := config.NewClientConfig()
+	clientConfig.RetryPolicies = map[int16]*config.RetryPolicy{3: policy, 4: policy}
+	c := NewRPCClient(clientConfig)
+
+	// a request which may have been processed is only retried if idempotent
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), 100*time.Millisecond); err != internal.ErrRequestTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if n := atomic.LoadInt32(&slowCalls); n != 1 {
+		t.Fatalf("request not marked idempotent is sent %d times", n)
+	}
+	p := protocol.NewPacket(3, nil, nil)
+	p.MarkIdempotent()
+	if _, err := c.InvokeSync(context.Background(), addr, p, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&slowCalls); n != 3 {
+		t.Fatalf("idempotent request is sent %d times, want 2", n-1)
+	}
+
+	// a retryable code is retried up to the max attempts
+	resp, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(4, nil, nil), time.Second)
+	if err != nil || resp.Code != internal.Success {
+		t.Fatalf("unexpected response: %+v, err: %v", resp, err)
+	}
+	once := *policy
+	once.MaxAttempts = 2
+	resp, err = c.InvokeSync(WithRetryPolicy(context.Background(), &once), addr, protocol.NewPacket(4, nil, nil), time.Second)
+	if err != nil || resp.Code != internal.QueueFull {
+		t.Fatalf("unexpected response: %+v, err: %v", resp, err)
+	}
+	resp, err = c.InvokeSync(WithRetryPolicy(context.Background(), nil), addr, protocol.NewPacket(4, nil, nil), time.Second)
+	if err != nil || resp.Code != internal.Success {
+		t.Fatalf("unexpected response: %+v, err: %v", resp, err)
+	}
+}
+
+func TestRetryOtherEndpoint(t *testing.T) {
+	_, addr := startTestServer(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr()
+	_ = l.Close()
+
+	resolver := newStaticResolver()
+	resolver.set("echo", down, addr)
+	clientConfig := config.NewClientConfig()
+	clientConfig.Resolver = resolver
+	clientConfig.RetryPolicies = map[int16]*config.RetryPolicy{1: config.NewDefaultRetryPolicy()}
+	c := NewRPCClient(clientConfig)
+	// the requests which cannot be sent are retried whether idempotent or not
+	for i := 0; i < 4; i++ {
+		if _, err := c.InvokeServiceSync(context.Background(), "echo", protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRetryCircuitOpen(t *testing.T) {
+	_, addr := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(3, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			time.Sleep(100 * time.Millisecond)
+			return protocol.NewPacket(3, nil, nil)
+		})
+	})
+	_, other := startTestServer(t, nil)
+	breakerConfig := config.NewDefaultBreakerConfig()
+	breakerConfig.MinCalls = 2
+	clientConfig := config.NewClientConfig()
+	clientConfig.Breaker = breakerConfig
+	clientConfig.RetryPolicies = map[int16]*config.RetryPolicy{1: config.NewDefaultRetryPolicy()}
+	c := NewRPCClient(clientConfig)
+	for i := 0; i < 2; i++ {
+		if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(3, nil, nil), 20*time.Millisecond); err != internal.ErrRequestTimeout {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// a rejected call is not retried on the same address
+	if _, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), time.Second); !errors.Is(err, internal.ErrCircuitOpen) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := c.CircuitStats(); len(stats) != 1 || stats[0].Rejected != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// but on another one
+	pick := func(ctx context.Context, packet *protocol.Packet, tried []net.Addr) (net.Addr, func(error), error) {
+		if len(tried) == 0 {
+			return addr, nil, nil
+		}
+		return other, nil, nil
+	}
+	if _, err := c.InvokePickedSync(context.Background(), pick, protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
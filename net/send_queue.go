@@ -0,0 +1,209 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"runtime"
+	"sync"
+	"thunder/internal"
+	"thunder/protocol"
+)
+
+const (
+	// lengthFieldLength is the length of the length field prepended to every
+	// frame on the wire.
+	lengthFieldLength = 4
+	// maxWriteBatch bounds the number of frames coalesced into one write, it
+	// stays well below IOV_MAX.
+	maxWriteBatch = 128
+)
+
+// outboundFrame is a frame with its length field, buf is the pooled buffer
+// holding it, if any, which is released once the frame is written.
+type outboundFrame struct {
+	data []byte
+	buf  *protocol.Buffer
+}
+
+func (f *outboundFrame) release() {
+	if f.buf != nil {
+		f.buf.Release()
+	}
+	f.data, f.buf = nil, nil
+}
+
+// sendQueue serializes the writes to a client connection. Frames are queued by
+// the invoking goroutines and written by a single writer goroutine, which
+// coalesces all the frames queued meanwhile into one vectored write.
+type sendQueue struct {
+	conn   net.Conn
+	frames chan outboundFrame
+	// failWhenFull makes enqueue fail instead of blocking on a full queue.
+	failWhenFull bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newSendQueue(conn net.Conn, size int, failWhenFull bool) *sendQueue {
+	if size <= 0 {
+		size = 1
+	}
+	return &sendQueue{
+		conn:         conn,
+		frames:       make(chan outboundFrame, size),
+		failWhenFull: failWhenFull,
+		closed:       make(chan struct{}),
+	}
+}
+
+// encodeFrame encodes the packet into a frame ready to be queued, with packet
+// pooling the frame is encoded into a pooled buffer.
+func encodeFrame(packet *protocol.Packet, checksum, pooled bool) (outboundFrame, error) {
+	var (
+		f   outboundFrame
+		err error
+	)
+	if pooled {
+		f.buf = protocol.AcquireBuffer()
+		f.data = append(f.buf.B[:0], 0, 0, 0, 0)
+	} else {
+		f.data = make([]byte, lengthFieldLength, lengthFieldLength+protocol.EncodedSizeHint(packet, checksum))
+	}
+	f.data, err = protocol.AppendEncode(f.data, packet, checksum)
+	if err != nil {
+		f.release()
+		return f, err
+	}
+	binary.BigEndian.PutUint32(f.data, uint32(len(f.data)-lengthFieldLength))
+	if f.buf != nil {
+		f.buf.B = f.data
+	}
+	return f, nil
+}
+
+// enqueue queues the frame, when the queue is full it either blocks until
+// there is room, the context ends or the connection is closed, or fails with
+// ErrSendQueueFull. The frame is released if it is not queued.
+func (q *sendQueue) enqueue(ctx context.Context, f outboundFrame) error {
+	select {
+	case <-q.closed:
+		f.release()
+		return internal.ErrConnectionClosed
+	default:
+	}
+
+	if q.failWhenFull {
+		select {
+		case q.frames <- f:
+			return q.queued()
+		default:
+			f.release()
+			return internal.ErrSendQueueFull
+		}
+	}
+	select {
+	case q.frames <- f:
+		return q.queued()
+	case <-q.closed:
+		f.release()
+		return internal.ErrConnectionClosed
+	case <-ctx.Done():
+		f.release()
+		return contextError(ctx)
+	}
+}
+
+// queued checks the queue is still open once a frame is in it. The writer
+// drains the queue once when it is closed, so the frames queued meanwhile are
+// drained here and fail with ErrConnectionClosed.
+func (q *sendQueue) queued() error {
+	if q.isClosed() {
+		q.drain()
+		return internal.ErrConnectionClosed
+	}
+	return nil
+}
+
+// run writes the queued frames until the queue is closed or a write fails.
+func (q *sendQueue) run() error {
+	frames := make([]outboundFrame, 0, maxWriteBatch)
+	buffers := make(net.Buffers, 0, maxWriteBatch)
+	for {
+		select {
+		case f := <-q.frames:
+			frames = append(frames[:0], f)
+		case <-q.closed:
+			q.drain()
+			return nil
+		}
+		q.collect(&frames)
+		if len(frames) == 1 {
+			// the writer is usually woken up by the first frame queued, give
+			// the other senders a chance to queue theirs before writing
+			runtime.Gosched()
+			q.collect(&frames)
+		}
+
+		buffers = buffers[:0]
+		for _, f := range frames {
+			buffers = append(buffers, f.data)
+		}
+		// WriteTo consumes the slice it is called on, so it gets a copy
+		pending := buffers
+		_, err := pending.WriteTo(q.conn)
+		for i := range frames {
+			frames[i].release()
+			buffers[i] = nil
+		}
+		if err != nil {
+			// a write failing on a closed queue is the connection being closed
+			if q.isClosed() {
+				err = nil
+			}
+			q.close()
+			q.drain()
+			return err
+		}
+	}
+}
+
+// collect appends the frames already queued to the batch.
+func (q *sendQueue) collect(frames *[]outboundFrame) {
+	for len(*frames) < maxWriteBatch {
+		select {
+		case f := <-q.frames:
+			*frames = append(*frames, f)
+		default:
+			return
+		}
+	}
+}
+
+// drain releases the frames left in the queue once it is closed.
+func (q *sendQueue) drain() {
+	for {
+		select {
+		case f := <-q.frames:
+			f.release()
+		default:
+			return
+		}
+	}
+}
+
+func (q *sendQueue) close() {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+}
+
+func (q *sendQueue) isClosed() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,156 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+func TestSendQueue(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	q := newSendQueue(client, 2, true)
+
+	for i := 0; i < 2; i++ {
+		f, err := encodeFrame(protocol.NewPacket(int16(i), []byte("thunder"), nil), false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = q.enqueue(context.Background(), f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := encodeFrame(protocol.NewPacket(2, nil, nil), false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.enqueue(context.Background(), f); err != internal.ErrSendQueueFull {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.run()
+	}()
+	for i := 0; i < 2; i++ {
+		var lengthField [4]byte
+		if _, err = io.ReadFull(server, lengthField[:]); err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(lengthField[:]))
+		if _, err = io.ReadFull(server, frame); err != nil {
+			t.Fatal(err)
+		}
+		p, err := protocol.Decode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Code != int16(i) || string(p.Body) != "thunder" {
+			t.Fatalf("unexpected packet: %+v", p)
+		}
+	}
+
+	q.close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	f, _ = encodeFrame(protocol.NewPacket(3, nil, nil), false, false)
+	if err = q.enqueue(context.Background(), f); err != internal.ErrConnectionClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSendQueueBlocking(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	q := newSendQueue(client, 1, false)
+	f, _ := encodeFrame(protocol.NewPacket(1, nil, nil), false, false)
+	if err := q.enqueue(context.Background(), f); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f, _ = encodeFrame(protocol.NewPacket(2, nil, nil), false, false)
+	if err := q.enqueue(ctx, f); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		f, _ := encodeFrame(protocol.NewPacket(3, nil, nil), false, false)
+		done <- q.enqueue(context.Background(), f)
+	}()
+	q.close()
+	if err := <-done; err != internal.ErrConnectionClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSendQueueClose(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		client, server := net.Pipe()
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, server)
+		}()
+		q := newSendQueue(client, 1024, false)
+		done := make(chan error, 1)
+		go func() {
+			done <- q.run()
+		}()
+
+		// the senders race the close until their frames are refused
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					f, _ := encodeFrame(protocol.NewPacket(1, nil, nil), false, true)
+					err := q.enqueue(context.Background(), f)
+					if err == internal.ErrConnectionClosed {
+						return
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		q.close()
+		wg.Wait()
+		<-done
+		_ = server.Close()
+		// the frames queued while the queue was closing are not left behind
+		if n := len(q.frames); n != 0 {
+			t.Fatalf("%d frames left in the closed queue", n)
+		}
+	}
+}
+
+func TestSendQueueClosedWhileQueuing(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	q := newSendQueue(client, 4, false)
+	// the writer drains the queue once it is closed, then a sender which
+	// found the queue open queues its frame
+	q.close()
+	q.drain()
+	f, _ := encodeFrame(protocol.NewPacket(1, nil, nil), false, true)
+	q.frames <- f
+	if err := q.queued(); err != internal.ErrConnectionClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := len(q.frames); n != 0 {
+		t.Fatalf("%d frames left in the closed queue", n)
+	}
+}
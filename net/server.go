@@ -8,6 +8,7 @@ import (
 	"github.com/panjf2000/gnet/pool/goroutine"
 	"net"
 	"sync"
+	"sync/atomic"
 	"thunder/config"
 	"thunder/internal"
 	"thunder/internal/logging"
@@ -15,24 +16,58 @@ import (
 	"time"
 )
 
+// ServerStats is a snapshot of the connection metrics of a server.
+type ServerStats struct {
+	// Connections is the number of open connections.
+	Connections int
+	// IdleClosed and HeartbeatClosed count the connections closed for being
+	// idle and for missing heartbeats.
+	IdleClosed      uint64
+	HeartbeatClosed uint64
+}
+
+type serverStats struct {
+	idleClosed      uint64
+	heartbeatClosed uint64
+}
+
 type processFunc func(p *protocol.Packet, addr net.Addr) *protocol.Packet
 
+// ContextProcessFunc is a processor given a context which carries the
+// connection the request was received on, see ConnectionFromContext.
+type ContextProcessFunc func(ctx context.Context, p *protocol.Packet) *protocol.Packet
+
+func (f processFunc) withContext() ContextProcessFunc {
+	return func(ctx context.Context, p *protocol.Packet) *protocol.Packet {
+		conn, _ := ConnectionFromContext(ctx)
+		return f(p, conn.RemoteAddr())
+	}
+}
+
 type RPCServer struct {
 	gnet.EventServer
 	logger           logging.Logger
-	packetProcessors map[int16]processFunc
-	responseTable    sync.Map
+	packetProcessors map[int16]ContextProcessFunc
+	responseTable    *responseTable
+	// conns maps the open connections to their context, it is ranged over by
+	// Tick
+	conns         sync.Map
+	nextHeartbeat time.Time
+	stats         serverStats
 
 	serverConfig *config.ServerConfig
 
 	codec      gnet.ICodec
 	workerPool *goroutine.Pool
+	events     *eventDispatcher
+	clients    *clientRegistry
+	topics     *topicRegistry
 }
 
 func NewRPCServer(serverConfig *config.ServerConfig) *RPCServer {
 	server := &RPCServer{
-		packetProcessors: make(map[int16]processFunc),
-		logger: serverConfig.Logger,
+		packetProcessors: make(map[int16]ContextProcessFunc),
+		logger:           serverConfig.Logger,
 	}
 
 	encoderConfig := gnet.EncoderConfig{
@@ -49,77 +84,188 @@ func NewRPCServer(serverConfig *config.ServerConfig) *RPCServer {
 		InitialBytesToStrip: 4,
 	}
 
-	server.codec = gnet.NewLengthFieldBasedFrameCodec(encoderConfig, decoderConfig)
+	server.codec = &frameCodec{
+		LengthFieldBasedFrameCodec: gnet.NewLengthFieldBasedFrameCodec(encoderConfig, decoderConfig),
+		server:                     server,
+	}
 	server.serverConfig = serverConfig
 	server.workerPool = goroutine.Default()
+	server.clients = newClientRegistry()
+	server.topics = newTopicRegistry()
+	server.events = newEventDispatcher(serverConfig.EventListener, serverConfig.Logger)
+	server.responseTable = newResponseTable(serverConfig.TimerTick, server.workerPool, serverConfig.Logger)
+	// the probes go through the worker pool like the requests, so a server
+	// too busy to process requests fails them too
+	server.RegisterProcessor(protocol.PingCode, func(packet *protocol.Packet, addr net.Addr) *protocol.Packet {
+		return protocol.NewPacket(internal.Success, nil, nil)
+	})
 
 	return server
 }
 
 func (r *RPCServer) InvokeSync(ctx context.Context, conn gnet.Conn, packet *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
-	ctx, _ = context.WithTimeout(ctx, timeout)
-	resp := NewResponseFuture(ctx, packet.PacketId, nil)
-	r.responseTable.Store(packet.PacketId, resp)
-	defer r.responseTable.Delete(packet.PacketId)
-	data, err := protocol.Encode(packet)
-	if err != nil {
-		return nil, err
-	}
-	err = conn.AsyncWrite(data)
-	return resp.waitResponse()
+	return r.invokeSync(ctx, connContextOf(conn), packet, timeout)
 }
 
 func (r *RPCServer) InvokeAsync(ctx context.Context, conn gnet.Conn, packet *protocol.Packet, callback func(future *ResponseFuture), timeout time.Duration) error {
+	return r.invokeAsync(ctx, connContextOf(conn), packet, callback, timeout)
+}
+
+func (r *RPCServer) InvokeOneway(ctx context.Context, conn gnet.Conn, packet *protocol.Packet, timeout time.Duration) error {
+	return r.writeContext(connContextOf(conn), packet)
+}
+
+// invokeSync and invokeAsync take the context of the connection, which
+// unlike the gnet.Conn stays valid once the connection is closed, so they
+// can be used off the event loops on connections which may be closing.
+func (r *RPCServer) invokeSync(ctx context.Context, conn *connContext, packet *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
 	resp := NewResponseFuture(ctx, packet.PacketId, nil)
-	r.responseTable.Store(packet.PacketId, resp)
-	data, err := protocol.Encode(packet)
+	resp.conn = conn.conn
+	r.responseTable.put(resp, timeout)
+	err := r.writeContext(conn, packet)
 	if err != nil {
-		return err
+		r.responseTable.removeFuture(resp)
+		return nil, err
 	}
-	err = conn.AsyncWrite(data)
+	return r.responseTable.wait(resp)
+}
+
+func (r *RPCServer) invokeAsync(ctx context.Context, conn *connContext, packet *protocol.Packet, callback func(future *ResponseFuture), timeout time.Duration) error {
+	resp := NewResponseFuture(ctx, packet.PacketId, callback)
+	resp.conn = conn.conn
+	r.responseTable.put(resp, timeout)
+	err := r.writeContext(conn, packet)
 	if err != nil {
+		r.responseTable.removeFuture(resp)
 		return err
 	}
-	go func() {
-		if err := recover(); err != nil {
-			r.logger.Errorf("receive message async error, err: %v", err)
-		}
-		r.receiveAsync(resp)
-	}()
+	r.responseTable.watch(resp)
 	return nil
 }
 
-func (r *RPCServer) InvokeOneway(ctx context.Context, conn gnet.Conn, packet *protocol.Packet, timeout time.Duration) error {
-	ctx, _ = context.WithTimeout(ctx, timeout)
-	data, err := protocol.Encode(packet)
-	if err != nil {
-		return err
+// InvokeClientSync is InvokeSync on one of the connections of the client
+// registered with the id.
+func (r *RPCServer) InvokeClientSync(ctx context.Context, clientId string, packet *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
+	conn, ok := r.clients.conn(clientId)
+	if !ok {
+		return nil, internal.ErrClientNotFound
 	}
-	err = conn.AsyncWrite(data)
-	if err != nil {
-		return err
+	return r.invokeSync(ctx, conn, packet, timeout)
+}
+
+// InvokeClientAsync is InvokeAsync on one of the connections of the client
+// registered with the id.
+func (r *RPCServer) InvokeClientAsync(ctx context.Context, clientId string, packet *protocol.Packet, callback func(future *ResponseFuture), timeout time.Duration) error {
+	conn, ok := r.clients.conn(clientId)
+	if !ok {
+		return internal.ErrClientNotFound
 	}
-	return nil
+	return r.invokeAsync(ctx, conn, packet, callback, timeout)
+}
+
+// InvokeClientOneway is InvokeOneway on one of the connections of the client
+// registered with the id.
+func (r *RPCServer) InvokeClientOneway(ctx context.Context, clientId string, packet *protocol.Packet, timeout time.Duration) error {
+	conn, ok := r.clients.conn(clientId)
+	if !ok {
+		return internal.ErrClientNotFound
+	}
+	return r.writeContext(conn, packet)
+}
+
+// Clients returns the live registered clients sorted by id, only those of the
+// group unless group is empty.
+func (r *RPCServer) Clients(group string) []ClientInfo {
+	return r.clients.list(group)
 }
 
+// RegisterProcessor registers the processor of the requests of the code. With
+// packet pooling, a response the processor acquired from the pool is released
+// once written, the other responses are left to the processor.
 func (r *RPCServer) RegisterProcessor(code int16, processFunc processFunc) {
+	r.packetProcessors[code] = processFunc.withContext()
+}
+
+func (r *RPCServer) RegisterContextProcessor(code int16, processFunc ContextProcessFunc) {
 	r.packetProcessors[code] = processFunc
 }
 
+// AddEventListener adds a listener of the connection events, after the one of
+// the server config. It must be called before Start.
+func (r *RPCServer) AddEventListener(listener config.ConnectionEventListener) {
+	if r.events == nil {
+		r.events = newEventDispatcher(listener, r.logger)
+		return
+	}
+	r.events.listener = eventListeners{r.events.listener, listener}
+}
+
 func (r *RPCServer) ShutDown() {
 	panic("implement me")
 }
 
 func (r *RPCServer) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
-	p, err := protocol.Decode(frame)
+	// the codec copies every frame out of the inbound buffer, so the body can
+	// alias it
+	var (
+		p   *protocol.Packet
+		err error
+	)
+	ctx := connContextOf(c)
+	if ctx.checksumEnabled() {
+		if decodeErr := protocol.RequireChecksum(frame); decodeErr != nil {
+			r.onDecodeError(c, decodeErr)
+			action = gnet.Close
+			return
+		}
+	}
+	if r.serverConfig.PacketPool {
+		p, err = protocol.DecodePooled(frame, nil, r.serverConfig.DecodeLimits)
+	} else {
+		p, err = protocol.DecodeAliasBody(frame, r.serverConfig.DecodeLimits)
+	}
 	if err != nil {
+		r.onDecodeError(c, err.(*protocol.DecodeError))
+		action = gnet.Close
 		return
 	}
+	now := time.Now()
+	ctx.touch(now)
+	if protocol.HasChecksum(frame) {
+		ctx.enableChecksum()
+	}
 	r.logger.Debugf("receive packet: %+v", p)
+	if p.IsControl() {
+		r.onControlPacket(p, c)
+		return
+	}
+	atomic.StoreInt64(&ctx.lastRead, now.UnixNano())
 	r.processPacket(p, c)
 	return
 }
 
+func (r *RPCServer) OnOpened(c gnet.Conn) (out []byte, action gnet.Action) {
+	ctx := newConnContext(c)
+	c.SetContext(ctx)
+	r.conns.Store(c, ctx)
+	r.events.onConnect(ctx)
+	return
+}
+
+func (r *RPCServer) OnClosed(c gnet.Conn, err error) (action gnet.Action) {
+	ctx := connContextOf(c)
+	r.conns.Delete(c)
+	r.clients.unregister(ctx)
+	r.topics.unsubscribeAll(ctx)
+	r.failPending(c, internal.ErrConnectionClosed)
+	ctx.releaseWrites()
+	if err != nil {
+		r.events.onException(ctx, err)
+	}
+	r.events.onClose(ctx, &ctx.attrs)
+	return
+}
+
 func (r *RPCServer) OnInitComplete(srv gnet.Server) (action gnet.Action) {
 	r.logger.Infof(internal.BannerString())
 	r.logger.Infof("[THUNDER] Thunder server is listening on %s (multi-cores: %t, loops: %d)\n",
@@ -127,6 +273,90 @@ func (r *RPCServer) OnInitComplete(srv gnet.Server) (action gnet.Action) {
 	return
 }
 
+// Tick closes the idle connections, sends the heartbeats on the connections
+// which have read nothing lately and closes the dead ones. It only fires when
+// heartbeats or the idle timeout are enabled.
+func (r *RPCServer) Tick() (delay time.Duration, action gnet.Action) {
+	now := time.Now()
+	idleTimeout := r.serverConfig.IdleTimeout
+	heartbeat := r.serverConfig.HeartbeatInterval > 0 && !now.Before(r.nextHeartbeat)
+	if heartbeat {
+		r.nextHeartbeat = now.Add(r.serverConfig.HeartbeatInterval)
+	}
+
+	r.conns.Range(func(key, value interface{}) bool {
+		c := key.(gnet.Conn)
+		ctx := connContextOf(c)
+		if atomic.LoadInt32(&ctx.closing) == 1 {
+			return true
+		}
+		// the subscribers wait for the server to publish, they are not idle
+		if idleTimeout > 0 && ctx.idleFor(now) >= idleTimeout && !r.topics.subscribed(ctx) {
+			r.closeIdle(c, ctx)
+			return true
+		}
+		if !heartbeat {
+			return true
+		}
+		send, dead := ctx.check(now, r.serverConfig.HeartbeatInterval, r.serverConfig.HeartbeatMaxMissed)
+		switch {
+		case dead:
+			r.logger.Warnf("heartbeats missed, close connection, addr: %s", c.RemoteAddr().String())
+			atomic.StoreInt32(&ctx.closing, 1)
+			atomic.AddUint64(&r.stats.heartbeatClosed, 1)
+			r.events.onException(ctx, internal.ErrHeartbeatTimeout)
+			_ = c.Close()
+		case send:
+			if err := r.writePacket(c, protocol.NewHeartbeat()); err != nil {
+				r.logger.Warnf("send heartbeat error, addr: %s, err: %v", c.RemoteAddr().String(), err)
+			}
+		}
+		return true
+	})
+	delay = r.tickInterval()
+	return
+}
+
+// tickInterval is the heartbeat interval, or a fraction of the idle timeout
+// when it is shorter, so idle connections are closed at most a quarter of the
+// timeout late.
+func (r *RPCServer) tickInterval() time.Duration {
+	interval := r.serverConfig.HeartbeatInterval
+	if idleCheck := r.serverConfig.IdleTimeout / 4; idleCheck > 0 && (interval <= 0 || idleCheck < interval) {
+		interval = idleCheck
+	}
+	return interval
+}
+
+// closeIdle closes the idle connection, after saying goodbye if enabled.
+func (r *RPCServer) closeIdle(c gnet.Conn, ctx *connContext) {
+	atomic.StoreInt32(&ctx.closing, 1)
+	atomic.AddUint64(&r.stats.idleClosed, 1)
+	r.logger.Infof("close idle connection, addr: %s", c.RemoteAddr().String())
+	r.events.onIdle(ctx)
+	if r.serverConfig.IdleGoodbye {
+		// gnet writes out what is buffered before closing the connection
+		if err := r.writePacket(c, protocol.NewGoodbye()); err != nil {
+			r.logger.Warnf("send goodbye error, addr: %s, err: %v", c.RemoteAddr().String(), err)
+		}
+	}
+	_ = c.Close()
+}
+
+// Stats returns the connection metrics of the server.
+func (r *RPCServer) Stats() ServerStats {
+	var connections int
+	r.conns.Range(func(key, value interface{}) bool {
+		connections++
+		return true
+	})
+	return ServerStats{
+		Connections:     connections,
+		IdleClosed:      atomic.LoadUint64(&r.stats.idleClosed),
+		HeartbeatClosed: atomic.LoadUint64(&r.stats.heartbeatClosed),
+	}
+}
+
 func (r *RPCServer) Start() {
 	err := gnet.Serve(r, r.serverConfig.Addr, func(opts *gnet.Options) {
 		opts.Logger = r.serverConfig.Logger
@@ -134,6 +364,7 @@ func (r *RPCServer) Start() {
 		opts.Multicore = r.serverConfig.Multicore
 		opts.TCPKeepAlive = r.serverConfig.TcpKeepAlive
 		opts.LB = r.serverConfig.LoadBalance
+		opts.Ticker = r.tickInterval() > 0
 	})
 
 	if err != nil {
@@ -143,50 +374,64 @@ func (r *RPCServer) Start() {
 
 func (r *RPCServer) processPacket(packet *protocol.Packet, conn gnet.Conn) {
 	if packet.IsResponseType() {
-		resp, exist := r.responseTable.Load(packet.PacketId)
-		if exist {
-			r.responseTable.Delete(packet.PacketId)
-			responseFuture := resp.(*ResponseFuture)
+		responseFuture := r.responseTable.remove(packet.PacketId)
+		if responseFuture != nil {
 			err := r.workerPool.Submit(func() {
 				defer func() {
 					if err := recover(); err != nil {
 						r.logger.Errorf("executeCallback error: %v", err)
 					}
 				}()
-				responseFuture.Response = packet
+				if !responseFuture.complete(packet, nil) {
+					r.releasePacket(packet)
+					return
+				}
 				responseFuture.executeInvokeCallback()
-				if responseFuture.Done != nil {
-					responseFuture.Done <- true
+				// the caller of InvokeSync owns the response, it is only
+				// released for the callbacks
+				if responseFuture.callback != nil {
+					r.releasePacket(packet)
 				}
-
 			})
 
 			if err != nil {
 				r.logger.Warnf("submit func to workerpool error, err: %v", err)
+				r.releasePacket(packet)
+				r.responseTable.fail(responseFuture, err)
 			}
+		} else {
+			r.releasePacket(packet)
 		}
 	} else {
 		f := r.packetProcessors[packet.Code]
 		if f != nil {
+			// the context is looked up on the event loop, gnet releases the
+			// connection once it is closed
+			ctx := connContextOf(conn)
+			id, oneway := packet.PacketId, packet.IsOneway()
 			err := r.workerPool.Submit(func() {
 				defer func() {
 					if err := recover(); err != nil {
 						r.logger.Errorf("execute process func error: %v", err)
+						if !oneway {
+							r.answerSystemError(ctx, id, err)
+						}
 					}
 				}()
-				res := f(packet, conn.RemoteAddr())
+				defer r.releasePacket(packet)
+				res := f(withConnection(context.Background(), ctx), packet)
 				if res != nil && !packet.IsOneway() {
 					res.PacketId = packet.PacketId
 					res.MarkResponseType()
-					data, err := protocol.Encode(res)
-					if err != nil {
-						r.logger.Errorf("encode response packet error, err: %v", err)
-					}
-					err = conn.AsyncWrite(data)
+					err := r.writeContext(ctx, res)
 					if err != nil {
 						r.logger.Warnf("send response packet error, response: %+v, err: %+v", res, err)
 					}
 				}
+				// only the responses acquired from the pool are the server's
+				if res != nil && res.IsPooled() {
+					r.releasePacket(res)
+				}
 			})
 
 			if err != nil {
@@ -197,21 +442,109 @@ func (r *RPCServer) processPacket(packet *protocol.Packet, conn gnet.Conn) {
 			p.PacketId = packet.PacketId
 			p.MarkResponseType()
 			p.Message = fmt.Sprintf("there is no process func registered with code: %d", packet.Code)
-			data, err := protocol.Encode(p)
-			if err != nil {
-				r.logger.Errorf("encode response packet error, err: %v", err)
-			}
-			err = conn.AsyncWrite(data)
+			err := r.writePacket(conn, p)
 			if err != nil {
 				r.logger.Warnf("send response packet error, response: %+v, err: %+v", p, err)
 			}
+			r.releasePacket(packet)
+		}
+	}
+}
+
+// answerSystemError answers the request whose process func panicked, so the
+// caller does not wait for its timeout.
+func (r *RPCServer) answerSystemError(ctx *connContext, id int32, cause interface{}) {
+	p := protocol.NewPacket(internal.SystemError, nil, nil)
+	p.PacketId = id
+	p.MarkResponseType()
+	p.Message = fmt.Sprintf("process func error: %v", cause)
+	if err := r.writeContext(ctx, p); err != nil {
+		r.logger.Warnf("send response packet error, response: %+v, err: %+v", p, err)
+	}
+}
+
+// onControlPacket answers a heartbeat request, registers the identity of a
+// client and updates the subscriptions of the connection, the other control
+// packets only matter for having been read.
+func (r *RPCServer) onControlPacket(packet *protocol.Packet, conn gnet.Conn) {
+	switch {
+	case packet.IsRegister():
+		id, group, tags := protocol.ParseRegister(packet)
+		if id != "" {
+			r.clients.register(connContextOf(conn), id, group, tags)
+		}
+	case packet.IsSubscribe():
+		r.topics.subscribe(connContextOf(conn), protocol.ParseTopics(packet))
+	case packet.IsUnsubscribe():
+		r.topics.unsubscribe(connContextOf(conn), protocol.ParseTopics(packet))
+	case packet.IsHeartbeat() && !packet.IsResponseType():
+		if err := r.writePacket(conn, protocol.NewHeartbeatResponse(packet)); err != nil {
+			r.logger.Warnf("send heartbeat response error, addr: %s, err: %v", conn.RemoteAddr().String(), err)
 		}
 	}
+	r.releasePacket(packet)
+}
+
+// writePacket encodes the packet, with a checksum if it is enabled by the
+// config or negotiated by the peer, and writes it to the connection. With
+// packet pooling the frame is encoded into a pooled buffer, which the codec
+// releases once gnet has copied it.
+func (r *RPCServer) writePacket(conn gnet.Conn, packet *protocol.Packet) error {
+	return r.writeContext(connContextOf(conn), packet)
 }
 
-func (r *RPCServer) receiveAsync(f *ResponseFuture) {
-	_, err := f.waitResponse()
+// writeContext is writePacket on the connection of the context.
+func (r *RPCServer) writeContext(ctx *connContext, packet *protocol.Packet) error {
+	conn := ctx.conn
+	if !packet.IsControl() {
+		atomic.StoreInt64(&ctx.lastWrite, time.Now().UnixNano())
+	}
+	checksum := r.serverConfig.Checksum || ctx.checksumEnabled()
+	if !r.serverConfig.PacketPool {
+		data, err := encodePacket(packet, checksum)
+		if err != nil {
+			return err
+		}
+		return conn.AsyncWrite(data)
+	}
+
+	buf := protocol.AcquireBuffer()
+	var err error
+	buf.B, err = protocol.AppendEncode(buf.B, packet, checksum)
 	if err != nil {
-		f.executeInvokeCallback()
+		buf.Release()
+		return err
+	}
+	ctx.trackWrite(buf)
+	if err = conn.AsyncWrite(buf.B); err != nil {
+		if ctx.untrackWrite(buf.B) != nil {
+			buf.Release()
+		}
+		return err
+	}
+	return nil
+}
+
+// releasePacket gives the packet back to the pool when packet pooling is
+// enabled.
+func (r *RPCServer) releasePacket(packet *protocol.Packet) {
+	if r.serverConfig.PacketPool && !packet.IsReleased() {
+		packet.Release()
 	}
 }
+
+// onDecodeError reports the malformed frame and fails the futures waiting for a
+// response from the connection, which is going to be closed.
+func (r *RPCServer) onDecodeError(c gnet.Conn, err *protocol.DecodeError) {
+	r.logger.Errorf("decode packet error, close connection, addr: %s, err: %v", c.RemoteAddr().String(), err)
+	if r.serverConfig.DecodeErrorHook != nil {
+		r.serverConfig.DecodeErrorHook(c.RemoteAddr(), err)
+	}
+	r.events.onException(connContextOf(c), err)
+	r.failPending(c, err)
+}
+
+// failPending fails all the futures waiting for a response from the connection.
+func (r *RPCServer) failPending(conn gnet.Conn, err error) {
+	r.responseTable.failConn(conn, err)
+}
@@ -1,19 +1,91 @@
 package net
 
 import (
+	"context"
+	"fmt"
+	"github.com/panjf2000/gnet"
 	"net"
+	"sync"
 	"testing"
 	"thunder/config"
+	"thunder/internal/logging"
 	"thunder/protocol"
+	"time"
 )
 
-func TestStart(t *testing.T) {
-	s := NewRPCServer(config.NewDefaultServerConfig(9003))
+// startedLogger closes started on the first info message, which the server
+// logs once gnet has initialized. gnet sets its global logger on every Serve,
+// so the servers of a test are started one after the other.
+type startedLogger struct {
+	logging.Logger
+	once    sync.Once
+	started chan struct{}
+}
+
+func (l *startedLogger) Infof(format string, args ...interface{}) {
+	l.Logger.Infof(format, args...)
+	l.once.Do(func() {
+		close(l.started)
+	})
+}
+
+// startTestServer starts a server on a free local port and stops it when the
+// test finishes.
+func startTestServer(t testing.TB, configure func(s *RPCServer)) (*RPCServer, net.Addr) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	serverConfig := config.NewDefaultServerConfig(int32(port))
+	serverConfig.Addr = fmt.Sprintf("tcp://127.0.0.1:%d", port)
+	serverConfig.PrintBanner = false
+	logger := &startedLogger{Logger: serverConfig.Logger, started: make(chan struct{})}
+	serverConfig.Logger = logger
+	s := NewRPCServer(serverConfig)
 	s.RegisterProcessor(1, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
-		resp := protocol.NewPacket(1, nil, nil)
+		resp := protocol.NewPacket(1, p.Body, nil)
 		resp.Message = "test test"
 		return resp
 	})
-	s.Start()
+	if configure != nil {
+		configure(s)
+	}
+	go s.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = gnet.Stop(ctx, serverConfig.Addr)
+	})
+
+	select {
+	case <-logger.started:
+	case <-time.After(time.Second):
+		t.Fatal("server is not started")
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr.String()); err == nil {
+			_ = conn.Close()
+			return s, addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server is not listening on %s", addr.String())
+	return nil, nil
 }
 
+func TestStart(t *testing.T) {
+	_, addr := startTestServer(t, nil)
+	c := NewRPCClient(config.NewClientConfig())
+	p, err := c.InvokeSync(context.Background(), addr, protocol.NewPacket(1, nil, nil), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Message != "test test" {
+		t.Fatalf("unexpected response: %+v", p)
+	}
+}
@@ -0,0 +1,209 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+// serviceEndpoints holds the endpoints of a service, kept up to date by the
+// watch of the resolver. lock serializes their updates, watched tells the
+// watch has updated them.
+type serviceEndpoints struct {
+	endpoints atomic.Value
+	next      uint32
+	cancel    func()
+
+	lock    sync.Mutex
+	watched bool
+}
+
+func (s *serviceEndpoints) list() []config.Endpoint {
+	endpoints, _ := s.endpoints.Load().([]config.Endpoint)
+	return endpoints
+}
+
+// resolution is the first resolution of a service, the calls which need the
+// service meanwhile wait for it.
+type resolution struct {
+	done chan struct{}
+	s    *serviceEndpoints
+	err  error
+}
+
+// InvokeServiceSync is InvokeSync on an endpoint of the service, resolved by
+// the resolver of the client config. The retries go to the other endpoints
+// first.
+func (R *RPCClient) InvokeServiceSync(ctx context.Context, service string, packet *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
+	return R.InvokePickedSync(ctx, func(ctx context.Context, _ *protocol.Packet, tried []net.Addr) (net.Addr, func(error), error) {
+		addr, err := R.resolve(ctx, service, tried)
+		return addr, nil, err
+	}, packet, timeout)
+}
+
+// InvokeServiceAsync is InvokeAsync on an endpoint of the service.
+func (R *RPCClient) InvokeServiceAsync(ctx context.Context, service string, packet *protocol.Packet, callback func(future *ResponseFuture), timeout time.Duration) error {
+	addr, err := R.resolve(ctx, service, nil)
+	if err != nil {
+		return err
+	}
+	return R.InvokeAsync(ctx, addr, packet, callback, timeout)
+}
+
+// InvokeServiceOneway is InvokeOneway on an endpoint of the service.
+func (R *RPCClient) InvokeServiceOneway(ctx context.Context, service string, packet *protocol.Packet, timeout time.Duration) error {
+	addr, err := R.resolve(ctx, service, nil)
+	if err != nil {
+		return err
+	}
+	return R.InvokeOneway(ctx, addr, packet, timeout)
+}
+
+// resolve picks the endpoints of the service in turn, skipping the tried
+// addresses unless they all are.
+func (R *RPCClient) resolve(ctx context.Context, service string, tried []net.Addr) (net.Addr, error) {
+	s, err := R.serviceEndpoints(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := s.list()
+	if len(endpoints) == 0 {
+		return nil, internal.ErrNoEndpoints
+	}
+	next := atomic.AddUint32(&s.next, 1)
+	for i := 0; i < len(endpoints); i++ {
+		addr := endpoints[(next+uint32(i))%uint32(len(endpoints))].Addr
+		if !containsAddr(tried, addr) {
+			return addr, nil
+		}
+	}
+	return endpoints[next%uint32(len(endpoints))].Addr, nil
+}
+
+func containsAddr(addrs []net.Addr, addr net.Addr) bool {
+	for _, a := range addrs {
+		if a.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceEndpoints resolves the service the first time it is invoked and
+// watches it from then on. The resolution is not done under servicesLocker,
+// the calls which need the service while it is resolved share it.
+func (R *RPCClient) serviceEndpoints(ctx context.Context, service string) (*serviceEndpoints, error) {
+	if s, ok := R.services.Load(service); ok {
+		return s.(*serviceEndpoints), nil
+	}
+	resolver := R.clientConfig.Resolver
+	if resolver == nil {
+		return nil, internal.ErrNoResolver
+	}
+
+	R.servicesLocker.Lock()
+	if s, ok := R.services.Load(service); ok {
+		R.servicesLocker.Unlock()
+		return s.(*serviceEndpoints), nil
+	}
+	r, ok := R.resolutions[service]
+	if !ok {
+		if R.resolutions == nil {
+			R.resolutions = make(map[string]*resolution)
+		}
+		r = &resolution{done: make(chan struct{})}
+		R.resolutions[service] = r
+	}
+	R.servicesLocker.Unlock()
+	if ok {
+		select {
+		case <-r.done:
+			return r.s, r.err
+		case <-ctx.Done():
+			return nil, contextError(ctx)
+		}
+	}
+
+	r.s, r.err = R.resolveService(ctx, resolver, service)
+	R.servicesLocker.Lock()
+	if r.err == nil {
+		R.services.Store(service, r.s)
+	}
+	delete(R.resolutions, service)
+	R.servicesLocker.Unlock()
+	close(r.done)
+	return r.s, r.err
+}
+
+// resolveService watches the service before it resolves it, so no change is
+// missed, the resolved endpoints are dropped if the watch has passed newer
+// ones.
+func (R *RPCClient) resolveService(ctx context.Context, resolver config.Resolver, service string) (*serviceEndpoints, error) {
+	s := &serviceEndpoints{}
+	cancel, err := resolver.Watch(service, func(endpoints []config.Endpoint) {
+		R.updateEndpoints(s, endpoints)
+	})
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := resolver.Resolve(ctx, service)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s.lock.Lock()
+	if !s.watched {
+		s.endpoints.Store(endpoints)
+	}
+	s.cancel = cancel
+	s.lock.Unlock()
+	return s, nil
+}
+
+// updateEndpoints replaces the endpoints of the service and drains the
+// connections to the addresses which are no longer endpoints of any service.
+func (R *RPCClient) updateEndpoints(s *serviceEndpoints, endpoints []config.Endpoint) {
+	s.lock.Lock()
+	previous := s.list()
+	s.endpoints.Store(endpoints)
+	s.watched = true
+	s.lock.Unlock()
+
+	current := make(map[string]struct{})
+	R.services.Range(func(_, value interface{}) bool {
+		for _, endpoint := range value.(*serviceEndpoints).list() {
+			current[endpoint.Addr.String()] = struct{}{}
+		}
+		return true
+	})
+	for _, endpoint := range endpoints {
+		current[endpoint.Addr.String()] = struct{}{}
+	}
+	for _, endpoint := range previous {
+		if _, ok := current[endpoint.Addr.String()]; !ok {
+			R.drain(endpoint.Addr)
+		}
+	}
+}
+
+// drain removes the pool of the address, its idle connections are closed
+// right away and the others once their pending requests complete, checked
+// every ConnectionShrinkInterval.
+func (R *RPCClient) drain(addr net.Addr) {
+	R.connectionLocker.Lock()
+	pool, ok := R.connectionTable.Load(addr.String())
+	if ok {
+		R.connectionTable.Delete(addr.String())
+	}
+	R.connectionLocker.Unlock()
+	if !ok {
+		return
+	}
+	pool.(*connPool).drain()
+	R.shrink(pool.(*connPool))
+}
@@ -0,0 +1,173 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/protocol"
+	"time"
+)
+
+// staticResolver resolves the services from a map which the tests update.
+// resolved, when set, is called after the endpoints of a service are read.
+type staticResolver struct {
+	lock     sync.Mutex
+	services map[string][]config.Endpoint
+	watchers map[string]func([]config.Endpoint)
+	resolved func(service string)
+}
+
+func newStaticResolver() *staticResolver {
+	return &staticResolver{
+		services: make(map[string][]config.Endpoint),
+		watchers: make(map[string]func([]config.Endpoint)),
+	}
+}
+
+func (r *staticResolver) Resolve(ctx context.Context, service string) ([]config.Endpoint, error) {
+	r.lock.Lock()
+	endpoints, resolved := r.services[service], r.resolved
+	r.lock.Unlock()
+	if resolved != nil {
+		resolved(service)
+	}
+	return endpoints, nil
+}
+
+func (r *staticResolver) Watch(service string, onChange func([]config.Endpoint)) (func(), error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.watchers[service] = onChange
+	return func() {}, nil
+}
+
+func (r *staticResolver) set(service string, addrs ...net.Addr) {
+	endpoints := make([]config.Endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		endpoints = append(endpoints, config.Endpoint{Addr: addr, Weight: 1})
+	}
+	r.lock.Lock()
+	r.services[service] = endpoints
+	onChange := r.watchers[service]
+	r.lock.Unlock()
+	if onChange != nil {
+		onChange(endpoints)
+	}
+}
+
+func TestInvokeService(t *testing.T) {
+	var slow sync.WaitGroup
+	s1, addr1 := startTestServer(t, func(s *RPCServer) {
+		s.RegisterProcessor(2, func(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+			defer slow.Done()
+			time.Sleep(200 * time.Millisecond)
+			return protocol.NewPacket(2, nil, nil)
+		})
+	})
+	_, addr2 := startTestServer(t, nil)
+	resolver := newStaticResolver()
+	resolver.set("echo", addr1, addr2)
+	clientConfig := config.NewClientConfig()
+	clientConfig.Resolver = resolver
+	clientConfig.ConnectionShrinkInterval = 50 * time.Millisecond
+	c := NewRPCClient(clientConfig)
+
+	if _, err := c.InvokeServiceSync(context.Background(), "missing", protocol.NewPacket(1, nil, nil), time.Second); err != internal.ErrNoEndpoints {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := c.InvokeServiceSync(context.Background(), "echo", protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.ConnectionStats(addr1)) != 1 || len(c.ConnectionStats(addr2)) != 1 {
+		t.Fatal("requests are not spread over the endpoints")
+	}
+
+	// the connection to a removed endpoint drains before closing
+	slow.Add(1)
+	t.Cleanup(slow.Wait)
+	future := make(chan *ResponseFuture, 1)
+	err := c.InvokeAsync(context.Background(), addr1, protocol.NewPacket(2, nil, nil), func(f *ResponseFuture) {
+		future <- f
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.set("echo", addr2)
+	if f := <-future; f.Err != nil {
+		t.Fatalf("pending request fails: %v", f.Err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for s1.Stats().Connections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection to the removed endpoint is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err = c.InvokeServiceSync(context.Background(), "echo", protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.ConnectionStats(addr1)) != 0 {
+		t.Fatal("removed endpoint is still invoked")
+	}
+}
+
+func TestResolveService(t *testing.T) {
+	_, addr1 := startTestServer(t, nil)
+	_, addr2 := startTestServer(t, nil)
+	resolver := newStaticResolver()
+	resolver.set("echo", addr1)
+	resolver.set("slow", addr1)
+	resolver.set("moved", addr1)
+	started, release := make(chan struct{}), make(chan struct{})
+	resolver.resolved = func(service string) {
+		switch service {
+		case "slow":
+			close(started)
+			<-release
+		case "moved":
+			// the service changes between its watch and its resolution
+			resolver.set("moved", addr2)
+		}
+	}
+	clientConfig := config.NewClientConfig()
+	clientConfig.Resolver = resolver
+	c := NewRPCClient(clientConfig)
+
+	// a slow resolution holds back the calls of its service only
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c.InvokeServiceSync(context.Background(), "slow", protocol.NewPacket(1, nil, nil), time.Second)
+			errs <- err
+		}()
+	}
+	<-started
+	start := time.Now()
+	if _, err := c.InvokeServiceSync(context.Background(), "echo", protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("call waits %v for another service", elapsed)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the change is not lost to the older resolved endpoints
+	if _, err := c.InvokeServiceSync(context.Background(), "moved", protocol.NewPacket(1, nil, nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.ConnectionStats(addr2)) != 1 {
+		t.Fatal("call does not go to the changed endpoint")
+	}
+}
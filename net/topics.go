@@ -0,0 +1,96 @@
+package net
+
+import (
+	"sync"
+	"thunder/protocol"
+)
+
+// topicRegistry indexes the connections subscribed to each topic.
+type topicRegistry struct {
+	lock        sync.RWMutex
+	subscribers map[string]map[*connContext]struct{}
+}
+
+func newTopicRegistry() *topicRegistry {
+	return &topicRegistry{
+		subscribers: make(map[string]map[*connContext]struct{}),
+	}
+}
+
+func (tr *topicRegistry) subscribe(ctx *connContext, topics []string) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	if ctx.topics == nil {
+		ctx.topics = make(map[string]struct{}, len(topics))
+	}
+	for _, topic := range topics {
+		subscribers, ok := tr.subscribers[topic]
+		if !ok {
+			subscribers = make(map[*connContext]struct{})
+			tr.subscribers[topic] = subscribers
+		}
+		subscribers[ctx] = struct{}{}
+		ctx.topics[topic] = struct{}{}
+	}
+}
+
+func (tr *topicRegistry) unsubscribe(ctx *connContext, topics []string) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.removeLocked(ctx, topics)
+}
+
+// unsubscribeAll removes all the subscriptions of the closed connection.
+func (tr *topicRegistry) unsubscribeAll(ctx *connContext) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	for topic := range ctx.topics {
+		tr.removeLocked(ctx, []string{topic})
+	}
+}
+
+func (tr *topicRegistry) removeLocked(ctx *connContext, topics []string) {
+	for _, topic := range topics {
+		if subscribers, ok := tr.subscribers[topic]; ok {
+			delete(subscribers, ctx)
+			if len(subscribers) == 0 {
+				delete(tr.subscribers, topic)
+			}
+		}
+		delete(ctx.topics, topic)
+	}
+}
+
+// subscribed reports whether the connection has subscriptions.
+func (tr *topicRegistry) subscribed(ctx *connContext) bool {
+	tr.lock.RLock()
+	defer tr.lock.RUnlock()
+	return len(ctx.topics) > 0
+}
+
+func (tr *topicRegistry) list(topic string) []*connContext {
+	tr.lock.RLock()
+	defer tr.lock.RUnlock()
+	subscribers := make([]*connContext, 0, len(tr.subscribers[topic]))
+	for ctx := range tr.subscribers[topic] {
+		subscribers = append(subscribers, ctx)
+	}
+	return subscribers
+}
+
+// Publish pushes the body to the connections subscribed to the topic, as a
+// oneway packet with the code protocol.PublishCode, and returns the number of
+// connections it is written to. The clients receive it with the processor
+// registered for protocol.PublishCode.
+func (r *RPCServer) Publish(topic string, body []byte) int {
+	packet := protocol.NewPublish(topic, body)
+	var published int
+	for _, ctx := range r.topics.list(topic) {
+		if err := r.writeContext(ctx, packet); err != nil {
+			r.logger.Warnf("publish error, topic: %s, addr: %s, err: %v", topic, ctx.remoteAddr, err)
+			continue
+		}
+		published++
+	}
+	return published
+}
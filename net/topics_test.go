@@ -0,0 +1,92 @@
+package net
+
+import (
+	"context"
+	"net"
+	"testing"
+	"thunder/config"
+	"thunder/protocol"
+	"time"
+)
+
+func waitSubscribers(t *testing.T, s *RPCServer, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.topics.list(topic)) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("topic %s has %d subscribers, expected %d", topic, len(s.topics.list(topic)), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	s, addr := startTestServer(t, func(s *RPCServer) {
+		s.serverConfig.IdleTimeout = 100 * time.Millisecond
+		s.serverConfig.IdleGoodbye = false
+	})
+	clientConfig := config.NewClientConfig()
+	clientConfig.ResubscribeInterval = 10 * time.Millisecond
+	c := NewRPCClient(clientConfig)
+	// without subscriptions the client does not try to subscribe again once
+	// the server is stopped
+	t.Cleanup(func() {
+		_ = c.Unsubscribe(context.Background(), addr, "t1")
+	})
+	published := make(chan string, 16)
+	c.RegisterProcessor(protocol.PublishCode, func(p *protocol.Packet, _ net.Addr) *protocol.Packet {
+		published <- protocol.TopicOf(p) + ":" + string(p.Body)
+		return nil
+	})
+	expect := func(message string) {
+		t.Helper()
+		select {
+		case m := <-published:
+			if m != message {
+				t.Fatalf("unexpected message: %s", m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %s is not published", message)
+		}
+	}
+
+	if err := c.Subscribe(context.Background(), addr, "t1", "t2"); err != nil {
+		t.Fatal(err)
+	}
+	waitSubscribers(t, s, "t1", 1)
+	waitSubscribers(t, s, "t2", 1)
+	if n := s.Publish("t1", []byte("a")); n != 1 {
+		t.Fatalf("published to %d connections", n)
+	}
+	expect("t1:a")
+	if n := s.Publish("t3", []byte("b")); n != 0 {
+		t.Fatalf("published to %d connections", n)
+	}
+
+	if err := c.Unsubscribe(context.Background(), addr, "t2"); err != nil {
+		t.Fatal(err)
+	}
+	waitSubscribers(t, s, "t2", 0)
+
+	// a subscriber is not idle
+	time.Sleep(200 * time.Millisecond)
+	if stats := s.Stats(); stats.IdleClosed != 0 {
+		t.Fatalf("subscriber is evicted: %+v", stats)
+	}
+
+	// the subscriptions go with the connection and come back with the next
+	old := s.topics.list("t1")[0]
+	_ = old.conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for subscribers := s.topics.list("t1"); len(subscribers) != 1 || subscribers[0] == old; subscribers = s.topics.list("t1") {
+		if time.Now().After(deadline) {
+			t.Fatal("client does not subscribe again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.Publish("t1", []byte("c")); n != 1 {
+		t.Fatalf("published to %d connections", n)
+	}
+	expect("t1:c")
+	waitSubscribers(t, s, "t2", 0)
+}
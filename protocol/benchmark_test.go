@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func benchmarkPacket() *Packet {
+	p := NewPacket(1, make([]byte, 512), nil)
+	p.Message = "benchmark"
+	p.ExtData = map[string]string{"trace": "0af7651916cd43dd8448eb211c80319c"}
+	return p
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, ct := range codecTypes {
+		b.Run(ct.name, func(b *testing.B) {
+			withCodecType(ct.codec, func() {
+				p := benchmarkPacket()
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := Encode(p); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, ct := range codecTypes {
+		b.Run(ct.name, func(b *testing.B) {
+			withCodecType(ct.codec, func() {
+				data := encodeWith(b, benchmarkPacket(), false)
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := Decode(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkAppendEncode(b *testing.B) {
+	for _, ct := range codecTypes {
+		b.Run(ct.name, func(b *testing.B) {
+			withCodecType(ct.codec, func() {
+				p := benchmarkPacket()
+				buf := make([]byte, 0, EncodedSizeHint(p, true)*2)
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					var err error
+					if buf, err = AppendEncode(buf[:0], p, true); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkDecodeAliasBody(b *testing.B) {
+	for _, ct := range codecTypes {
+		b.Run(ct.name, func(b *testing.B) {
+			withCodecType(ct.codec, func() {
+				data := encodeWith(b, benchmarkPacket(), false)
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := DecodeAliasBody(data, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+const (
+	// ChecksumFlag is set on the codec type byte of a frame which carries
+	// a trailing CRC32C checksum over everything in front of it.
+	ChecksumFlag = byte(0x80)
+
+	checksumLength = 4
+	codecTypeMask  = ^ChecksumFlag
+)
+
+var (
+	ErrChecksumMismatch = errors.New("frame checksum mismatch")
+	ErrChecksumMissing  = errors.New("frame checksum missing")
+
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// HasChecksum reports whether the frame was encoded with a checksum trailer.
+func HasChecksum(frame []byte) bool {
+	return len(frame) > 0 && frame[0]&ChecksumFlag == ChecksumFlag
+}
+
+// RequireChecksum returns an error if the frame has no checksum trailer. The
+// flag is not covered by the checksum, so a connection which has received a
+// checksummed frame requires them all, a flipped flag does not skip the
+// verification.
+func RequireChecksum(frame []byte) *DecodeError {
+	if HasChecksum(frame) {
+		return nil
+	}
+	return newDecodeError("checksum", ErrChecksumMissing)
+}
+
+// appendChecksum appends the checksum of the frame starting at dst[start:].
+func appendChecksum(dst []byte, start int) []byte {
+	sum := crc32.Checksum(dst[start:], crc32cTable)
+	return append(dst, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+}
+
+// verifyChecksum checks the trailer of the frame and returns the frame
+// without it.
+func verifyChecksum(frame []byte) ([]byte, error) {
+	if len(frame) < checksumLength {
+		return nil, newDecodeError("checksum", ErrTruncated)
+	}
+	payload := frame[:len(frame)-checksumLength]
+	expected := binary.BigEndian.Uint32(frame[len(frame)-checksumLength:])
+	if crc32.Checksum(payload, crc32cTable) != expected {
+		return nil, newDecodeError("checksum", ErrChecksumMismatch)
+	}
+	return payload, nil
+}
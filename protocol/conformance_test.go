@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden test vectors from the current encoder")
+
+const conformanceFile = "conformance.json"
+
+// testVector is a golden frame with the packet it carries, Body is kept as
+// hex since it is not part of the json form of a Packet.
+type testVector struct {
+	Name     string `json:"name"`
+	Codec    string `json:"codec"`
+	Checksum bool   `json:"checksum"`
+	Frame    string `json:"frame"`
+	Packet   Packet `json:"packet"`
+	Body     string `json:"body"`
+}
+
+// conformancePackets are encoded with every codec into the golden vectors.
+// ExtData holds at most one entry, the order of the entries on the wire
+// follows the map iteration order.
+var conformancePackets = []struct {
+	name   string
+	packet Packet
+}{
+	{"empty", Packet{Code: 0, Language: Golang}},
+	{"request", Packet{Code: 1, Language: Golang, PacketId: 1, Body: []byte("thunder")}},
+	{"response", Packet{Code: 200, Language: Golang, Version: 1, PacketId: 2, Flag: ResponseType, Message: "ok"}},
+	{"oneway", Packet{Code: 3, Language: Golang, PacketId: 3, Flag: RPCOneWay, ExtData: map[string]string{"topic": "news"}, Body: []byte{0, 1, 2, 3}}},
+	{"negative", Packet{Code: -1, Language: Golang, Version: -1, PacketId: -1, Flag: -1, Message: "max"}},
+	{"unicode", Packet{Code: 404, Language: Golang, PacketId: 1 << 30, Flag: ResponseType, Message: "雷 thunder", ExtData: map[string]string{"key": "值"}}},
+}
+
+func generateVectors(t *testing.T) []testVector {
+	var vectors []testVector
+	for _, ct := range codecTypes {
+		for _, checksum := range []bool{false, true} {
+			for _, c := range conformancePackets {
+				p := c.packet
+				withCodecType(ct.codec, func() {
+					name := ct.name + "/" + c.name
+					if checksum {
+						name += "/checksum"
+					}
+					vectors = append(vectors, testVector{
+						Name:     name,
+						Codec:    ct.name,
+						Checksum: checksum,
+						Frame:    hex.EncodeToString(encodeWith(t, &p, checksum)),
+						Packet:   p,
+						Body:     hex.EncodeToString(p.Body),
+					})
+				})
+			}
+		}
+	}
+	return vectors
+}
+
+func loadVectors(t *testing.T) []testVector {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", conformanceFile))
+	if err != nil {
+		t.Fatalf("read test vectors error: %v", err)
+	}
+	var vectors []testVector
+	if err = json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("unmarshal test vectors error: %v", err)
+	}
+	return vectors
+}
+
+func TestConformance(t *testing.T) {
+	if *update {
+		data, err := json.MarshalIndent(generateVectors(t), "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join("testdata", conformanceFile), append(data, '\n'), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vectors := loadVectors(t)
+	if len(vectors) != len(codecTypes)*2*len(conformancePackets) {
+		t.Fatalf("%d test vectors in %s, run the test with -update to regenerate them", len(vectors), conformanceFile)
+	}
+	for _, v := range vectors {
+		v := v
+		t.Run(v.Name, func(t *testing.T) {
+			frame, err := hex.DecodeString(v.Frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := v.Packet
+			expected.Body, err = hex.DecodeString(v.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := Decode(frame)
+			if err != nil {
+				t.Fatalf("decode golden frame error: %v", err)
+			}
+			assertPacketEqual(t, &expected, decoded)
+
+			var codec byte
+			for _, ct := range codecTypes {
+				if ct.name == v.Codec {
+					codec = ct.codec
+				}
+			}
+			withCodecType(codec, func() {
+				encoded := hex.EncodeToString(encodeWith(t, &expected, v.Checksum))
+				if encoded != v.Frame {
+					t.Fatalf("frame on the wire changed\nexpected: %s\nactual:   %s", v.Frame, encoded)
+				}
+			})
+		})
+	}
+}
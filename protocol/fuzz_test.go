@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// The seed corpus of the fuzz targets is checked in under testdata/fuzz,
+// run them with e.g. go test -fuzz=FuzzDecode ./protocol
+
+func assertDecodeError(t *testing.T, err error) {
+	t.Helper()
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("error is not a *DecodeError: %v", err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	// an ext data key too long for THUNDER is fine in a JSON frame
+	p := NewPacket(1, nil, nil)
+	p.ExtData = map[string]string{strings.Repeat("k", 1<<15): "v"}
+	withCodecType(Json, func() {
+		frame, err := Encode(p)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(frame)
+	})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := Decode(data)
+		if err != nil {
+			assertDecodeError(t, err)
+			return
+		}
+
+		// a decoded packet must survive another round trip through the codec
+		// of its frame
+		var serializer Serializer = THUNDER
+		if data[0]&codecTypeMask == Json {
+			serializer = JSON
+		}
+		header, err := serializer.Marshal(p)
+		if err != nil {
+			t.Fatalf("marshal decoded packet error: %v", err)
+		}
+		decoded, err := serializer.UnMarshal(header)
+		if err != nil {
+			t.Fatalf("unmarshal re-encoded packet error: %v", err)
+		}
+		decoded.Body, decoded.Language = p.Body, p.Language
+		assertPacketEqual(t, p, decoded)
+	})
+}
+
+func FuzzJSONUnMarshal(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := JSON.UnMarshal(data)
+		if err != nil {
+			assertDecodeError(t, err)
+			return
+		}
+		if _, err = JSON.Marshal(p); err != nil {
+			t.Fatalf("marshal decoded packet error: %v", err)
+		}
+	})
+}
+
+func FuzzThunderUnMarshal(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := THUNDER.UnMarshal(data)
+		if err != nil {
+			assertDecodeError(t, err)
+			return
+		}
+
+		header, err := THUNDER.Marshal(p)
+		if err != nil {
+			t.Fatalf("marshal decoded packet error: %v", err)
+		}
+		decoded, err := THUNDER.UnMarshal(header)
+		if err != nil {
+			t.Fatalf("unmarshal re-encoded packet error: %v", err)
+		}
+		decoded.Language = p.Language
+		assertPacketEqual(t, p, decoded)
+	})
+}
@@ -20,11 +20,40 @@ type JSONSerializer struct {
 	jsoniter.API
 }
 
+// jsonHeaderSizeHint is about the length of a marshaled header without
+// Message and ExtData.
+const jsonHeaderSizeHint = 96
+
 func (j *JSONSerializer) Marshal(p *Packet) ([]byte, error) {
 	return j.API.Marshal(p)
 }
 
+// appendMarshal appends the header of the packet to dst, marshaling it with a
+// pooled stream instead of allocating the header.
+func (j *JSONSerializer) appendMarshal(dst []byte, p *Packet) ([]byte, error) {
+	stream := j.API.BorrowStream(nil)
+	defer j.API.ReturnStream(stream)
+	stream.WriteVal(p)
+	if stream.Error != nil {
+		return dst, stream.Error
+	}
+	return append(dst, stream.Buffer()...), nil
+}
+
 func (j *JSONSerializer) UnMarshal(bs []byte) (*Packet, error) {
 	p := new(Packet)
-	return p, j.API.Unmarshal(bs, p)
+	if err := j.unmarshalInto(p, bs, defaultDecodeLimits); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (j *JSONSerializer) unmarshalInto(p *Packet, bs []byte, limits *DecodeLimits) error {
+	if err := j.API.Unmarshal(bs, p); err != nil {
+		return newDecodeError("header", err)
+	}
+	if limits.MaxExtDataEntries > 0 && len(p.ExtData) > limits.MaxExtDataEntries {
+		return newDecodeError("extData", ErrLimitExceeded)
+	}
+	return nil
 }
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTruncated      = errors.New("truncated data")
+	ErrNegativeLength = errors.New("negative length")
+	ErrLimitExceeded  = errors.New("limit exceeded")
+	ErrUnknownCodec   = errors.New("unknown codec type")
+)
+
+// DecodeError is returned by Decode when a frame is malformed, Field names
+// the part of the frame which failed to decode.
+type DecodeError struct {
+	Field string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode %s error: %v", e.Field, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func newDecodeError(field string, err error) *DecodeError {
+	return &DecodeError{Field: field, Err: err}
+}
+
+// DecodeLimits bounds the lengths accepted from the wire, a frame exceeding
+// any of them is rejected before anything is allocated for it.
+type DecodeLimits struct {
+	MaxFrameSize      int32
+	MaxHeaderSize     int32
+	MaxExtDataEntries int
+	MaxBodySize       int32
+}
+
+var defaultDecodeLimits = NewDefaultDecodeLimits()
+
+func NewDefaultDecodeLimits() *DecodeLimits {
+	return &DecodeLimits{
+		MaxFrameSize:      16 << 20,
+		MaxHeaderSize:     1 << 20,
+		MaxExtDataEntries: 1024,
+		MaxBodySize:       16 << 20,
+	}
+}
+
+// checkLength validates a length read from the wire against the bytes
+// remaining in the buffer and the given limit, a limit <= 0 means unlimited.
+func checkLength(field string, length int64, remaining int, limit int64) error {
+	if length < 0 {
+		return newDecodeError(field, ErrNegativeLength)
+	}
+	if limit > 0 && length > limit {
+		return newDecodeError(field, ErrLimitExceeded)
+	}
+	if length > int64(remaining) {
+		return newDecodeError(field, ErrTruncated)
+	}
+	return nil
+}
@@ -1,15 +1,37 @@
 package protocol
 
 import (
-	"bytes"
 	"encoding/binary"
-	"fmt"
+	"strings"
 	"sync/atomic"
 )
 
 const (
-	RPCOneWay = 2
+	RPCOneWay    = 2
 	ResponseType = 1
+	// Heartbeat marks the control packets checking a connection is alive,
+	// they are answered by the transport and never reach the processors.
+	Heartbeat = 4
+	// Goodbye marks the control packet sent before closing an idle
+	// connection, the peer stops sending requests on it.
+	Goodbye = 8
+	// Register marks the control packet a client sends first on every
+	// connection to tell the server its identity.
+	Register = 16
+	// Subscribe and Unsubscribe mark the control packets a client sends to
+	// add and remove topic subscriptions on the connection.
+	Subscribe   = 32
+	Unsubscribe = 64
+	// Idempotent marks the requests which can be processed more than once,
+	// the client retries them even after they may have reached the server.
+	Idempotent = 128
+
+	// PublishCode is the code of the packets pushed by the server to the
+	// subscribers of a topic.
+	PublishCode int16 = -1
+	// PingCode is the code of the health probes, every server answers them
+	// with internal.Success.
+	PingCode int16 = -2
 )
 
 var (
@@ -30,6 +52,12 @@ type Packet struct {
 	Message  string            `json:"message"`
 	ExtData  map[string]string `json:"extData"`
 	Body     []byte            `json:"-"`
+
+	// buffer is the pooled buffer Body aliases, see DecodePooled
+	buffer   *Buffer
+	released int32
+	// pooled tells the packets acquired from the pool
+	pooled bool
 }
 
 func NewPacket(code int16, body []byte, header ExtData) *Packet {
@@ -104,6 +132,143 @@ func (p *Packet) MarkOneway() {
 	p.Flag = p.Flag | RPCOneWay
 }
 
+func (p *Packet) IsHeartbeat() bool {
+	return p.Flag&(Heartbeat) == Heartbeat
+}
+
+func (p *Packet) IsGoodbye() bool {
+	return p.Flag&(Goodbye) == Goodbye
+}
+
+// IsControl reports whether the packet is handled by the transport.
+func (p *Packet) IsControl() bool {
+	return p.Flag&(Heartbeat|Goodbye|Register|Subscribe|Unsubscribe) != 0
+}
+
+func (p *Packet) IsRegister() bool {
+	return p.Flag&(Register) == Register
+}
+
+func (p *Packet) IsSubscribe() bool {
+	return p.Flag&(Subscribe) == Subscribe
+}
+
+func (p *Packet) IsUnsubscribe() bool {
+	return p.Flag&(Unsubscribe) == Unsubscribe
+}
+
+func (p *Packet) IsIdempotent() bool {
+	return p.Flag&(Idempotent) == Idempotent
+}
+
+func (p *Packet) MarkIdempotent() {
+	p.Flag = p.Flag | Idempotent
+}
+
+// NewHeartbeat creates a heartbeat request, the peer answers it with the
+// packet returned by NewHeartbeatResponse.
+func NewHeartbeat() *Packet {
+	p := NewPacket(0, nil, nil)
+	p.Flag = Heartbeat
+	return p
+}
+
+func NewHeartbeatResponse(heartbeat *Packet) *Packet {
+	p := NewPacket(0, nil, nil)
+	p.PacketId = heartbeat.PacketId
+	p.Flag = Heartbeat | ResponseType
+	return p
+}
+
+func NewGoodbye() *Packet {
+	p := NewPacket(0, nil, nil)
+	p.Flag = Goodbye
+	return p
+}
+
+const (
+	registerClientId = "clientId"
+	registerGroup    = "group"
+	registerTag      = "tag."
+)
+
+// NewRegister creates the register packet of a client, its identity is
+// carried in ExtData.
+func NewRegister(clientId, group string, tags map[string]string) *Packet {
+	p := NewPacket(0, nil, nil)
+	p.Flag = Register
+	p.ExtData = make(map[string]string, len(tags)+2)
+	p.ExtData[registerClientId] = clientId
+	p.ExtData[registerGroup] = group
+	for key, value := range tags {
+		p.ExtData[registerTag+key] = value
+	}
+	return p
+}
+
+// ParseRegister returns the identity carried by a register packet.
+func ParseRegister(p *Packet) (clientId, group string, tags map[string]string) {
+	tags = make(map[string]string)
+	for key, value := range p.ExtData {
+		if strings.HasPrefix(key, registerTag) {
+			tags[strings.TrimPrefix(key, registerTag)] = value
+		}
+	}
+	return p.ExtData[registerClientId], p.ExtData[registerGroup], tags
+}
+
+const (
+	subscribeTopic = "topic."
+	publishTopic   = "topic"
+)
+
+// NewSubscribe creates the packet subscribing the connection it is sent on to
+// the topics.
+func NewSubscribe(topics ...string) *Packet {
+	return newTopicsPacket(Subscribe, topics)
+}
+
+// NewUnsubscribe creates the packet removing the subscriptions of the
+// connection it is sent on to the topics.
+func NewUnsubscribe(topics ...string) *Packet {
+	return newTopicsPacket(Unsubscribe, topics)
+}
+
+func newTopicsPacket(flag int32, topics []string) *Packet {
+	p := NewPacket(0, nil, nil)
+	p.Flag = flag
+	p.ExtData = make(map[string]string, len(topics))
+	for _, topic := range topics {
+		p.ExtData[subscribeTopic+topic] = ""
+	}
+	return p
+}
+
+// ParseTopics returns the topics of a subscribe or unsubscribe packet.
+func ParseTopics(p *Packet) []string {
+	topics := make([]string, 0, len(p.ExtData))
+	for key := range p.ExtData {
+		if strings.HasPrefix(key, subscribeTopic) {
+			topics = append(topics, strings.TrimPrefix(key, subscribeTopic))
+		}
+	}
+	return topics
+}
+
+// NewPublish creates the oneway packet pushing the body to the subscribers of
+// the topic.
+func NewPublish(topic string, body []byte) *Packet {
+	p := NewPacket(PublishCode, body, nil)
+	p.MarkOneway()
+	p.ExtData = map[string]string{publishTopic: topic}
+	return p
+}
+
+// TopicOf returns the topic of a packet created by NewPublish.
+func TopicOf(p *Packet) string {
+	return p.ExtData[publishTopic]
+}
+
 func MarkProtocolType(source int32) []byte {
 	result := make([]byte, 4)
 	result[0] = codecType
@@ -113,93 +278,149 @@ func MarkProtocolType(source int32) []byte {
 	return result
 }
 
+const frameHeadLength = 5
+
 func Encode(packet *Packet) ([]byte, error) {
-	var (
-		header []byte
-		err    error
-	)
+	return AppendEncode(make([]byte, 0, EncodedSizeHint(packet, false)), packet, false)
+}
 
+// EncodeWithChecksum encodes the packet like Encode and appends a CRC32C
+// checksum over the header and body, which Decode verifies.
+func EncodeWithChecksum(packet *Packet) ([]byte, error) {
+	return AppendEncode(make([]byte, 0, EncodedSizeHint(packet, true)), packet, true)
+}
+
+// EncodedSizeHint returns the length of the encoded frame of the packet, it is
+// exact for the thunder codec and an estimate for the json codec.
+func EncodedSizeHint(packet *Packet, checksum bool) int {
+	size := frameHeadLength + len(packet.Body)
 	switch codecType {
-	case Json:
-		header, err = JSON.Marshal(packet)
 	case Thunder:
-		header, err = THUNDER.Marshal(packet)
+		size += THUNDER.headerSize(packet)
+	default:
+		size += jsonHeaderSizeHint + len(packet.Message)
+		for key, value := range packet.ExtData {
+			size += len(key) + len(value) + 6
+		}
 	}
-
-	if err != nil {
-		return nil, err
+	if checksum {
+		size += checksumLength
 	}
+	return size
+}
 
-	frameSize := len(header) + len(packet.Body) + 4 + 1
-	buf := bytes.NewBuffer(make([]byte, frameSize))
-	buf.Reset()
-
-	err = binary.Write(buf, binary.BigEndian, codecType)
-	if err != nil {
-		return nil, err
+// AppendEncode appends the encoded frame of the packet to dst and returns the
+// extended buffer, nothing is allocated when dst has enough capacity, which
+// makes it suitable for pooled or reused buffers. On error dst is returned
+// unchanged.
+func AppendEncode(dst []byte, packet *Packet, checksum bool) ([]byte, error) {
+	checkNotReleased(packet)
+	start := len(dst)
+	frameCodecType := codecType
+	if checksum {
+		frameCodecType |= ChecksumFlag
 	}
+	// codec type, 1 byte and header length, 4 bytes
+	dst = append(dst, frameCodecType, 0, 0, 0, 0)
+	headerStart := len(dst)
 
-	headerLength := int32(len(header))
-	err = binary.Write(buf, binary.BigEndian, headerLength)
-	if err != nil {
-		return nil, err
+	var err error
+	switch codecType {
+	case Json:
+		dst, err = JSON.appendMarshal(dst, packet)
+	case Thunder:
+		dst, err = THUNDER.appendMarshal(dst, packet)
 	}
-
-	err = binary.Write(buf, binary.BigEndian, header)
 	if err != nil {
-		return nil, err
+		return dst[:start], err
 	}
+	binary.BigEndian.PutUint32(dst[headerStart-4:], uint32(len(dst)-headerStart))
 
-	err = binary.Write(buf, binary.BigEndian, packet.Body)
-	if err != nil {
-		return nil, err
+	dst = append(dst, packet.Body...)
+	if checksum {
+		dst = appendChecksum(dst, start)
 	}
-
-	return buf.Bytes(), nil
+	return dst, nil
 }
 
 func Decode(data []byte) (*Packet, error) {
-	buf := bytes.NewBuffer(data)
-	length := int32(len(data))
-	var headerLength int32
-	var codecTypeByte byte
-	err := binary.Read(buf, binary.BigEndian, &codecTypeByte)
-	if err != nil {
+	return decode(data, defaultDecodeLimits, false)
+}
+
+// DecodeWithLimits decodes a frame like Decode, validating every length read
+// from the wire against the remaining data and the given limits. Any error
+// returned is a *DecodeError.
+func DecodeWithLimits(data []byte, limits *DecodeLimits) (*Packet, error) {
+	return decode(data, limits, false)
+}
+
+// DecodeAliasBody decodes a frame like DecodeWithLimits but the Body of the
+// packet aliases data instead of being copied, so data must not be modified
+// or reused while the packet is in use.
+func DecodeAliasBody(data []byte, limits *DecodeLimits) (*Packet, error) {
+	return decode(data, limits, true)
+}
+
+func decode(data []byte, limits *DecodeLimits, aliasBody bool) (*Packet, error) {
+	packet := new(Packet)
+	if err := decodeInto(packet, data, limits, aliasBody); err != nil {
 		return nil, err
 	}
+	return packet, nil
+}
 
-	err = binary.Read(buf, binary.BigEndian, &headerLength)
-	if err != nil {
-		return nil, err
+func decodeInto(packet *Packet, data []byte, limits *DecodeLimits, aliasBody bool) error {
+	if limits == nil {
+		limits = defaultDecodeLimits
+	}
+	if err := checkLength("frame", int64(len(data)), len(data), int64(limits.MaxFrameSize)); err != nil {
+		return err
+	}
+
+	var err error
+	if HasChecksum(data) {
+		data, err = verifyChecksum(data)
+		if err != nil {
+			return err
+		}
 	}
+	if len(data) < frameHeadLength {
+		return newDecodeError("frame", ErrTruncated)
+	}
+	codecTypeByte := data[0] & codecTypeMask
+	headerLength := int32(binary.BigEndian.Uint32(data[1:frameHeadLength]))
+	data = data[frameHeadLength:]
 
-	headerData := make([]byte, headerLength)
-	err = binary.Read(buf, binary.BigEndian, &headerData)
+	err = checkLength("header", int64(headerLength), len(data), int64(limits.MaxHeaderSize))
 	if err != nil {
-		return nil, err
+		return err
 	}
+	headerData := data[:headerLength]
 
-	var packet *Packet
-	switch codecTypeByte{
+	switch codecTypeByte {
 	case Json:
-		packet, err = JSON.UnMarshal(headerData)
+		err = JSON.unmarshalInto(packet, headerData, limits)
 	case Thunder:
-		packet, err = THUNDER.UnMarshal(headerData)
+		err = THUNDER.unmarshalInto(packet, headerData, limits)
 	default:
-		err = fmt.Errorf("unknown codec type: %d", codecTypeByte)
+		err = newDecodeError("codec", ErrUnknownCodec)
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	bodyLength := length - 4 - 1 - headerLength
-	if bodyLength > 0 {
-		bodyData := make([]byte, bodyLength)
-		err = binary.Read(buf, binary.BigEndian, &bodyData)
+	bodyData := data[headerLength:]
+	if len(bodyData) > 0 {
+		err = checkLength("body", int64(len(bodyData)), len(bodyData), int64(limits.MaxBodySize))
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if aliasBody {
+			packet.Body = bodyData[:len(bodyData):len(bodyData)]
+		} else {
+			packet.Body = make([]byte, len(bodyData))
+			copy(packet.Body, bodyData)
 		}
-		packet.Body = bodyData
 	}
-	return packet, nil
+	return nil
 }
@@ -0,0 +1,232 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+var codecTypes = []struct {
+	name  string
+	codec byte
+}{
+	{"json", Json},
+	{"thunder", Thunder},
+}
+
+// withCodecType switches the codec used by Encode for the duration of f.
+func withCodecType(codec byte, f func()) {
+	origin := codecType
+	codecType = codec
+	defer func() {
+		codecType = origin
+	}()
+	f()
+}
+
+func encodeWith(t testing.TB, p *Packet, checksum bool) []byte {
+	t.Helper()
+	var (
+		data []byte
+		err  error
+	)
+	if checksum {
+		data, err = EncodeWithChecksum(p)
+	} else {
+		data, err = Encode(p)
+	}
+	if err != nil {
+		t.Fatalf("encode packet error: %v", err)
+	}
+	return data
+}
+
+// assertPacketEqual compares the packets ignoring the difference between nil
+// and empty ExtData and Body, which are not distinguished on the wire.
+func assertPacketEqual(t testing.TB, expected, actual *Packet) {
+	t.Helper()
+	e, a := *expected, *actual
+	if len(e.ExtData) == 0 {
+		e.ExtData = nil
+	}
+	if len(a.ExtData) == 0 {
+		a.ExtData = nil
+	}
+	if len(e.Body) == 0 {
+		e.Body = nil
+	}
+	if len(a.Body) == 0 {
+		a.Body = nil
+	}
+	if !reflect.DeepEqual(e, a) {
+		t.Fatalf("packet mismatch\nexpected: %+v\nactual:   %+v", e, a)
+	}
+}
+
+func randomString(r *rand.Rand, maxLen int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:/ "
+	b := make([]byte, r.Intn(maxLen+1))
+	for i := range b {
+		b[i] = letters[r.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+func randomPacket(r *rand.Rand, bodySize int) *Packet {
+	p := &Packet{
+		Code:     int16(r.Intn(1 << 16)),
+		Language: Golang,
+		Version:  int16(r.Intn(1 << 16)),
+		PacketId: r.Int31() - r.Int31(),
+		Message:  randomString(r, 64),
+	}
+	if n := r.Intn(16); n > 0 {
+		p.ExtData = make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			p.ExtData[randomString(r, 32)] = randomString(r, 128)
+		}
+	}
+	if bodySize > 0 {
+		p.Body = make([]byte, bodySize)
+		r.Read(p.Body)
+	}
+	return p
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	bodySizes := []int{0, 1, 1024, 1 << 20}
+	flags := []int32{0, ResponseType, RPCOneWay, ResponseType | RPCOneWay}
+	for _, ct := range codecTypes {
+		for _, checksum := range []bool{false, true} {
+			for _, flag := range flags {
+				for _, bodySize := range bodySizes {
+					name := ct.name + "/checksum=" + strconv.FormatBool(checksum) +
+						"/flag=" + strconv.Itoa(int(flag)) + "/body=" + strconv.Itoa(bodySize)
+					t.Run(name, func(t *testing.T) {
+						withCodecType(ct.codec, func() {
+							for i := 0; i < 20; i++ {
+								p := randomPacket(r, bodySize)
+								p.Flag = flag
+								data := encodeWith(t, p, checksum)
+								if HasChecksum(data) != checksum {
+									t.Fatalf("checksum flag is %t, expected %t", HasChecksum(data), checksum)
+								}
+								decoded, err := Decode(data)
+								if err != nil {
+									t.Fatalf("decode packet error: %v", err)
+								}
+								assertPacketEqual(t, p, decoded)
+								if decoded.IsResponseType() != (flag&ResponseType != 0) || decoded.IsOneway() != (flag&RPCOneWay != 0) {
+									t.Fatalf("flag mismatch, expected %d, actual %d", flag, decoded.Flag)
+								}
+							}
+						})
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeChecksumMismatch(t *testing.T) {
+	for _, ct := range codecTypes {
+		withCodecType(ct.codec, func() {
+			data := encodeWith(t, NewPacket(1, []byte("thunder"), nil), true)
+			for i := range data {
+				corrupted := append([]byte(nil), data...)
+				corrupted[i] ^= 0x01
+				_, err := Decode(corrupted)
+				if err == nil {
+					t.Fatalf("%s: decode corrupted frame at byte %d succeeded", ct.name, i)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	p := NewPacket(1, bytes.Repeat([]byte{1}, 64), nil)
+	p.ExtData = map[string]string{"a": "1", "b": "2", "c": "3"}
+	cases := []struct {
+		name   string
+		limits DecodeLimits
+		field  string
+	}{
+		{"frame", DecodeLimits{MaxFrameSize: 32}, "frame"},
+		{"header", DecodeLimits{MaxHeaderSize: 8}, "header"},
+		{"extData", DecodeLimits{MaxExtDataEntries: 2}, "extData"},
+		{"body", DecodeLimits{MaxBodySize: 63}, "body"},
+	}
+	for _, ct := range codecTypes {
+		withCodecType(ct.codec, func() {
+			data := encodeWith(t, p, false)
+			for _, c := range cases {
+				_, err := DecodeWithLimits(data, &c.limits)
+				decodeErr, ok := err.(*DecodeError)
+				if !ok || decodeErr.Field != c.field || decodeErr.Err != ErrLimitExceeded {
+					t.Fatalf("%s/%s: unexpected error: %v", ct.name, c.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	p := NewPacket(1, []byte("thunder"), nil)
+	p.Message = "message"
+	p.ExtData = map[string]string{"key": "value"}
+	for _, ct := range codecTypes {
+		withCodecType(ct.codec, func() {
+			data := encodeWith(t, p, false)
+			headerEnd := 5 + int(binary.BigEndian.Uint32(data[1:5]))
+			for i := 0; i < headerEnd; i++ {
+				if _, err := Decode(data[:i]); err == nil {
+					t.Fatalf("%s: decode frame truncated to %d bytes succeeded", ct.name, i)
+				}
+			}
+		})
+	}
+}
+
+func TestAppendEncode(t *testing.T) {
+	p := NewPacket(1, []byte("thunder"), nil)
+	p.ExtData = map[string]string{"key": "value"}
+	prefix := []byte("prefix")
+	for _, ct := range codecTypes {
+		withCodecType(ct.codec, func() {
+			for _, checksum := range []bool{false, true} {
+				expected := encodeWith(t, p, checksum)
+				data, err := AppendEncode(append([]byte(nil), prefix...), p, checksum)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data[:len(prefix)], prefix) || !bytes.Equal(data[len(prefix):], expected) {
+					t.Fatalf("%s: appended frame mismatch\nexpected: %x\nactual:   %x", ct.name, expected, data[len(prefix):])
+				}
+				if ct.codec == Thunder && len(expected) != EncodedSizeHint(p, checksum) {
+					t.Fatalf("size hint %d, encoded %d", EncodedSizeHint(p, checksum), len(expected))
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeAliasBody(t *testing.T) {
+	data := encodeWith(t, NewPacket(1, []byte("thunder"), nil), false)
+	copied, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliased, err := DecodeAliasBody(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] = 'R'
+	if string(copied.Body) != "thunder" || string(aliased.Body) != "thundeR" {
+		t.Fatalf("unexpected bodies, copied: %s, aliased: %s", copied.Body, aliased.Body)
+	}
+}
@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// maxPooledBufferSize keeps buffers grown by huge frames out of the pool.
+	maxPooledBufferSize = 64 << 10
+	defaultBufferSize   = 512
+
+	poisonCode = int16(-0x2222)
+	poisonByte = byte(0xdd)
+)
+
+var (
+	packetPool = sync.Pool{
+		New: func() interface{} {
+			return new(Packet)
+		},
+	}
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			return &Buffer{B: make([]byte, 0, defaultBufferSize)}
+		},
+	}
+
+	poolDebug int32
+)
+
+// EnablePoolDebug switches the debug mode of the pools. In debug mode a
+// released packet or buffer is poisoned and never reused, so a use after
+// release reads garbage instead of another request's data, and encoding or
+// releasing it again panics.
+func EnablePoolDebug(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&poolDebug, 1)
+	} else {
+		atomic.StoreInt32(&poolDebug, 0)
+	}
+}
+
+func poolDebugEnabled() bool {
+	return atomic.LoadInt32(&poolDebug) == 1
+}
+
+// Buffer is a pooled byte buffer, B holds the data.
+type Buffer struct {
+	B        []byte
+	released int32
+}
+
+// AcquireBuffer returns an empty buffer from the pool, it should be given back
+// with Release once B is not referenced anymore.
+func AcquireBuffer() *Buffer {
+	b := bufferPool.Get().(*Buffer)
+	atomic.StoreInt32(&b.released, 0)
+	return b
+}
+
+// Release gives the buffer back to the pool, the buffer and B must not be
+// used after it.
+func (b *Buffer) Release() {
+	if !atomic.CompareAndSwapInt32(&b.released, 0, 1) {
+		panic("thunder: buffer released twice")
+	}
+	if poolDebugEnabled() {
+		for i := range b.B {
+			b.B[i] = poisonByte
+		}
+		return
+	}
+	if cap(b.B) > maxPooledBufferSize {
+		return
+	}
+	b.B = b.B[:0]
+	bufferPool.Put(b)
+}
+
+// AcquirePacket returns a packet from the pool initialized like NewPacket, it
+// should be given back with Release once it is not used anymore.
+func AcquirePacket(code int16, body []byte, header ExtData) *Packet {
+	p := acquirePacket()
+	p.Code = code
+	p.Language = Golang
+	p.PacketId = atomic.AddInt32(&packetIdGenerator, 1)
+	p.Body = body
+	if header != nil {
+		for k, v := range header.EncodeToMap() {
+			if p.ExtData == nil {
+				p.ExtData = make(map[string]string)
+			}
+			p.ExtData[k] = v
+		}
+	}
+	return p
+}
+
+func acquirePacket() *Packet {
+	p := packetPool.Get().(*Packet)
+	atomic.StoreInt32(&p.released, 0)
+	p.pooled = true
+	return p
+}
+
+// Release gives the packet back to the pool together with the pooled buffer
+// its Body was decoded into, if any. The packet must not be used after it. It
+// does nothing to a packet which was not acquired from the pool.
+func (p *Packet) Release() {
+	if !p.pooled {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&p.released, 0, 1) {
+		panic("thunder: packet released twice")
+	}
+	if p.buffer != nil {
+		p.buffer.Release()
+	}
+	if poolDebugEnabled() {
+		p.Code, p.PacketId, p.Flag = poisonCode, 0, 0
+		p.Message = "released packet"
+		p.ExtData, p.Body, p.buffer = nil, nil, nil
+		return
+	}
+
+	extData := p.ExtData
+	for k := range extData {
+		delete(extData, k)
+	}
+	*p = Packet{ExtData: extData, released: 1, pooled: true}
+	packetPool.Put(p)
+}
+
+// IsPooled reports whether the packet was acquired from the pool, by
+// AcquirePacket or DecodePooled.
+func (p *Packet) IsPooled() bool {
+	return p.pooled
+}
+
+// IsReleased reports whether the packet was given back to its pool.
+func (p *Packet) IsReleased() bool {
+	return atomic.LoadInt32(&p.released) == 1
+}
+
+func checkNotReleased(p *Packet) {
+	if p.IsReleased() {
+		panic("thunder: use of released packet")
+	}
+}
+
+// DecodePooled decodes a frame like DecodeAliasBody into a packet acquired
+// from the pool. If owner is not nil, it is the pooled buffer holding data and
+// it is released together with the packet; on error the caller keeps it.
+func DecodePooled(data []byte, owner *Buffer, limits *DecodeLimits) (*Packet, error) {
+	p := acquirePacket()
+	if err := decodeInto(p, data, limits, true); err != nil {
+		p.Release()
+		return nil, err
+	}
+	p.buffer = owner
+	return p, nil
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func assertPanics(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("%s does not panic", name)
+		}
+	}()
+	f()
+}
+
+func TestPacketRelease(t *testing.T) {
+	p := AcquirePacket(1, []byte("thunder"), nil)
+	if !p.IsPooled() || NewPacket(1, nil, nil).IsPooled() {
+		t.Fatal("pooled packets are not told from the others")
+	}
+	p.ExtData = map[string]string{"key": "value"}
+	p.Release()
+	if !p.IsReleased() {
+		t.Fatal("packet is not marked released")
+	}
+	assertPanics(t, "double release", p.Release)
+	assertPanics(t, "encode after release", func() {
+		_, _ = Encode(p)
+	})
+
+	reused := AcquirePacket(2, nil, nil)
+	if reused.IsReleased() || len(reused.ExtData) != 0 || reused.Body != nil || reused.Code != 2 {
+		t.Fatalf("acquired packet is not reset: %+v", reused)
+	}
+	reused.Release()
+
+	// a packet which is not from the pool is not put into it
+	np := NewPacket(1, nil, nil)
+	np.Release()
+	np.Release()
+	if np.IsReleased() {
+		t.Fatal("packet not from the pool is released")
+	}
+}
+
+func TestDecodePooled(t *testing.T) {
+	data := encodeWith(t, NewPacket(1, []byte("thunder"), nil), false)
+	buf := AcquireBuffer()
+	buf.B = append(buf.B, data...)
+
+	p, err := DecodePooled(buf.B, buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Body) != "thunder" {
+		t.Fatalf("unexpected body: %s", p.Body)
+	}
+	p.Release()
+	assertPanics(t, "release the buffer owned by a released packet", buf.Release)
+
+	buf = AcquireBuffer()
+	buf.B = append(buf.B, data[:3]...)
+	if _, err = DecodePooled(buf.B, buf, nil); err == nil {
+		t.Fatal("decode truncated frame succeeded")
+	}
+	buf.Release()
+}
+
+func TestPoolDebug(t *testing.T) {
+	EnablePoolDebug(true)
+	defer EnablePoolDebug(false)
+
+	data := encodeWith(t, NewPacket(1, []byte("thunder"), nil), false)
+	buf := AcquireBuffer()
+	buf.B = append(buf.B, data...)
+	p, err := DecodePooled(buf.B, buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := p.Body
+	p.Release()
+
+	if p.Code != poisonCode || p.Body != nil {
+		t.Fatalf("released packet is not poisoned: %+v", p)
+	}
+	for _, b := range body {
+		if b != poisonByte {
+			t.Fatalf("released body is not poisoned: %x", body)
+		}
+	}
+	if next := AcquirePacket(1, nil, nil); next == p {
+		t.Fatal("released packet is reused in debug mode")
+	}
+}
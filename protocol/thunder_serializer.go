@@ -1,8 +1,9 @@
 package protocol
 
 import (
-	"bytes"
 	"encoding/binary"
+	"fmt"
+	"math"
 )
 
 const (
@@ -21,209 +22,142 @@ type ThunderSerializer struct {
 }
 
 func (t *ThunderSerializer) Marshal(p *Packet) ([]byte, error) {
-	extBytes, err := t.encodeMaps(p.ExtData)
-	if err != nil {
-		return nil, err
-	}
-
-	buf := bytes.NewBuffer(make([]byte, headerFixedLength+len(p.Message)+len(extBytes)))
-	buf.Reset()
+	return t.appendMarshal(make([]byte, 0, t.headerSize(p)), p)
+}
 
-	// Packet.Code, 4 bytes
-	err = binary.Write(buf, binary.BigEndian, int16(p.Code))
-	if err != nil {
-		return nil, err
+// headerSize returns the exact length of the marshaled header of the packet.
+func (t *ThunderSerializer) headerSize(p *Packet) int {
+	size := headerFixedLength + len(p.Message)
+	for key, value := range p.ExtData {
+		size += 2 + len(key) + 4 + len(value)
 	}
+	return size
+}
 
+// appendMarshal appends the header of the packet to dst without any
+// intermediate buffer.
+func (t *ThunderSerializer) appendMarshal(dst []byte, p *Packet) ([]byte, error) {
+	// Packet.Code, 2 bytes
+	dst = appendUint16(dst, uint16(p.Code))
 	// Packet.Language, 1 byte
-	err = binary.Write(buf, binary.BigEndian, Golang)
-	if err != nil {
-		return nil, err
-	}
-
+	dst = append(dst, byte(Golang))
 	// Packet.Version, 2 bytes
-	err = binary.Write(buf, binary.BigEndian, int16(p.Version))
-	if err != nil {
-		return nil, err
-	}
-
+	dst = appendUint16(dst, uint16(p.Version))
 	// Packet.PacketId, 4 bytes
-	err = binary.Write(buf, binary.BigEndian, p.PacketId)
-	if err != nil {
-		return nil, err
-	}
-
-	// Packet.Flag,4 bytes
-	err = binary.Write(buf, binary.BigEndian, p.Flag)
-	if err != nil {
-		return nil, err
-	}
-
-	// Packet.Message, 4 bytes
-	err = binary.Write(buf, binary.BigEndian, int32(len(p.Message)))
-	if err != nil {
-		return nil, err
-	}
-
-	// Packet.Message, len(command.Message) bytes
-	if len(p.Message) > 0 {
-		err = binary.Write(buf, binary.BigEndian, []byte(p.Message))
-		if err != nil {
-			return nil, err
+	dst = appendUint32(dst, uint32(p.PacketId))
+	// Packet.Flag, 4 bytes
+	dst = appendUint32(dst, uint32(p.Flag))
+
+	// Packet.Message, 4 bytes length and len(p.Message) bytes
+	dst = appendUint32(dst, uint32(len(p.Message)))
+	dst = append(dst, p.Message...)
+
+	// Packet.ExtData, 4 bytes length and the entries
+	lengthOffset := len(dst)
+	dst = appendUint32(dst, 0)
+	for key, value := range p.ExtData {
+		if len(key) > math.MaxInt16 {
+			return nil, fmt.Errorf("extData key is too long: %d", len(key))
 		}
+		dst = appendUint16(dst, uint16(len(key)))
+		dst = append(dst, key...)
+		dst = appendUint32(dst, uint32(len(value)))
+		dst = append(dst, value...)
 	}
+	binary.BigEndian.PutUint32(dst[lengthOffset:], uint32(len(dst)-lengthOffset-4))
 
-	// Packet.ExtData
-	err = binary.Write(buf, binary.BigEndian, int32(len(extBytes)))
-	if err != nil {
-		return nil, err
-	}
+	return dst, nil
+}
 
-	if len(extBytes) > 0 {
-		err = binary.Write(buf, binary.BigEndian, extBytes)
-		if err != nil {
-			return nil, err
-		}
-	}
+func appendUint16(dst []byte, v uint16) []byte {
+	return append(dst, byte(v>>8), byte(v))
+}
 
-	return buf.Bytes(), nil
+func appendUint32(dst []byte, v uint32) []byte {
+	return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
 }
 
 func (t *ThunderSerializer) UnMarshal(data []byte) (*Packet, error) {
-	var err error
-	packet := &Packet{}
-	buf := bytes.NewBuffer(data)
-	var code int16
-	err = binary.Read(buf, binary.BigEndian, &code)
-	if err != nil {
+	packet := new(Packet)
+	if err := t.unmarshalInto(packet, data, defaultDecodeLimits); err != nil {
 		return nil, err
 	}
-	packet.Code = code
-
-	var (
-		languageCode byte
-		remarkLen    int32
-		extFieldsLen int32
-	)
-	err = binary.Read(buf, binary.BigEndian, &languageCode)
-	if err != nil {
-		return nil, err
-	}
-	packet.Language = LanguageCode(languageCode)
-
-	var version int16
-	err = binary.Read(buf, binary.BigEndian, &version)
-	if err != nil {
-		return nil, err
-	}
-	packet.Version = version
+	return packet, nil
+}
 
-	// int opaque
-	err = binary.Read(buf, binary.BigEndian, &packet.PacketId)
-	if err != nil {
-		return nil, err
+func (t *ThunderSerializer) unmarshalInto(packet *Packet, data []byte, limits *DecodeLimits) error {
+	if len(data) < headerFixedLength {
+		return newDecodeError("header", ErrTruncated)
 	}
+	// Packet.Code, 2 bytes
+	packet.Code = int16(binary.BigEndian.Uint16(data[0:2]))
+	// Packet.Language, 1 byte
+	packet.Language = LanguageCode(data[2])
+	// Packet.Version, 2 bytes
+	packet.Version = int16(binary.BigEndian.Uint16(data[3:5]))
+	// Packet.PacketId, 4 bytes
+	packet.PacketId = int32(binary.BigEndian.Uint32(data[5:9]))
+	// Packet.Flag, 4 bytes
+	packet.Flag = int32(binary.BigEndian.Uint32(data[9:13]))
+	data = data[13:]
 
-	// int flag
-	err = binary.Read(buf, binary.BigEndian, &packet.Flag)
+	// Packet.Message
+	remark, data, err := readLengthPrefixed(data, "message", 4)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	// String remark
-	err = binary.Read(buf, binary.BigEndian, &remarkLen)
-	if err != nil {
-		return nil, err
+	if len(remark) > 0 {
+		packet.Message = string(remark)
 	}
 
-	if remarkLen > 0 {
-		var remarkData = make([]byte, remarkLen)
-		err = binary.Read(buf, binary.BigEndian, &remarkData)
-		if err != nil {
-			return nil, err
-		}
-		packet.Message = string(remarkData)
-	}
-
-	err = binary.Read(buf, binary.BigEndian, &extFieldsLen)
+	// Packet.ExtData
+	extFieldsData, _, err := readLengthPrefixed(data, "extData", 4)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if extFieldsLen > 0 {
-		extFieldsData := make([]byte, extFieldsLen)
-		err = binary.Read(buf, binary.BigEndian, &extFieldsData)
-		if err != nil {
-			return nil, err
+	if len(extFieldsData) > 0 {
+		if packet.ExtData == nil {
+			packet.ExtData = make(map[string]string)
 		}
-
-		packet.ExtData = make(map[string]string)
-		buf := bytes.NewBuffer(extFieldsData)
-		var (
-			kLen int16
-			vLen int32
-		)
-		for buf.Len() > 0 {
-			err = binary.Read(buf, binary.BigEndian, &kLen)
-			if err != nil {
-				return nil, err
+		var key, value []byte
+		for len(extFieldsData) > 0 {
+			if limits.MaxExtDataEntries > 0 && len(packet.ExtData) >= limits.MaxExtDataEntries {
+				return newDecodeError("extData", ErrLimitExceeded)
 			}
 
-			key, err := getExtFieldsData(buf, int32(kLen))
+			key, extFieldsData, err = readLengthPrefixed(extFieldsData, "extData key", 2)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
-			err = binary.Read(buf, binary.BigEndian, &vLen)
+			value, extFieldsData, err = readLengthPrefixed(extFieldsData, "extData value", 4)
 			if err != nil {
-				return nil, err
+				return err
 			}
-
-			value, err := getExtFieldsData(buf, vLen)
-			if err != nil {
-				return nil, err
-			}
-			packet.ExtData[key] = value
+			packet.ExtData[string(key)] = string(value)
 		}
 	}
 
-	return packet, nil
+	return nil
 }
 
-func (t *ThunderSerializer) encodeMaps(maps map[string]string) ([]byte, error) {
-	if maps == nil || len(maps) == 0 {
-		return []byte{}, nil
+// readLengthPrefixed reads a field prefixed with its big endian length of
+// lengthSize bytes, it returns the field and the data following it.
+func readLengthPrefixed(data []byte, field string, lengthSize int) ([]byte, []byte, error) {
+	if len(data) < lengthSize {
+		return nil, nil, newDecodeError(field, ErrTruncated)
 	}
-	extFieldsBuf := bytes.NewBuffer([]byte{})
-	var err error
-	for key, value := range maps {
-		err = binary.Write(extFieldsBuf, binary.BigEndian, int16(len(key)))
-		if err != nil {
-			return nil, err
-		}
-		err = binary.Write(extFieldsBuf, binary.BigEndian, []byte(key))
-		if err != nil {
-			return nil, err
-		}
-
-		err = binary.Write(extFieldsBuf, binary.BigEndian, int32(len(value)))
-		if err != nil {
-			return nil, err
-		}
-		err = binary.Write(extFieldsBuf, binary.BigEndian, []byte(value))
-		if err != nil {
-			return nil, err
-		}
+	var length int64
+	switch lengthSize {
+	case 2:
+		length = int64(int16(binary.BigEndian.Uint16(data)))
+	default:
+		length = int64(int32(binary.BigEndian.Uint32(data)))
 	}
-	return extFieldsBuf.Bytes(), nil
-}
-
-func getExtFieldsData(buff *bytes.Buffer, length int32) (string, error) {
-	var data = make([]byte, length)
-	err := binary.Read(buff, binary.BigEndian, &data)
-	if err != nil {
-		return "", err
+	data = data[lengthSize:]
+	if err := checkLength(field, length, len(data), 0); err != nil {
+		return nil, nil, err
 	}
-
-	return string(data), nil
+	return data[:length], data[length:], nil
 }
@@ -0,0 +1,265 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/internal/logging"
+	tnet "thunder/net"
+	"thunder/protocol"
+	"time"
+)
+
+// WatchFunc is passed the snapshots of a watched service as it changes.
+type WatchFunc func(s *Service)
+
+type instanceKey struct {
+	service string
+	addr    string
+}
+
+// watch holds the listeners of a service, guarded by the lock of the client,
+// and the last snapshot passed to them. Its lock serializes the calls of the
+// listeners so they see the revisions in order.
+type watch struct {
+	listeners map[int]WatchFunc
+
+	lock     sync.Mutex
+	revision int64
+	latest   *Service
+}
+
+// Client registers instances to a registry and looks services up in it.
+type Client struct {
+	client         *tnet.RPCClient
+	addr           net.Addr
+	registryConfig *config.RegistryConfig
+	logger         logging.Logger
+
+	lock      sync.Mutex
+	instances map[instanceKey]Instance
+	renewing  bool
+	watches   map[string]*watch
+	nextId    int
+	// renewLock serializes the registrations, renewals and deregistrations,
+	// so none of them registers again an instance deregistered meanwhile
+	renewLock sync.Mutex
+}
+
+// NewClient creates a client of the registry at the address.
+func NewClient(addr net.Addr, clientConfig *config.ClientConfig, registryConfig *config.RegistryConfig) *Client {
+	c := &Client{
+		client:         tnet.NewRPCClient(clientConfig),
+		addr:           addr,
+		registryConfig: registryConfig,
+		logger:         registryConfig.Logger,
+		instances:      make(map[instanceKey]Instance),
+		watches:        make(map[string]*watch),
+	}
+	c.client.RegisterProcessor(protocol.PublishCode, c.processChange)
+	return c
+}
+
+// Register registers the instance and renews it every RenewInterval until it
+// is deregistered. An instance dropped by the registry, after it restarted
+// for instance, is registered again by the next renewal.
+func (c *Client) Register(ctx context.Context, i Instance, timeout time.Duration) error {
+	c.renewLock.Lock()
+	defer c.renewLock.Unlock()
+	if err := c.register(ctx, []Instance{i}, timeout); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.instances[instanceKey{service: i.Service, addr: i.Addr}] = i
+	if !c.renewing {
+		c.renewing = true
+		go c.renew()
+	}
+	return nil
+}
+
+func (c *Client) Deregister(ctx context.Context, service, addr string, timeout time.Duration) error {
+	c.renewLock.Lock()
+	defer c.renewLock.Unlock()
+	c.lock.Lock()
+	delete(c.instances, instanceKey{service: service, addr: addr})
+	c.lock.Unlock()
+	p := protocol.NewPacket(CodeDeregister, nil, nil)
+	p.ExtData = map[string]string{keyService: service, keyAddr: addr}
+	_, err := c.invoke(ctx, p, timeout)
+	return err
+}
+
+func (c *Client) register(ctx context.Context, instances []Instance, timeout time.Duration) error {
+	body, err := protocol.JSON.API.Marshal(instances)
+	if err != nil {
+		return err
+	}
+	_, err = c.invoke(ctx, protocol.NewPacket(CodeRegister, body, nil), timeout)
+	return err
+}
+
+// renew renews the registered instances until there are none left.
+func (c *Client) renew() {
+	ticker := time.NewTicker(c.registryConfig.RenewInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !c.renewOnce() {
+			return
+		}
+	}
+}
+
+// renewOnce registers the instances again, it returns false once there are
+// none left.
+func (c *Client) renewOnce() bool {
+	c.renewLock.Lock()
+	defer c.renewLock.Unlock()
+	c.lock.Lock()
+	instances := make([]Instance, 0, len(c.instances))
+	for _, i := range c.instances {
+		instances = append(instances, i)
+	}
+	if len(instances) == 0 {
+		c.renewing = false
+		c.lock.Unlock()
+		return false
+	}
+	c.lock.Unlock()
+	if err := c.register(context.Background(), instances, c.registryConfig.RenewInterval); err != nil {
+		c.logger.Warnf("renew instances error, addr: %s, err: %v", c.addr.String(), err)
+	}
+	return true
+}
+
+// Query returns the current snapshot of the service.
+func (c *Client) Query(ctx context.Context, service string, timeout time.Duration) (*Service, error) {
+	p := protocol.NewPacket(CodeQuery, nil, nil)
+	p.ExtData = map[string]string{keyService: service}
+	resp, err := c.invoke(ctx, p, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{}
+	if err = protocol.JSON.API.Unmarshal(resp.Body, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Watch returns the current snapshot of the service and passes the later ones
+// to the listener as the service changes, until Unwatch. A service can be
+// watched by several listeners.
+func (c *Client) Watch(ctx context.Context, service string, listener WatchFunc, timeout time.Duration) (*Service, error) {
+	s, _, err := c.watch(ctx, service, listener, timeout)
+	return s, err
+}
+
+// watch adds the listener to the watch of the service, the returned function
+// removes it.
+func (c *Client) watch(ctx context.Context, service string, listener WatchFunc, timeout time.Duration) (*Service, func(), error) {
+	c.lock.Lock()
+	w, ok := c.watches[service]
+	if !ok {
+		w = &watch{listeners: make(map[int]WatchFunc)}
+		c.watches[service] = w
+	}
+	id := c.nextId
+	c.nextId++
+	w.listeners[id] = listener
+	c.lock.Unlock()
+	cancel := func() {
+		c.unwatch(service, w, id)
+	}
+
+	if err := c.client.Subscribe(ctx, c.addr, Topic(service)); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	s, err := c.Query(ctx, service, timeout)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	// a snapshot pushed meanwhile may be newer than the queried one
+	w.lock.Lock()
+	if s.Revision > w.revision {
+		w.revision, w.latest = s.Revision, s
+	} else if w.latest != nil {
+		s = w.latest
+	}
+	w.lock.Unlock()
+	return s, cancel, nil
+}
+
+// unwatch removes the listener, the service is unsubscribed from once it has
+// no listeners left.
+func (c *Client) unwatch(service string, w *watch, id int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(w.listeners, id)
+	if len(w.listeners) > 0 || c.watches[service] != w {
+		return
+	}
+	delete(c.watches, service)
+	// unsubscribing under the lock keeps it ordered with the subscription
+	// of a new watch of the service
+	if err := c.client.Unsubscribe(context.Background(), c.addr, Topic(service)); err != nil {
+		c.logger.Warnf("unsubscribe error, service: %s, err: %v", service, err)
+	}
+}
+
+// Unwatch removes all the listeners of the service.
+func (c *Client) Unwatch(ctx context.Context, service string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.watches, service)
+	return c.client.Unsubscribe(ctx, c.addr, Topic(service))
+}
+
+// invoke sends the request and turns an error response into an error.
+func (c *Client) invoke(ctx context.Context, p *protocol.Packet, timeout time.Duration) (*protocol.Packet, error) {
+	resp, err := c.client.InvokeSync(ctx, c.addr, p, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != internal.Success {
+		return nil, errors.New(resp.Message)
+	}
+	return resp, nil
+}
+
+// processChange passes a pushed snapshot to the listeners of the service,
+// unless it is older than the last one seen.
+func (c *Client) processChange(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+	s := &Service{}
+	if err := protocol.JSON.API.Unmarshal(p.Body, s); err != nil {
+		c.logger.Warnf("unmarshal service error, topic: %s, err: %v", protocol.TopicOf(p), err)
+		return nil
+	}
+	c.lock.Lock()
+	w, ok := c.watches[s.Name]
+	var listeners []WatchFunc
+	if ok {
+		for _, listener := range w.listeners {
+			listeners = append(listeners, listener)
+		}
+	}
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if s.Revision > w.revision {
+		w.revision, w.latest = s.Revision, s
+		for _, listener := range listeners {
+			listener(s)
+		}
+	}
+	return nil
+}
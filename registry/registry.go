@@ -0,0 +1,234 @@
+// Package registry is a name server built on thunder: service instances
+// register their address and renew it periodically, clients look the services
+// up by name and watch them for changes.
+//
+// The changes of a service are pushed to its watchers through the topic
+// subscriptions of the server, the topic of a service is returned by Topic.
+// A Resolver lets the clients invoke the services by name.
+package registry
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"thunder/config"
+	"thunder/internal"
+	"thunder/internal/logging"
+	"thunder/internal/timingwheel"
+	tnet "thunder/net"
+	"thunder/protocol"
+	"time"
+)
+
+// The codes of the registry requests, they are reserved on the servers and
+// clients of a registry.
+const (
+	CodeRegister   int16 = -200
+	CodeDeregister int16 = -201
+	CodeQuery      int16 = -202
+)
+
+// the ext data keys of the registry requests
+const (
+	keyService = "service"
+	keyAddr    = "addr"
+)
+
+// Instance is an instance of a service, identified by its service and address.
+type Instance struct {
+	Service  string            `json:"service"`
+	Addr     string            `json:"addr"`
+	Metadata map[string]string `json:"metadata"`
+	// Weight is the share of the traffic the instance asks for, relative to
+	// the other instances of the service.
+	Weight int `json:"weight"`
+}
+
+// Service is a snapshot of the instances of a service, a snapshot with a
+// greater revision is more recent.
+type Service struct {
+	Name      string     `json:"name"`
+	Revision  int64      `json:"revision"`
+	Instances []Instance `json:"instances"`
+}
+
+// Topic returns the topic the changes of the service are published to.
+func Topic(service string) string {
+	return "registry/" + service
+}
+
+type instance struct {
+	Instance
+	timer timingwheel.Timer
+}
+
+type service struct {
+	instances map[string]*instance
+}
+
+type Registry struct {
+	server         *tnet.RPCServer
+	registryConfig *config.RegistryConfig
+	logger         logging.Logger
+	wheel          *timingwheel.TimingWheel
+
+	lock     sync.Mutex
+	services map[string]*service
+	// revision orders the snapshots of all the services, it starts at the
+	// start time of the registry so it keeps increasing across restarts.
+	revision int64
+}
+
+// New registers the processors of the registry on the server.
+func New(server *tnet.RPCServer, registryConfig *config.RegistryConfig) *Registry {
+	r := &Registry{
+		server:         server,
+		registryConfig: registryConfig,
+		logger:         registryConfig.Logger,
+		wheel:          timingwheel.New(registryConfig.TimerTick, timingwheel.DefaultSlots),
+		services:       make(map[string]*service),
+		revision:       time.Now().UnixNano(),
+	}
+	server.RegisterProcessor(CodeRegister, r.processRegister)
+	server.RegisterProcessor(CodeDeregister, r.processDeregister)
+	server.RegisterProcessor(CodeQuery, r.processQuery)
+	return r
+}
+
+// Services returns the names of the services with instances.
+func (r *Registry) Services() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	names := make([]string, 0, len(r.services))
+	for name := range r.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Query returns the snapshot of the service.
+func (r *Registry) Query(name string) *Service {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.snapshot(name)
+}
+
+// register adds or renews the instance, the watchers are notified when it is
+// new or has changed.
+func (r *Registry) register(i Instance) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s, ok := r.services[i.Service]
+	if !ok {
+		s = &service{instances: make(map[string]*instance)}
+		r.services[i.Service] = s
+	}
+	previous, ok := s.instances[i.Addr]
+	changed := !ok || previous.Weight != i.Weight || !reflect.DeepEqual(previous.Metadata, i.Metadata)
+	if ok {
+		r.wheel.Stop(&previous.timer)
+	}
+	// a renewed instance replaces the previous one, so an expiry racing with
+	// the renewal finds it has been replaced
+	registered := &instance{Instance: i}
+	s.instances[i.Addr] = registered
+	r.wheel.Add(&registered.timer, r.registryConfig.InstanceTTL, func() {
+		go r.expire(registered)
+	})
+	if changed {
+		r.notify(i.Service)
+	}
+}
+
+func (r *Registry) deregister(name, addr string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if s, ok := r.services[name]; ok {
+		if i, ok := s.instances[addr]; ok {
+			r.wheel.Stop(&i.timer)
+			r.removeLocked(i)
+		}
+	}
+}
+
+// expire drops the instance which has not been renewed in time.
+func (r *Registry) expire(i *instance) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if s, ok := r.services[i.Service]; ok && s.instances[i.Addr] == i {
+		r.logger.Infof("registry instance expired, service: %s, addr: %s", i.Service, i.Addr)
+		r.removeLocked(i)
+	}
+}
+
+func (r *Registry) removeLocked(i *instance) {
+	s := r.services[i.Service]
+	delete(s.instances, i.Addr)
+	if len(s.instances) == 0 {
+		delete(r.services, i.Service)
+	}
+	r.notify(i.Service)
+}
+
+// notify publishes the snapshot of the changed service to its watchers.
+func (r *Registry) notify(name string) {
+	r.revision++
+	body, err := protocol.JSON.API.Marshal(r.snapshot(name))
+	if err != nil {
+		r.logger.Errorf("marshal service error, service: %s, err: %v", name, err)
+		return
+	}
+	r.server.Publish(Topic(name), body)
+}
+
+func (r *Registry) snapshot(name string) *Service {
+	snapshot := &Service{Name: name, Revision: r.revision, Instances: []Instance{}}
+	if s, ok := r.services[name]; ok {
+		for _, i := range s.instances {
+			snapshot.Instances = append(snapshot.Instances, i.Instance)
+		}
+	}
+	sort.Slice(snapshot.Instances, func(i, j int) bool {
+		return snapshot.Instances[i].Addr < snapshot.Instances[j].Addr
+	})
+	return snapshot
+}
+
+func newResponse(code int16, message string) *protocol.Packet {
+	p := protocol.NewPacket(code, nil, nil)
+	p.Message = message
+	return p
+}
+
+func (r *Registry) processRegister(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+	var instances []Instance
+	if err := protocol.JSON.API.Unmarshal(p.Body, &instances); err != nil {
+		return newResponse(internal.BadRequest, err.Error())
+	}
+	for _, i := range instances {
+		if i.Service == "" || i.Addr == "" {
+			return newResponse(internal.BadRequest, "missing service or addr")
+		}
+	}
+	for _, i := range instances {
+		r.register(i)
+	}
+	return newResponse(internal.Success, "")
+}
+
+func (r *Registry) processDeregister(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+	r.deregister(p.ExtData[keyService], p.ExtData[keyAddr])
+	return newResponse(internal.Success, "")
+}
+
+func (r *Registry) processQuery(p *protocol.Packet, addr net.Addr) *protocol.Packet {
+	body, err := protocol.JSON.API.Marshal(r.Query(p.ExtData[keyService]))
+	if err != nil {
+		return newResponse(internal.BadRequest, err.Error())
+	}
+	resp := newResponse(internal.Success, "")
+	resp.Body = body
+	return resp
+}
@@ -0,0 +1,212 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"github.com/panjf2000/gnet"
+	"net"
+	"testing"
+	"thunder/config"
+	tnet "thunder/net"
+	"thunder/protocol"
+	"time"
+)
+
+func startTestRegistry(t *testing.T, registryConfig *config.RegistryConfig) (*Registry, net.Addr) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	serverConfig := config.NewDefaultServerConfig(int32(port))
+	serverConfig.Addr = fmt.Sprintf("tcp://127.0.0.1:%d", port)
+	serverConfig.PrintBanner = false
+	s := tnet.NewRPCServer(serverConfig)
+	r := New(s, registryConfig)
+	go s.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = gnet.Stop(ctx, serverConfig.Addr)
+	})
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr.String()); err == nil {
+			_ = conn.Close()
+			return r, addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("registry is not listening on %s", addr.String())
+	return nil, nil
+}
+
+func addrsOf(s *Service) []string {
+	addrs := make([]string, 0, len(s.Instances))
+	for _, i := range s.Instances {
+		addrs = append(addrs, i.Addr)
+	}
+	return addrs
+}
+
+func TestRegistry(t *testing.T) {
+	registryConfig := config.NewDefaultRegistryConfig()
+	registryConfig.InstanceTTL = 300 * time.Millisecond
+	registryConfig.RenewInterval = 50 * time.Millisecond
+	r, addr := startTestRegistry(t, registryConfig)
+
+	provider := NewClient(addr, config.NewClientConfig(), registryConfig)
+	t.Cleanup(func() {
+		_ = provider.Deregister(context.Background(), "echo", "10.0.0.1:9003", time.Second)
+	})
+	err := provider.Register(context.Background(), Instance{Service: "echo", Addr: "10.0.0.1:9003", Weight: 1}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan *Service, 16)
+	watcher := NewClient(addr, config.NewClientConfig(), registryConfig)
+	t.Cleanup(func() {
+		_ = watcher.Unwatch(context.Background(), "echo")
+	})
+	s, err := watcher.Watch(context.Background(), "echo", func(s *Service) {
+		changes <- s
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := addrsOf(s); len(addrs) != 1 || addrs[0] != "10.0.0.1:9003" {
+		t.Fatalf("unexpected instances: %v", addrs)
+	}
+	expect := func(addrs ...string) {
+		t.Helper()
+		select {
+		case s := <-changes:
+			if fmt.Sprint(addrsOf(s)) != fmt.Sprint(addrs) {
+				t.Fatalf("unexpected instances: %v, expected %v", addrsOf(s), addrs)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("change to %v is not pushed", addrs)
+		}
+	}
+
+	// an instance which is not renewed expires, a renewed one stays
+	slowConfig := *registryConfig
+	slowConfig.RenewInterval = time.Hour
+	err = NewClient(addr, config.NewClientConfig(), &slowConfig).Register(context.Background(), Instance{Service: "echo", Addr: "10.0.0.2:9003", Weight: 2}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("10.0.0.1:9003", "10.0.0.2:9003")
+	expect("10.0.0.1:9003")
+	if services := r.Services(); len(services) != 1 || services[0] != "echo" {
+		t.Fatalf("unexpected services: %v", services)
+	}
+
+	if err = provider.Deregister(context.Background(), "echo", "10.0.0.1:9003", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expect()
+	if s, err = watcher.Query(context.Background(), "echo", time.Second); err != nil || len(s.Instances) != 0 {
+		t.Fatalf("unexpected query: %+v, %v", s, err)
+	}
+}
+
+func TestRegistryWatchers(t *testing.T) {
+	registryConfig := config.NewDefaultRegistryConfig()
+	_, addr := startTestRegistry(t, registryConfig)
+	c := NewClient(addr, config.NewClientConfig(), registryConfig)
+
+	// every listener of a service is passed its changes
+	first, second := make(chan *Service, 4), make(chan *Service, 4)
+	if _, err := c.Watch(context.Background(), "echo", func(s *Service) { first <- s }, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	_, cancel, err := c.watch(context.Background(), "echo", func(s *Service) { second <- s }, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(changes chan *Service, addrs ...string) {
+		t.Helper()
+		select {
+		case s := <-changes:
+			if fmt.Sprint(addrsOf(s)) != fmt.Sprint(addrs) {
+				t.Fatalf("unexpected instances: %v, expected %v", addrsOf(s), addrs)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("change to %v is not pushed", addrs)
+		}
+	}
+	provider := NewClient(addr, config.NewClientConfig(), registryConfig)
+	if err = provider.Register(context.Background(), Instance{Service: "echo", Addr: "10.0.0.1:9003"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expect(first, "10.0.0.1:9003")
+	expect(second, "10.0.0.1:9003")
+
+	// removing one of them leaves the other
+	cancel()
+	if err = provider.Deregister(context.Background(), "echo", "10.0.0.1:9003", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expect(first)
+	select {
+	case s := <-second:
+		t.Fatalf("removed listener is passed %+v", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestResolver(t *testing.T) {
+	registryConfig := config.NewDefaultRegistryConfig()
+	_, addr := startTestRegistry(t, registryConfig)
+	provider := NewClient(addr, config.NewClientConfig(), registryConfig)
+	err := provider.Register(context.Background(), Instance{Service: "echo", Addr: addr.String(), Weight: 2}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resolver config.Resolver = NewResolver(NewClient(addr, config.NewClientConfig(), registryConfig), time.Second)
+	endpoints, err := resolver.Resolve(context.Background(), "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0].Addr.String() != addr.String() || endpoints[0].Weight != 2 {
+		t.Fatalf("unexpected endpoints: %+v", endpoints)
+	}
+	changes := make(chan []config.Endpoint, 4)
+	cancel, err := resolver.Watch("echo", func(endpoints []config.Endpoint) {
+		changes <- endpoints
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	// the registry serves the service, a client resolving it calls the
+	// registry by name
+	clientConfig := config.NewClientConfig()
+	clientConfig.Resolver = resolver
+	c := tnet.NewRPCClient(clientConfig)
+	p := protocol.NewPacket(CodeQuery, nil, nil)
+	p.ExtData = map[string]string{keyService: "echo"}
+	if _, err = c.InvokeServiceSync(context.Background(), "echo", p, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = provider.Deregister(context.Background(), "echo", addr.String(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case endpoints = <-changes:
+		if len(endpoints) != 0 {
+			t.Fatalf("unexpected endpoints: %+v", endpoints)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("change is not notified")
+	}
+}
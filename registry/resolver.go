@@ -0,0 +1,55 @@
+package registry
+
+import (
+	"context"
+	"net"
+	"thunder/config"
+	"time"
+)
+
+// Resolver is a config.Resolver looking the services up in a registry, so
+// the clients can be invoked with service names.
+type Resolver struct {
+	client  *Client
+	timeout time.Duration
+}
+
+// NewResolver creates a resolver querying and watching the services with the
+// client, timeout bounds every query.
+func NewResolver(client *Client, timeout time.Duration) *Resolver {
+	return &Resolver{client: client, timeout: timeout}
+}
+
+func (r *Resolver) Resolve(ctx context.Context, service string) ([]config.Endpoint, error) {
+	s, err := r.client.Query(ctx, service, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return r.endpoints(s), nil
+}
+
+func (r *Resolver) Watch(service string, onChange func(endpoints []config.Endpoint)) (func(), error) {
+	_, cancel, err := r.client.watch(context.Background(), service, func(s *Service) {
+		onChange(r.endpoints(s))
+	}, r.timeout)
+	return cancel, err
+}
+
+// endpoints turns the instances of the service into endpoints, an instance
+// whose address does not resolve is logged and left out.
+func (r *Resolver) endpoints(s *Service) []config.Endpoint {
+	var endpoints []config.Endpoint
+	for _, i := range s.Instances {
+		addr, err := net.ResolveTCPAddr("tcp", i.Addr)
+		if err != nil {
+			r.client.logger.Warnf("resolve instance address error, service: %s, addr: %s, err: %v", s.Name, i.Addr, err)
+			continue
+		}
+		weight := i.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		endpoints = append(endpoints, config.Endpoint{Addr: addr, Weight: weight, Metadata: i.Metadata})
+	}
+	return endpoints
+}